@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* BlockRead and BlockWrite read and patch the raw blocks of the volume, in its
+ * own byte order and whatever the format of the image, so that on-disk
+ * structures can be examined and repaired without a hex editor.
+ */
+
+func printHexLine(address int, line []byte) {
+	ascii := make([]byte, len(line))
+	for i, b := range line {
+		ascii[i] = '.'
+		if b >= 0x20 && b < 0x7F {
+			ascii[i] = b
+		}
+	}
+	fmt.Printf("%08x  % -47x  |%s|\n", address, line, ascii)
+}
+
+func BlockRead(cmd *cobra.Command, args []string) {
+	if len(args) < 1 || len(args) > 2 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+	block, err := strconv.Atoi(args[0])
+	FatalErrCheck(err)
+	count := 1
+	if len(args) == 2 {
+		count, err = strconv.Atoi(args[1])
+		FatalErrCheck(err)
+	}
+
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	vl, err := r.GetVolumeLabel()
+	FatalErrCheck(err)
+	data, err := r.ReadBlocks(block, count)
+	FatalErrCheck(err)
+	notes, err := r.Annotate(block, count)
+	FatalErrCheck(err)
+
+	gran := int(vl.Gran)
+	start := block * gran
+	for i := 0; i < len(data); i += 16 {
+		if i%gran == 0 {
+			fmt.Printf("Block %d\n", block+i/gran)
+		}
+		for len(notes) > 0 && notes[0].Offset < i+16 {
+			fmt.Printf("          ; +%04x, %d bytes: %s\n", notes[0].Offset%gran, notes[0].Length, notes[0].Text)
+			notes = notes[1:]
+		}
+		printHexLine(start+i, data[i:min(i+16, len(data))])
+	}
+}
+
+func BlockWrite(cmd *cobra.Command, args []string) {
+	if len(args) != 1 || (fromFileName == "") == (hexBytes == "") {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+	block, err := strconv.Atoi(args[0])
+	FatalErrCheck(err)
+
+	var data []byte
+	if fromFileName != "" {
+		data, err = os.ReadFile(fromFileName)
+		FatalErrCheck(err)
+	} else {
+		data, err = hex.DecodeString(strings.Join(strings.Fields(hexBytes), ""))
+		FatalErrCheck(err)
+	}
+	if len(data) == 0 {
+		FatalErrCheck(fmt.Errorf("nothing to write"))
+	}
+
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	err = r.WriteBlocks(block, data)
+	FatalErrCheck(err)
+	SaveImage(r)
+	Infof("Wrote %d bytes at block %d\n", len(data), block)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+/* Dump prints the on-disk structures of the volume. With no options it prints
+ * all of them; the options select single structures. With --raw each field is
+ * shown next to the bytes that hold it.
+ */
+
+// printFields prints each field of a structure with its offset and bytes.
+func printFields(fields []rmximage.Field, data []byte) {
+	for _, field := range fields {
+		raw := []byte{}
+		if field.Offset+field.Length <= len(data) {
+			raw = data[field.Offset : field.Offset+field.Length]
+		}
+		fmt.Printf("%04x  %-29s  %-26s %s\n", field.Offset, fmt.Sprintf("% x", raw), field.Name, field.Value(data))
+	}
+}
+
+// printHexDump prints data in lines of 16 bytes, with addresses from zero.
+func printHexDump(data []byte) {
+	for i := 0; i < len(data); i += 16 {
+		printHexLine(i, data[i:min(i+16, len(data))])
+	}
+}
+
+func dumpIsoLabel(r *rmximage.RMXImage) {
+	if raw {
+		data, err := r.RawIsoLabel()
+		FatalErrCheck(err)
+		printFields(rmximage.IsoLabelFields, data)
+		return
+	}
+	ivl, err := r.GetIsoVolumeLabel()
+	FatalErrCheck(err)
+	ivl.Print(os.Stdout)
+}
+
+func dumpRmxLabel(r *rmximage.RMXImage) {
+	if raw {
+		data, err := r.RawRmxLabel()
+		FatalErrCheck(err)
+		printFields(rmximage.RmxLabelFields, data)
+		return
+	}
+	vl, err := r.GetVolumeLabel()
+	FatalErrCheck(err)
+	vl.Print(os.Stdout)
+}
+
+func dumpFNode(r *rmximage.RMXImage, fnode *rmximage.FNode) {
+	fmt.Printf("---- FNode %d ----\n", fnode.Number)
+	if raw {
+		data, err := r.RawFNode(fnode.Number)
+		FatalErrCheck(err)
+		printFields(rmximage.FNodeFields, data)
+		return
+	}
+	fnode.Print(os.Stdout)
+}
+
+func dumpVolMap(r *rmximage.RMXImage) {
+	if raw {
+		fnode, err := r.GetFNode(1)
+		FatalErrCheck(err)
+		data, err := r.ReadFile(fnode)
+		FatalErrCheck(err)
+		printHexDump(data)
+		return
+	}
+	vm, err := r.GetVolMap()
+	FatalErrCheck(err)
+	vm.Print(os.Stdout)
+}
+
+func dumpDirectory(r *rmximage.RMXImage, dirFNode *rmximage.FNode) {
+	if raw {
+		data, err := r.ReadFile(dirFNode)
+		FatalErrCheck(err)
+		dirList := &rmximage.Directory{}
+		FatalErrCheck(dirList.Deserialize(data, len(data)))
+		for i, entry := range dirList.Entries {
+			fmt.Printf("%04x  % x  %5d %s\n", i*16, data[i*16:i*16+16], entry.FNode, entry.Name)
+		}
+		return
+	}
+	dirList, err := r.GetDirectory(dirFNode)
+	FatalErrCheck(err)
+	dirList.Print(os.Stdout)
+}
+
+func dumpIndirect(r *rmximage.RMXImage, fnode *rmximage.FNode) {
+	entries, err := r.IndirectEntries(fnode)
+	FatalErrCheck(err)
+	block := -1
+	for _, entry := range entries {
+		if entry.Block != block {
+			fmt.Printf("Indirect block %d:\n", entry.Block)
+			block = entry.Block
+		}
+		if raw {
+			fmt.Printf("%04x  % x  ", entry.Offset, entry.Raw)
+		}
+		fmt.Printf("NumBlocks=%d, BlockPointer=%d\n", entry.NumBlocks, entry.BlockPointer)
+	}
+}
+
+func Dump(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	selected := showIso || showLabel || showVolMap || showDir != "" || showFNode >= 0 || showIndirect >= 0
+	if selected {
+		if showIso {
+			dumpIsoLabel(r)
+		}
+		if showLabel {
+			dumpRmxLabel(r)
+		}
+		if showFNode >= 0 {
+			fnode, err := r.GetFNode(showFNode)
+			FatalErrCheck(err)
+			dumpFNode(r, fnode)
+		}
+		if showIndirect >= 0 {
+			fnode, err := r.GetFNode(showIndirect)
+			FatalErrCheck(err)
+			dumpIndirect(r, fnode)
+		}
+		if showVolMap {
+			dumpVolMap(r)
+		}
+		if showDir != "" {
+			fnode, err := r.Lookup(nil, showDir)
+			FatalErrCheck(err)
+			dumpDirectory(r, fnode)
+		}
+		return
+	}
+
+	dumpIsoLabel(r)
+
+	fmt.Println("")
+
+	dumpRmxLabel(r)
+
+	vl, err := r.GetVolumeLabel()
+	FatalErrCheck(err)
+	for i := 0; i < int(vl.MaxFnode); i++ {
+		fnode, err := r.GetFNode(i)
+		if err != nil {
+			fmt.Println("Error getting FNode:", err)
+			os.Exit(-1)
+		}
+		if fnode.IsAllocated() {
+			fmt.Println("")
+			dumpFNode(r, fnode)
+		}
+	}
+
+	fmt.Println("\nVol Map:")
+
+	dumpVolMap(r)
+
+	fmt.Println("\nFNode Map:")
+
+	fm, err := r.GetFNodeMap()
+	FatalErrCheck(err)
+
+	fm.Print(os.Stdout)
+
+	fmt.Println("")
+
+	dirFNode, err := r.GetRootDirectory()
+	FatalErrCheck(err)
+
+	dumpDirectory(r, dirFNode)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+)
+
+// exitCodes are the exit statuses for errors that scripts may want to tell
+// apart. Other errors exit with 255.
+var exitCodes = []struct {
+	err  error
+	code int
+}{
+	{rmximage.ErrNotFound, 2},
+	{rmximage.ErrNotDirectory, 3},
+	{rmximage.ErrExists, 4},
+	{rmximage.ErrVolumeFull, 5},
+	{rmximage.ErrNoFreeFNode, 6},
+	{rmximage.ErrTooManyExtents, 7},
+	{rmximage.ErrCorrupt, 8},
+}
+
+func exitCode(err error) int {
+	for _, e := range exitCodes {
+		if errors.Is(err, e.err) {
+			return e.code
+		}
+	}
+	return -1
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"sort"
+)
+
+/* FSStat reports how fragmented a volume is and where its space goes: the free
+ * extents, which decide whether put --contig will fit, the extents of each
+ * file, and the space lost to the granularity of the volume.
+ */
+
+// typeName returns the name of an FNode type, or its number if it is unknown.
+func typeName(ftype int) string {
+	name, ok := rmximage.TypeNames[ftype]
+	if !ok {
+		return fmt.Sprintf("Unknown %d", ftype)
+	}
+	return name
+}
+
+// usage is the space used by a group of files.
+type usage struct {
+	files  int
+	bytes  int
+	blocks int
+	slack  int
+}
+
+func (u *usage) add(fs rmximage.FileStats) {
+	u.files++
+	u.bytes += fs.Size
+	u.blocks += fs.Blocks
+	u.slack += fs.Slack
+}
+
+func FSStat(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	stats, err := r.Stats()
+	FatalErrCheck(err)
+
+	largest := stats.LargestFree()
+	fmt.Printf("Blocks:              %d of %d bytes, %d free\n", stats.Blocks, stats.Gran, stats.FreeBlocks)
+	fmt.Printf("FNodes:              %d, %d free\n", stats.FNodes, stats.FreeFNodes)
+	fmt.Printf("Largest free extent: %d blocks (%d bytes)\n", largest, largest*stats.Gran)
+
+	// free extents are counted in buckets of 1, 2-3, 4-7, ... blocks
+	fmt.Printf("\n%-16s %8s\n", "Free extent", "Count")
+	fmt.Printf("%-16s %8s\n", "-----------", "-----")
+	for low := 1; low <= largest; low *= 2 {
+		high := low*2 - 1
+		count := 0
+		for _, n := range stats.FreeExtents {
+			if n >= low && n <= high {
+				count++
+			}
+		}
+		label := fmt.Sprintf("%d-%d blocks", low, high)
+		if low == 1 {
+			label = "1 block"
+		}
+		fmt.Printf("%-16s %8d\n", label, count)
+	}
+
+	byType := map[int]*usage{}
+	total := &usage{}
+	for _, fs := range stats.Files {
+		if byType[fs.Type] == nil {
+			byType[fs.Type] = &usage{}
+		}
+		byType[fs.Type].add(fs)
+		total.add(fs)
+	}
+	types := []int{}
+	for t := range byType {
+		types = append(types, t)
+	}
+	sort.Ints(types)
+	fmt.Printf("\n%-12s %6s %10s %8s %8s\n", "Type", "Files", "Bytes", "Blocks", "Slack")
+	fmt.Printf("%-12s %6s %10s %8s %8s\n", "----", "-----", "-----", "------", "-----")
+	for _, t := range types {
+		u := byType[t]
+		fmt.Printf("%-12s %6d %10d %8d %8d\n", typeName(t), u.files, u.bytes, u.blocks, u.slack)
+	}
+	fmt.Printf("%-12s %6d %10d %8d %8d\n", "Total", total.files, total.bytes, total.blocks, total.slack)
+
+	fmt.Printf("\n%-30s %6s %-10s %8s %7s %4s %6s\n", "Path", "FNode", "Type", "Size", "Extents", "Long", "Slack")
+	fmt.Printf("%-30s %6s %-10s %8s %7s %4s %6s\n", "----", "-----", "----", "----", "-------", "----", "-----")
+	for _, fs := range stats.Files {
+		name := fs.Path
+		if name == "" {
+			name = fmt.Sprintf("(FNode %d)", fs.FNode)
+		}
+		long := ""
+		if fs.Long {
+			long = "yes"
+		}
+		fmt.Printf("%-30s %6d %-10s %8d %7d %4s %6d\n", name, fs.FNode, typeName(fs.Type), fs.Size, fs.Extents, long, fs.Slack)
+	}
+	for _, skipped := range stats.Skipped {
+		fmt.Printf("Left out FNode %d %s: %s\n", skipped.FNode, skipped.Path, skipped.Reason)
+	}
+
+	if !byDir {
+		return
+	}
+	dirs := map[string]*usage{}
+	for _, fs := range stats.Files {
+		if fs.Dir == "" {
+			continue
+		}
+		if dirs[fs.Dir] == nil {
+			dirs[fs.Dir] = &usage{}
+		}
+		dirs[fs.Dir].add(fs)
+	}
+	dirNames := []string{}
+	for name := range dirs {
+		dirNames = append(dirNames, name)
+	}
+	sort.Strings(dirNames)
+	fmt.Printf("\n%-30s %6s %10s %8s %8s\n", "Directory", "Files", "Bytes", "Blocks", "Slack")
+	fmt.Printf("%-30s %6s %10s %8s %8s\n", "---------", "-----", "-----", "------", "-----")
+	for _, name := range dirNames {
+		u := dirs[name]
+		fmt.Printf("%-30s %6d %10d %8d %8d\n", name, u.files, u.bytes, u.blocks, u.slack)
+	}
+}
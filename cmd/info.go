@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+/* Info reports what rmxtool found out about an image while loading it, which is
+ * the first thing to look at when an image will not open the way it should.
+ */
+
+func Info(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	how := "detected"
+	if formatName != "" {
+		how = "given"
+	}
+	fmt.Printf("Image:        %s\n", imageFileName)
+	fmt.Printf("Format:       %s (%s)\n", r.GetFormat(), how)
+
+	g := r.GetGeometry()
+	if g != nil {
+		fmt.Printf("Geometry:     %s\n", g)
+	} else {
+		fmt.Printf("Geometry:     none, the image is the volume\n")
+	}
+	if r.GetOffset() != 0 {
+		fmt.Printf("Offset:       %d bytes\n", r.GetOffset())
+	}
+	fmt.Printf("Volume size:  %d bytes\n", r.Size())
+
+	switch {
+	case r.IsByteSwapDetected():
+		fmt.Printf("Byte order:   swapped (detected)\n")
+	case r.IsByteSwapped():
+		fmt.Printf("Byte order:   swapped (given)\n")
+	default:
+		fmt.Printf("Byte order:   normal\n")
+	}
+
+	err = r.CheckVolumeLabel()
+	if err != nil {
+		fmt.Printf("Volume label: not valid, %v\n", err)
+	} else {
+		vl, err := r.GetVolumeLabel()
+		FatalErrCheck(err)
+		fmt.Printf("Volume label: valid\n")
+		fmt.Printf("  Name:        %s\n", vl.Name)
+		fmt.Printf("  Granularity: %d\n", vl.Gran)
+		fmt.Printf("  Size:        %d\n", vl.Size)
+		fmt.Printf("  FNodes:      %d of %d bytes at %d\n", vl.MaxFnode, vl.FnodeSize, vl.FnodeStart)
+		fmt.Printf("  Root FNode:  %d\n", vl.RootFnode)
+	}
+
+	iso, err := r.GetIsoVolumeLabel()
+	if err != nil || iso.LabelId != "VOL" {
+		fmt.Printf("ISO label:    not present\n")
+	} else {
+		fmt.Printf("ISO label:    present\n")
+		fmt.Printf("  Name:        %s\n", iso.Name)
+		fmt.Printf("  Interleave:  %d\n", iso.Interleave)
+	}
+}
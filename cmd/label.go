@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"os"
+	"strings"
+)
+
+/* Label shows the RMX and ISO volume labels, and LabelSet changes the fields of
+ * them that can safely be changed, keeping the two names in step. The interleave
+ * of a volume that holds files is changed only with --force.
+ */
+
+func printLabels(r *rmximage.RMXImage) {
+	fmt.Println("RMX volume label:")
+	vl, err := r.GetVolumeLabel()
+	FatalErrCheck(err)
+	vl.Print(os.Stdout)
+
+	fmt.Println("\nISO volume label:")
+	ivl, err := r.GetIsoVolumeLabel()
+	FatalErrCheck(err)
+	ivl.Print(os.Stdout)
+}
+
+func Label(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	printLabels(r)
+}
+
+func LabelSet(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	for _, arg := range args {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			FatalErrCheck(fmt.Errorf("expected field=value, got %q", arg))
+		}
+		FatalErrCheck(r.SetLabelField(name, value, force))
+	}
+	SaveImage(r)
+	if !quiet {
+		printLabels(r)
+	}
+}
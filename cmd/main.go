@@ -1,23 +1,54 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/container"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
 	"github.com/sbelectronics/rmxtool/pkg/rmximage"
 	"github.com/spf13/cobra"
+	"log/slog"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 )
 
 var (
-	checkErrors    int
 	quiet          bool
+	verbose        bool
+	check          bool
+	reattach       bool
+	byDir          bool
+	mapWidth       int
+	legendFiles    int
+	fromFileName   string
+	hexBytes       string
+	raw            bool
+	force          bool
+	scrub          bool
+	showIso        bool
+	showLabel      bool
+	showVolMap     bool
+	showDir        string
+	showFNode      int
+	showIndirect   int
 	byteSwap       bool
 	contig         bool
+	salvage        bool
 	imageFileName  string
+	geometrySpec   string
+	toGeometrySpec string
+	formatName     string
+	offsetSpec     string
+	partition      int
+	toFormatName   string
 	outputFileName string
 	rmxDirectory   string
 	destName       string
+	reportFileName string
+	salvageReport  []string
+	treeErrors     int
 	rootCmd        = &cobra.Command{
 		Use:   "rmxtool",
 		Short: "Tool for modifying iRMX disk images",
@@ -89,6 +120,95 @@ var (
 		Run:   GetTree,
 	}
 
+	convertCmd = &cobra.Command{
+		Use:   "convert <output>",
+		Short: "Write the image to a new file, optionally in a different format or geometry",
+		Run:   Convert,
+	}
+
+	infoCmd = &cobra.Command{
+		Use:   "info",
+		Short: "Show the detected format, geometry, byte order and labels of the image",
+		Run:   Info,
+	}
+
+	scanCmd = &cobra.Command{
+		Use:   "scan",
+		Short: "List the iRMX volumes found in the image",
+		Run:   Scan,
+	}
+
+	orphansCmd = &cobra.Command{
+		Use:   "orphans",
+		Short: "List allocated FNodes that cannot be reached from the root, and optionally reattach them",
+		Run:   Orphans,
+	}
+
+	rebuildDirCmd = &cobra.Command{
+		Use:   "rebuilddir <path|fnode>",
+		Short: "Rebuild a damaged directory from the Parent fields of its FNodes",
+		Run:   RebuildDir,
+	}
+
+	fsstatCmd = &cobra.Command{
+		Use:   "fsstat",
+		Short: "Report free extents, file fragmentation and space lost to granularity",
+		Run:   FSStat,
+	}
+
+	mapCmd = &cobra.Command{
+		Use:   "map",
+		Short: "Draw a map of the blocks of the volume, in the terminal or as SVG or PNG",
+		Run:   Map,
+	}
+
+	whoOwnsCmd = &cobra.Command{
+		Use:   "whoowns <block|0xoffset>...",
+		Short: "Find the file that holds a block, or a byte offset given in hex",
+		Run:   WhoOwns,
+	}
+
+	blockCmd = &cobra.Command{
+		Use:   "block",
+		Short: "Read or write raw blocks of the volume",
+	}
+
+	blockReadCmd = &cobra.Command{
+		Use:   "read <block> [count]",
+		Short: "Hexdump blocks, decoding the structures they hold",
+		Run:   BlockRead,
+	}
+
+	blockWriteCmd = &cobra.Command{
+		Use:   "write <block> --from <file> | --hex <bytes>",
+		Short: "Write bytes over blocks, starting at the beginning of a block",
+		Run:   BlockWrite,
+	}
+
+	setFNodeCmd = &cobra.Command{
+		Use:   "setfnode <fnode> <field=value>...",
+		Short: "Change fields of an FNode, as named by dump --raw",
+		Run:   SetFNode,
+	}
+
+	labelCmd = &cobra.Command{
+		Use:   "label",
+		Short: "Show the volume labels",
+		Run:   Label,
+	}
+
+	labelSetCmd = &cobra.Command{
+		Use:   "set <field=value>...",
+		Short: "Change the volume labels: name, isoname, fill, side or interleave",
+		Run:   LabelSet,
+	}
+
+	scrubCmd = &cobra.Command{
+		Use:   "scrub",
+		Short: "Overwrite free blocks, unused directory entries and free FNodes",
+		Run:   Scrub,
+	}
+
 	incFnodeCmd = &cobra.Command{
 		Use:   "incfnode",
 		Short: "Increase the number of FNodes in the image",
@@ -99,7 +219,7 @@ var (
 func FatalErrCheck(err error) {
 	if err != nil {
 		fmt.Println("Fatal error:", err)
-		os.Exit(-1)
+		os.Exit(exitCode(err))
 	}
 }
 
@@ -110,61 +230,50 @@ func Infof(format string, args ...interface{}) {
 	fmt.Printf(format, args...)
 }
 
-func Dump(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
-	FatalErrCheck(err)
-
-	ivl, err := r.GetIsoVolumeLabel()
-	FatalErrCheck(err)
-	ivl.Print()
-
-	fmt.Println("")
-
-	vl, err := r.GetVolumeLabel()
-	FatalErrCheck(err)
-	vl.Print()
+// NewLogger returns the logger for the library's debug and progress events,
+// which go to stderr so they never mix with data written to stdout.
+func NewLogger() *slog.Logger {
+	if quiet {
+		return nil
+	}
+	level := slog.LevelWarn
+	if verbose {
+		level = slog.LevelDebug
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
 
-	for i := 0; i < int(vl.MaxFnode); i++ {
-		fnode, err := r.GetFNode(i)
+// LoadImage loads the image named by the global flags.
+func LoadImage() (*rmximage.RMXImage, error) {
+	r := rmximage.NewRMXImage()
+	r.SetLogger(NewLogger())
+	if geometrySpec != "" {
+		g, err := geometry.Parse(geometrySpec)
 		if err != nil {
-			fmt.Println("Error getting FNode:", err)
-			os.Exit(-1)
+			return nil, err
 		}
-		if fnode.IsAllocated() {
-			fmt.Println("")
-			fmt.Printf("---- FNode %d ----\n", i)
-			fnode.Print()
+		r.SetGeometry(g)
+	}
+	r.SetFormat(formatName)
+	if offsetSpec != "" {
+		offset, err := strconv.ParseInt(offsetSpec, 0, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid offset '%s': %w", offsetSpec, err)
 		}
+		r.SetOffset(int(offset))
 	}
-
-	fmt.Println("\nVol Map:")
-
-	vm, err := r.GetVolMap()
-	FatalErrCheck(err)
-	vm.Print()
-
-	fmt.Println("\nFNode Map:")
-
-	fm, err := r.GetFNodeMap()
-	FatalErrCheck(err)
-
-	fm.Print()
-
-	fmt.Println("")
-
-	dirFNode, err := r.GetRootDirectory()
-	FatalErrCheck(err)
-
-	dirList, err := r.GetDirectory(dirFNode)
-	FatalErrCheck(err)
-
-	dirList.Print()
+	r.SetPartition(partition)
+	// an explicit --byteswap, true or false, turns off byte order detection
+	r.SetDetectByteOrder(!rootCmd.PersistentFlags().Changed("byteswap"))
+	err := r.Load(imageFileName, byteSwap)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func Stat(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	if len(args) != 1 {
@@ -175,7 +284,7 @@ func Stat(cmd *cobra.Command, args []string) {
 	fnode, err := r.Lookup(nil, args[0])
 	FatalErrCheck(err)
 
-	fnode.Print()
+	fnode.Print(os.Stdout)
 
 	_, err = r.ReadFile(fnode)
 	FatalErrCheck(err)
@@ -194,8 +303,7 @@ func Stat(cmd *cobra.Command, args []string) {
 }
 
 func Dir(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	dirName := ""
@@ -209,20 +317,27 @@ func Dir(cmd *cobra.Command, args []string) {
 	dirList, err := r.GetDirectory(fnode)
 	FatalErrCheck(err)
 
-	dirList.PrintLong()
+	dirList.PrintLong(os.Stdout)
 }
 
 func Get(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	for _, arg := range args {
 		fnode, err := r.Lookup(nil, arg)
 		FatalErrCheck(err)
 
-		data, err := r.ReadFile(fnode)
-		FatalErrCheck(err)
+		var data []byte
+		if salvage {
+			var problems []string
+			data, problems, err = r.SalvageFile(fnode)
+			FatalErrCheck(err)
+			AddToSalvageReport(arg, fnode.Number, problems...)
+		} else {
+			data, err = r.ReadFile(fnode)
+			FatalErrCheck(err)
+		}
 
 		if fnode.Name == "" {
 			fmt.Printf("You have encountered the man with no name. Run.\n")
@@ -254,10 +369,55 @@ func Get(cmd *cobra.Command, args []string) {
 			os.Exit(-1)
 		}
 
-		Infof("Wrote %d bytes to %s\n", len(data), outputFileName)
+		if f == os.Stdout {
+			if !quiet {
+				fmt.Fprintf(os.Stderr, "Wrote %d bytes to %s\n", len(data), outputFileName)
+			}
+		} else {
+			Infof("Wrote %d bytes to %s\n", len(data), outputFileName)
+		}
+	}
+
+	if salvage {
+		err = WriteSalvageReport()
+		FatalErrCheck(err)
+	}
+}
+
+// AddToSalvageReport records the problems that were encountered while salvaging
+// a file. Nothing is recorded if there were no problems.
+func AddToSalvageReport(pathName string, fnodeNumber int, problems ...string) {
+	for _, problem := range problems {
+		salvageReport = append(salvageReport, fmt.Sprintf("%s (FNode %d): %s", pathName, fnodeNumber, problem))
 	}
 }
 
+// WriteSalvageReport writes the accumulated salvage report to reportFileName.
+func WriteSalvageReport() error {
+	f, err := os.OpenFile(reportFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("Error opening report file %s: %v", reportFileName, err)
+	}
+	defer func() {
+		err := f.Close()
+		FatalErrCheck(err)
+	}()
+
+	if len(salvageReport) == 0 {
+		_, err = fmt.Fprintf(f, "All files were recovered completely.\n")
+		return err
+	}
+	for _, line := range salvageReport {
+		_, err = fmt.Fprintln(f, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	Infof("%d problems were encountered, see %s\n", len(salvageReport), reportFileName)
+	return nil
+}
+
 func GetParentDir(r *rmximage.RMXImage, dirName string) (*rmximage.FNode, error) {
 	var dirFNode *rmximage.FNode
 	if dirName != "" && dirName != "." {
@@ -268,7 +428,7 @@ func GetParentDir(r *rmximage.RMXImage, dirName string) (*rmximage.FNode, error)
 		}
 
 		if !dirFNode.IsDirectory() {
-			return nil, fmt.Errorf("specified directory %s is not a directory", dirName)
+			return nil, fmt.Errorf("specified directory %s %w", dirName, rmximage.ErrNotDirectory)
 		}
 		return dirFNode, nil
 	} else {
@@ -279,8 +439,7 @@ func GetParentDir(r *rmximage.RMXImage, dirName string) (*rmximage.FNode, error)
 }
 
 func Put(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	for _, arg := range args {
@@ -305,9 +464,11 @@ func Put(cmd *cobra.Command, args []string) {
 		fnode, err := r.Lookup(dirFNode, fileName)
 		if err == nil {
 			// The file already exists
-			fmt.Printf("Deleting file %s in directory %s so we can re-PUT it\n", fileName, dirFNode.Name)
+			Infof("Deleting file %s in directory %s so we can re-PUT it\n", fileName, dirFNode.Name)
 			err = r.DeleteFNode(fnode)
 			FatalErrCheck(err)
+		} else if !errors.Is(err, rmximage.ErrNotFound) {
+			FatalErrCheck(err)
 		}
 
 		fnode, err = r.PutFile(dirFNode, fileName, data, contig)
@@ -316,14 +477,13 @@ func Put(cmd *cobra.Command, args []string) {
 		Infof("Stored %d bytes to FNode %d (%s)\n", len(data), fnode.Number, fnode.Name)
 	}
 
-	err = r.Save()
-	FatalErrCheck(err)
+	SaveImage(r)
 }
 
 func Delete(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
+	r.SetScrub(scrub)
 
 	for _, arg := range args {
 		fnode, err := r.Lookup(nil, arg)
@@ -333,13 +493,11 @@ func Delete(cmd *cobra.Command, args []string) {
 		FatalErrCheck(err)
 	}
 
-	err = r.Save()
-	FatalErrCheck(err)
+	SaveImage(r)
 }
 
 func Mkdir(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	for _, arg := range args {
@@ -353,8 +511,7 @@ func Mkdir(cmd *cobra.Command, args []string) {
 		FatalErrCheck(err)
 	}
 
-	err = r.Save()
-	FatalErrCheck(err)
+	SaveImage(r)
 }
 
 func WipeFNode(fnode *rmximage.FNode) error {
@@ -389,8 +546,7 @@ func WipeFNode(fnode *rmximage.FNode) error {
 }
 
 func Wipe(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	rootDir, err := r.GetRootDirectory()
@@ -399,25 +555,55 @@ func Wipe(cmd *cobra.Command, args []string) {
 	err = WipeFNode(rootDir)
 	FatalErrCheck(err)
 
-	err = r.Save()
-	FatalErrCheck(err)
+	SaveImage(r)
 }
 
 func CheckDisk(cmd *cobra.Command, args []string) {
-	checkErrors = 0
-	c := &Checker{}
-	c.CheckDisk1()
-	if checkErrors > 0 {
-		fmt.Printf("Disk check completed with %d errors.\n", checkErrors)
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	vl, err := r.GetVolumeLabel()
+	if err == nil {
+		Infof("Volume Name: %s\n", vl.Name)
+	}
+
+	findings := r.Check()
+	errorCount := 0
+	for _, finding := range findings {
+		fmt.Printf("  %s\n", finding)
+		if finding.Severity == rmximage.SeverityError {
+			errorCount++
+		}
+	}
+	if errorCount > 0 {
+		fmt.Printf("Disk check completed with %d errors and %d warnings.\n", errorCount, len(findings)-errorCount)
 		os.Exit(1)
+	} else if len(findings) > 0 {
+		Infof("Disk check completed successfully, no errors found, %d warnings.\n", len(findings))
 	} else {
 		Infof("Disk check completed successfully, no errors found.\n")
 	}
 }
 
+// SaveImage saves the changes made to the image. With --check, the volume is
+// checked first and is not saved if the changes left it with errors.
+func SaveImage(r *rmximage.RMXImage) {
+	if check {
+		findings := r.Check()
+		if rmximage.HasErrors(findings) {
+			for _, finding := range findings {
+				fmt.Printf("  %s\n", finding)
+			}
+			fmt.Println("Fatal error: the volume has errors, it was not saved")
+			os.Exit(1)
+		}
+	}
+	err := r.Save()
+	FatalErrCheck(err)
+}
+
 func Free(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	freeBlocks := 0
@@ -444,35 +630,93 @@ func Free(cmd *cobra.Command, args []string) {
 }
 
 func GetTree(cmd *cobra.Command, args []string) {
-	r := rmximage.NewRMXImage()
-	err := r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	vl, err := r.GetVolumeLabel()
 	FatalErrCheck(err)
 
-	err = GetDirFNode(r, int(vl.RootFnode), "")
+	treeErrors = 0
+	err = GetDirFNode(r, int(vl.RootFnode), "", map[int]bool{}, map[int]string{})
 	FatalErrCheck(err)
+
+	if salvage {
+		err = WriteSalvageReport()
+		FatalErrCheck(err)
+	} else if treeErrors > 0 {
+		FatalErrCheck(fmt.Errorf("%d entries could not be extracted, use --salvage to recover what can be", treeErrors))
+	}
 }
 
-func GetDirFNode(r *rmximage.RMXImage, fnodeNumber int, pathName string) error {
+// treeProblem records an entry that gettree could not extract, in the salvage
+// report or on the screen.
+func treeProblem(pathName string, fnodeNumber int, err error) {
+	if salvage {
+		AddToSalvageReport(pathName, fnodeNumber, err.Error()+", skipped")
+		return
+	}
+	fmt.Printf("  Error: %s (FNode %d): %v\n", pathName, fnodeNumber, err)
+	treeErrors++
+}
+
+// GetDirFNode extracts FNode fnodeNumber, and if it is a directory everything in
+// it, to pathName. ancestors are the directories above it, so that a directory
+// that contains itself is not followed. extracted holds the path each FNode was
+// first extracted to: a file linked from two directories is written to both, but
+// a directory is walked only once. Problems with the tree go to treeProblem; the
+// error returned is for problems writing the files.
+func GetDirFNode(r *rmximage.RMXImage, fnodeNumber int, pathName string, ancestors map[int]bool, extracted map[int]string) error {
+	if ancestors[fnodeNumber] {
+		treeProblem(pathName, fnodeNumber, fmt.Errorf("directory contains itself"))
+		return nil
+	}
+
 	fnode, err := r.GetFNode(fnodeNumber)
 	if err != nil {
-		return fmt.Errorf("  Error getting FNode %d: %v\n", fnodeNumber, err)
+		treeProblem(pathName, fnodeNumber, fmt.Errorf("cannot get FNode: %w", err))
+		return nil
 	}
 	if !fnode.IsAllocated() {
-		return fmt.Errorf("  Error: FNode %d is not allocated.\n", fnodeNumber)
+		treeProblem(pathName, fnodeNumber, fmt.Errorf("FNode is not allocated"))
+		return nil
+	}
+	if other, ok := extracted[fnodeNumber]; ok {
+		if fnode.IsDirectory() {
+			treeProblem(pathName, fnodeNumber, fmt.Errorf("directory is also linked as %q", other))
+			return nil
+		}
+		if salvage {
+			AddToSalvageReport(pathName, fnodeNumber, fmt.Sprintf("file is also linked as %q, extracted again", other))
+		}
+		Infof("File %s is also linked as %s\n", pathName, other)
+	} else {
+		extracted[fnodeNumber] = pathName
+	}
+
+	var data []byte
+	if salvage {
+		var problems []string
+		data, problems, err = r.SalvageFile(fnode)
+		AddToSalvageReport(pathName, fnodeNumber, problems...)
+	} else {
+		data, err = r.ReadFile(fnode)
 	}
-	data, err := r.ReadFile(fnode)
 	if err != nil {
-		return fmt.Errorf("  Error reading file for FNode %d: %v\n", fnodeNumber, err)
+		treeProblem(pathName, fnodeNumber, fmt.Errorf("cannot read file: %w", err))
+		return nil
 	}
 	if fnode.IsDirectory() {
-		dirList, err := r.GetDirectory(fnode)
+		dirList := &rmximage.Directory{}
+		err = dirList.Deserialize(data, len(data))
 		if err != nil {
-			return fmt.Errorf("Error getting directory: %v\n", err)
+			treeProblem(pathName, fnodeNumber, fmt.Errorf("cannot read directory: %w", err))
+			return nil
 		}
 		fmt.Printf("Processing dir %s\n", pathName)
+		below := map[int]bool{fnodeNumber: true}
+		for n := range ancestors {
+			below[n] = true
+		}
 		for _, entry := range dirList.Entries {
 			var newPathName string
 			if pathName == "" {
@@ -481,7 +725,10 @@ func GetDirFNode(r *rmximage.RMXImage, fnodeNumber int, pathName string) error {
 				newPathName = path.Join(pathName, entry.Name)
 			}
 			if entry.FNode != 0 {
-				GetDirFNode(r, int(entry.FNode), newPathName)
+				err := GetDirFNode(r, int(entry.FNode), newPathName, below, extracted)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	} else if fnode.FType != rmximage.TypeData {
@@ -501,7 +748,7 @@ func GetDirFNode(r *rmximage.RMXImage, fnodeNumber int, pathName string) error {
 		}
 		f, err := os.OpenFile(pathName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
-			return fmt.Errorf("Error opening output file %s: %v", outputFileName, err)
+			return fmt.Errorf("Error opening output file %s: %v", pathName, err)
 		}
 		defer func() {
 			err := f.Close()
@@ -525,8 +772,7 @@ func IncFnode(cmd *cobra.Command, args []string) {
 		os.Exit(-1)
 	}
 
-	r := rmximage.NewRMXImage()
-	err = r.Load(imageFileName, byteSwap)
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
 	vl, err := r.GetVolumeLabel()
@@ -537,60 +783,43 @@ func IncFnode(cmd *cobra.Command, args []string) {
 		os.Exit(-1)
 	}
 
-	fnode, err := r.GetFNode(0)
-	FatalErrCheck(err)
-
-	data, err := r.ReadFile(fnode)
+	err = r.GrowFNodes(newFnodeCount)
 	FatalErrCheck(err)
 
-	err = r.TruncateFNode(fnode)
-	FatalErrCheck(err)
-
-	newSize := uint32(newFnodeCount) * uint32(vl.FnodeSize)
-	padding := make([]byte, newSize-uint32(len(data)))
-	data = append(data, padding...)
-
-	err = r.PutData(fnode, data, true) // side-effect will write fnode to old location
-	FatalErrCheck(err)
-
-	// update the volume label, do this before fnode.Update() so it writes to the
-	// correcy place.
-	origMaxFnode := vl.MaxFnode
-	vl.FnodeStart = uint32(fnode.Pointers[0].BlockPointer) * uint32(vl.Gran)
-	vl.MaxFnode = uint16(newFnodeCount)
-	err = vl.Update()
-	FatalErrCheck(err)
-
-	err = fnode.Update()
-	FatalErrCheck(err)
-
-	// make the fnode map bigger
-
-	fmfnode, err := r.GetFNode(2) // FNodeMap
-	FatalErrCheck(err)
+	SaveImage(r)
+}
 
-	fmfnode.TotalSize = uint32(newFnodeCount+7) / uint32(8)
+func Convert(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
 
-	err = fmfnode.Update()
+	r, err := LoadImage()
 	FatalErrCheck(err)
 
-	fm, err := r.GetFNodeMap()
-	FatalErrCheck(err)
-	for i := origMaxFnode; i < uint16(newFnodeCount); i++ {
-		fm.SetAlloc(int(i), false)
+	var g *geometry.Geometry
+	if toGeometrySpec != "" {
+		g, err = geometry.Parse(toGeometrySpec)
+		FatalErrCheck(err)
 	}
 
-	err = fm.Update()
+	err = r.SaveAs(args[0], toFormatName, g)
 	FatalErrCheck(err)
 
-	err = r.Save()
-	FatalErrCheck(err)
+	Infof("Converted %s to %s\n", imageFileName, args[0])
 }
 
 func main() {
 	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Hide nonessential output")
-	rootCmd.PersistentFlags().BoolVarP(&byteSwap, "byteswap", "b", false, "Swap low and high bytes")
+	rootCmd.PersistentFlags().BoolVarP(&check, "check", "", false, "Check the volume before saving changes, and do not save it if it has errors")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log what is done to the image to stderr")
+	rootCmd.PersistentFlags().BoolVarP(&byteSwap, "byteswap", "b", false, "Swap low and high bytes (detected if not given)")
 	rootCmd.PersistentFlags().StringVarP(&imageFileName, "filename", "f", "test.img", "RMX image file to use")
+	rootCmd.PersistentFlags().StringVarP(&formatName, "format", "", "", "image format ("+strings.Join(container.Names(), ", ")+"), detected if not given")
+	rootCmd.PersistentFlags().StringVarP(&geometrySpec, "geometry", "g", "", "disk geometry, a preset ("+strings.Join(geometry.PresetNames(), ", ")+") optionally followed by key=value settings")
+	rootCmd.PersistentFlags().StringVarP(&offsetSpec, "offset", "", "", "offset in bytes of the volume within the image, for hard disk images (0x for hex)")
+	rootCmd.PersistentFlags().IntVarP(&partition, "partition", "", 0, "volume within the image to use, numbered as listed by scan")
 	rootCmd.AddCommand(dumpCmd)
 	rootCmd.AddCommand(statCmd)
 	rootCmd.AddCommand(dirCmd)
@@ -603,10 +832,48 @@ func main() {
 	rootCmd.AddCommand(freeCmd)
 	rootCmd.AddCommand(getTreeCmd)
 	rootCmd.AddCommand(incFnodeCmd)
+	rootCmd.AddCommand(convertCmd)
+	rootCmd.AddCommand(infoCmd)
+	rootCmd.AddCommand(scanCmd)
+	rootCmd.AddCommand(orphansCmd)
+	rootCmd.AddCommand(rebuildDirCmd)
+	rootCmd.AddCommand(fsstatCmd)
+	rootCmd.AddCommand(mapCmd)
+	rootCmd.AddCommand(whoOwnsCmd)
+	rootCmd.AddCommand(blockCmd)
+	rootCmd.AddCommand(setFNodeCmd)
+	rootCmd.AddCommand(labelCmd)
+	rootCmd.AddCommand(scrubCmd)
+	labelCmd.AddCommand(labelSetCmd)
+	blockCmd.AddCommand(blockReadCmd)
+	blockCmd.AddCommand(blockWriteCmd)
 
 	getCmd.PersistentFlags().StringVarP(&outputFileName, "output", "o", "", "output filename")
+	getCmd.PersistentFlags().BoolVarP(&salvage, "salvage", "s", false, "Recover as much as possible from damaged files")
+	getCmd.PersistentFlags().StringVarP(&reportFileName, "report", "r", "salvage-report.txt", "file to write the salvage report to")
+	getTreeCmd.PersistentFlags().BoolVarP(&salvage, "salvage", "s", false, "Continue past errors and recover as much as possible")
+	getTreeCmd.PersistentFlags().StringVarP(&reportFileName, "report", "r", "salvage-report.txt", "file to write the salvage report to")
 	putCmd.PersistentFlags().StringVarP(&rmxDirectory, "directory", "d", "", "parent directory to use in RMX image")
 	putCmd.PersistentFlags().StringVarP(&destName, "name", "n", "", "name to use when putting file in RMX image (defaults to basename of file)")
+	convertCmd.PersistentFlags().StringVarP(&toGeometrySpec, "to-geometry", "t", "", "geometry of the output image (defaults to the geometry of the input image)")
+	convertCmd.PersistentFlags().StringVarP(&toFormatName, "to-format", "", "", "format of the output image (defaults to detecting it from the file extension)")
+	orphansCmd.PersistentFlags().BoolVarP(&reattach, "reattach", "", false, "Link the orphans into their parent directory, or into /"+rmximage.LostFoundName)
+	fsstatCmd.PersistentFlags().BoolVarP(&byDir, "by-dir", "", false, "Also total the space used in each directory")
+	mapCmd.PersistentFlags().StringVarP(&outputFileName, "output", "o", "", "write the map to a .svg or .png file instead of the terminal")
+	mapCmd.PersistentFlags().IntVarP(&mapWidth, "width", "w", 64, "blocks per row")
+	mapCmd.PersistentFlags().IntVarP(&legendFiles, "legend", "l", 0, "give the largest data files colors of their own, up to 9")
+	blockWriteCmd.PersistentFlags().StringVarP(&fromFileName, "from", "", "", "file holding the bytes to write")
+	blockWriteCmd.PersistentFlags().StringVarP(&hexBytes, "hex", "", "", "bytes to write, in hex, optionally separated by spaces")
+	dumpCmd.PersistentFlags().BoolVarP(&raw, "raw", "", false, "Show the bytes of each structure next to its fields")
+	dumpCmd.PersistentFlags().BoolVarP(&showIso, "iso", "", false, "Dump the ISO volume label")
+	dumpCmd.PersistentFlags().BoolVarP(&showLabel, "label", "", false, "Dump the RMX volume label")
+	dumpCmd.PersistentFlags().BoolVarP(&showVolMap, "volmap", "", false, "Dump the VolMap")
+	dumpCmd.PersistentFlags().StringVarP(&showDir, "dir", "", "", "Dump the entries of a directory")
+	dumpCmd.PersistentFlags().IntVarP(&showFNode, "fnode", "", -1, "Dump an FNode")
+	dumpCmd.PersistentFlags().IntVarP(&showIndirect, "indirect", "", -1, "Dump the indirect blocks of a long file, given its FNode")
+	setFNodeCmd.PersistentFlags().BoolVarP(&force, "force", "", false, "Allow the system FNodes, 0 to 5, to be changed")
+	labelSetCmd.PersistentFlags().BoolVarP(&force, "force", "", false, "Allow the interleave of a volume that holds files to be changed")
+	deleteCmd.PersistentFlags().BoolVarP(&scrub, "scrub", "", false, "Zero the blocks of the file and its name in the directory")
 	putCmd.PersistentFlags().BoolVarP(&contig, "contig", "c", false, "Allocate contiguous blocks for the file in the RMX image")
 
 	err := rootCmd.Execute()
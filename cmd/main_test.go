@@ -0,0 +1,137 @@
+package main
+
+import (
+	"github.com/sbelectronics/rmxtool/internal/testvolume"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type MainSuite struct {
+	suite.Suite
+}
+
+func (s *MainSuite) TearDownTest() {
+	imageFileName = ""
+	offsetSpec = ""
+	partition = 0
+	salvage = false
+	salvageReport = nil
+	reportFileName = ""
+}
+
+func (s *MainSuite) TestLoadImageRegion() {
+	disk := make([]byte, 0x10000)
+	testvolume.Label(disk[0x2000:], "FIRST", 0x2000)
+	testvolume.Label(disk[0x6000:], "SECOND", 0x1000)
+	imageFileName = filepath.Join(s.T().TempDir(), "disk.img")
+	s.Require().NoError(os.WriteFile(imageFileName, disk, 0644))
+
+	cases := []struct {
+		offset    string
+		partition int
+		expected  int
+		size      int
+		name      string
+	}{
+		{"0x2000", 0, 0x2000, 0x2000, "FIRST"},
+		{"8192", 0, 0x2000, 0x2000, "FIRST"},
+		{"", 1, 0x2000, 0x2000, "FIRST"},
+		{"", 2, 0x6000, 0x1000, "SECOND"},
+		{"0x6000", 0, 0x6000, 0x1000, "SECOND"},
+	}
+	for _, c := range cases {
+		offsetSpec = c.offset
+		partition = c.partition
+		r, err := LoadImage()
+		s.Require().NoError(err, "%+v", c)
+		s.Equal(c.expected, r.GetOffset(), "%+v", c)
+		s.Equal(c.size, r.Size(), "%+v", c)
+		vl, err := r.GetVolumeLabel()
+		s.Require().NoError(err)
+		s.Equal(c.name, vl.Name)
+	}
+
+	offsetSpec, partition = "0x", 0
+	_, err := LoadImage()
+	s.ErrorContains(err, "invalid offset '0x'")
+	offsetSpec, partition = "", 3
+	_, err = LoadImage()
+	s.ErrorContains(err, "partition 3 not found, the image holds 2 volumes")
+	offsetSpec, partition = "0x10000", 0
+	_, err = LoadImage()
+	s.ErrorContains(err, "outside of the image")
+}
+
+func (s *MainSuite) TestGetTreeSalvage() {
+	dir := s.T().TempDir()
+	imageFileName = filepath.Join(dir, "loop.img")
+	s.Require().NoError(os.WriteFile(imageFileName, testvolume.Make(), 0644))
+
+	// sub holds a link back to the root, a second link to hello.txt and an
+	// FNode beyond the end of the FNode file
+	r, err := LoadImage()
+	s.Require().NoError(err)
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	sub, err := r.Mkdir(root, "sub")
+	s.Require().NoError(err)
+	subDir, err := r.GetDirectory(sub)
+	s.Require().NoError(err)
+	for _, link := range []struct {
+		fnode int
+		name  string
+	}{{testvolume.RootFNode, "up"}, {testvolume.HelloFNode, "again.txt"}, {200, "gone"}} {
+		_, err = subDir.AddEntry(link.fnode, link.name)
+		s.Require().NoError(err)
+	}
+	s.Require().NoError(subDir.Update())
+	s.Require().NoError(r.Save())
+
+	s.T().Chdir(dir)
+	salvage = true
+	reportFileName = filepath.Join(dir, "report.txt")
+	GetTree(getTreeCmd, nil)
+
+	for _, name := range []string{"hello.txt", "sub/again.txt"} {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		s.Require().NoError(err)
+		s.Equal("hello", string(data))
+	}
+	report, err := os.ReadFile(reportFileName)
+	s.Require().NoError(err)
+	s.Equal([]string{
+		`sub/up (FNode 6): directory contains itself, skipped`,
+		`sub/again.txt (FNode 7): file is also linked as "hello.txt", extracted again`,
+		`sub/gone (FNode 200): cannot get FNode: FNode 200 does not exist, the volume has 10: not found, skipped`,
+	}, strings.Split(strings.TrimSpace(string(report)), "\n"))
+}
+
+func (s *MainSuite) TestCheckDiskWarnings() {
+	// hello.txt names the wrong parent, which is only a warning
+	imageFileName = filepath.Join(s.T().TempDir(), "warn.img")
+	s.Require().NoError(os.WriteFile(imageFileName, testvolume.Make(), 0644))
+	r, err := LoadImage()
+	s.Require().NoError(err)
+	hello, err := r.GetFNode(testvolume.HelloFNode)
+	s.Require().NoError(err)
+	hello.Parent = 0
+	s.Require().NoError(r.PutFNode(testvolume.HelloFNode, hello))
+	s.Require().NoError(r.Save())
+
+	r, err = LoadImage()
+	s.Require().NoError(err)
+	findings := r.Check()
+	s.Require().Len(findings, 1)
+	s.Equal(rmximage.SeverityWarning, findings[0].Severity)
+
+	// chkdsk returns rather than exiting with an error
+	CheckDisk(chkdskCmd, nil)
+}
+
+func TestMainSuite(t *testing.T) {
+	suite.Run(t, new(MainSuite))
+}
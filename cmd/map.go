@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+/* Map draws every block of the volume as a cell of a grid, colored by what the
+ * block is used for. The grid is printed with ANSI colors, or written as SVG or
+ * PNG when an output file is given. The largest files can be given colors of
+ * their own.
+ */
+
+const mapCellSize = 8 // pixels per block in SVG and PNG maps
+
+var ownerColors = map[rmximage.Owner]color.RGBA{
+	rmximage.OwnerFree:      {0xE0, 0xE0, 0xE0, 0xFF},
+	rmximage.OwnerSystem:    {0x60, 0x60, 0xC0, 0xFF},
+	rmximage.OwnerDirectory: {0xE0, 0xC0, 0x20, 0xFF},
+	rmximage.OwnerData:      {0x40, 0xA0, 0x40, 0xFF},
+	rmximage.OwnerLost:      {0x90, 0x60, 0x30, 0xFF},
+	rmximage.OwnerBad:       {0x20, 0x20, 0x20, 0xFF},
+	rmximage.OwnerShared:    {0xE0, 0x20, 0x20, 0xFF},
+}
+
+// ownerChars are drawn in the terminal, so that the map can be read without color.
+var ownerChars = map[rmximage.Owner]byte{
+	rmximage.OwnerFree:      '.',
+	rmximage.OwnerSystem:    'S',
+	rmximage.OwnerDirectory: 'D',
+	rmximage.OwnerData:      'd',
+	rmximage.OwnerLost:      'L',
+	rmximage.OwnerBad:       'B',
+	rmximage.OwnerShared:    'X',
+}
+
+// fileColors are given to the largest files, in order.
+var fileColors = []color.RGBA{
+	{0x00, 0xB0, 0xB0, 0xFF},
+	{0xC0, 0x40, 0xC0, 0xFF},
+	{0xF0, 0x80, 0x20, 0xFF},
+	{0x80, 0xC0, 0xF0, 0xFF},
+	{0xA0, 0xE0, 0x60, 0xFF},
+	{0xF0, 0xA0, 0xC0, 0xFF},
+	{0x20, 0x60, 0x60, 0xFF},
+	{0x80, 0x80, 0x00, 0xFF},
+	{0x60, 0x20, 0x80, 0xFF},
+}
+
+// mapEntry is a line of the legend.
+type mapEntry struct {
+	char  byte
+	color color.RGBA
+	label string
+	count int
+}
+
+// mapLegend returns the legend of the map, and the entry each block is drawn with.
+func mapLegend(r *rmximage.RMXImage, blocks []rmximage.BlockUse) ([]*mapEntry, []*mapEntry, error) {
+	legend := []*mapEntry{}
+	byOwner := map[rmximage.Owner]*mapEntry{}
+	for _, owner := range []rmximage.Owner{rmximage.OwnerFree, rmximage.OwnerSystem, rmximage.OwnerDirectory,
+		rmximage.OwnerData, rmximage.OwnerLost, rmximage.OwnerBad, rmximage.OwnerShared} {
+		byOwner[owner] = &mapEntry{char: ownerChars[owner], color: ownerColors[owner], label: owner.String()}
+		legend = append(legend, byOwner[owner])
+	}
+
+	byFNode := map[int]*mapEntry{}
+	if legendFiles > 0 {
+		stats, err := r.Stats()
+		if err != nil {
+			return nil, nil, err
+		}
+		files := []rmximage.FileStats{}
+		for _, fs := range stats.Files {
+			if fs.Type == rmximage.TypeData && fs.Blocks > 0 {
+				files = append(files, fs)
+			}
+		}
+		sort.SliceStable(files, func(i, j int) bool {
+			return files[i].Blocks > files[j].Blocks
+		})
+		for i, fs := range files {
+			if i >= legendFiles || i >= len(fileColors) {
+				break
+			}
+			byFNode[fs.FNode] = &mapEntry{char: byte('1' + i), color: fileColors[i], label: fs.Path}
+			legend = append(legend, byFNode[fs.FNode])
+		}
+	}
+
+	cells := make([]*mapEntry, len(blocks))
+	for i, b := range blocks {
+		cells[i] = byOwner[b.Owner]
+		if entry, ok := byFNode[b.FNode]; ok && b.Owner == rmximage.OwnerData {
+			cells[i] = entry
+		}
+		cells[i].count++
+	}
+	return legend, cells, nil
+}
+
+func printMap(legend []*mapEntry, cells []*mapEntry) {
+	for row := 0; row < len(cells); row += mapWidth {
+		fmt.Printf("%6d ", row)
+		var last *mapEntry
+		for _, cell := range cells[row:min(row+mapWidth, len(cells))] {
+			if cell != last {
+				fmt.Printf("\x1b[38;2;%d;%d;%dm", cell.color.R, cell.color.G, cell.color.B)
+				last = cell
+			}
+			fmt.Printf("%c", cell.char)
+		}
+		fmt.Printf("\x1b[0m\n")
+	}
+	fmt.Println()
+	for _, entry := range legend {
+		fmt.Printf("\x1b[38;2;%d;%d;%dm%c\x1b[0m %-30s %6d blocks\n", entry.color.R, entry.color.G, entry.color.B, entry.char, entry.label, entry.count)
+	}
+}
+
+func svgColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+func writeSVG(f *os.File, legend []*mapEntry, cells []*mapEntry) error {
+	rows := (len(cells) + mapWidth - 1) / mapWidth
+	width := max(mapWidth*mapCellSize, 400)
+	height := rows*mapCellSize + (len(legend)+1)*16
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"%d\" height=\"%d\">\n", width, height)
+	for i, cell := range cells {
+		fmt.Fprintf(&sb, "<rect x=\"%d\" y=\"%d\" width=\"%d\" height=\"%d\" fill=\"%s\"><title>block %d</title></rect>\n",
+			(i%mapWidth)*mapCellSize, (i/mapWidth)*mapCellSize, mapCellSize, mapCellSize, svgColor(cell.color), i)
+	}
+	for i, entry := range legend {
+		y := rows*mapCellSize + (i+1)*16
+		fmt.Fprintf(&sb, "<rect x=\"0\" y=\"%d\" width=\"12\" height=\"12\" fill=\"%s\"/>\n", y-11, svgColor(entry.color))
+		label := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(entry.label)
+		fmt.Fprintf(&sb, "<text x=\"16\" y=\"%d\" font-family=\"monospace\" font-size=\"12\">%s (%d blocks)</text>\n", y, label, entry.count)
+	}
+	sb.WriteString("</svg>\n")
+	_, err := f.WriteString(sb.String())
+	return err
+}
+
+func writePNG(f *os.File, cells []*mapEntry) error {
+	rows := (len(cells) + mapWidth - 1) / mapWidth
+	img := image.NewRGBA(image.Rect(0, 0, mapWidth*mapCellSize, rows*mapCellSize))
+	for i, cell := range cells {
+		x0, y0 := (i%mapWidth)*mapCellSize, (i/mapWidth)*mapCellSize
+		// leave a one pixel gap between the cells
+		for y := y0; y < y0+mapCellSize-1; y++ {
+			for x := x0; x < x0+mapCellSize-1; x++ {
+				img.SetRGBA(x, y, cell.color)
+			}
+		}
+	}
+	return png.Encode(f, img)
+}
+
+func Map(cmd *cobra.Command, args []string) {
+	if mapWidth <= 0 {
+		FatalErrCheck(fmt.Errorf("width must be at least 1"))
+	}
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	blocks, err := r.BlockMap()
+	FatalErrCheck(err)
+	legend, cells, err := mapLegend(r, blocks)
+	FatalErrCheck(err)
+
+	if outputFileName == "" {
+		printMap(legend, cells)
+		return
+	}
+
+	ext := strings.ToLower(path.Ext(outputFileName))
+	if ext != ".svg" && ext != ".png" {
+		FatalErrCheck(fmt.Errorf("cannot tell the format of %s, use a .svg or .png file", outputFileName))
+	}
+	f, err := os.Create(outputFileName)
+	FatalErrCheck(err)
+	if ext == ".svg" {
+		err = writeSVG(f, legend, cells)
+	} else {
+		err = writePNG(f, cells)
+	}
+	if err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	FatalErrCheck(err)
+
+	if !quiet {
+		fmt.Printf("Wrote a map of %d blocks to %s\n", len(cells), outputFileName)
+		if ext == ".png" {
+			// a PNG has no room for text, so the legend goes to the terminal
+			for _, entry := range legend {
+				fmt.Printf("%s %-30s %6d blocks\n", svgColor(entry.color), entry.label, entry.count)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+)
+
+/* Orphans lists the FNodes that are allocated but cannot be reached from the
+ * root directory, such as the files of a directory whose entry was lost, and
+ * with --reattach links them back in.
+ */
+
+func Orphans(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	orphans, err := r.Orphans()
+	FatalErrCheck(err)
+	if len(orphans) == 0 {
+		Infof("No orphaned FNodes found\n")
+		return
+	}
+
+	fmt.Printf("%-6s %-12s %10s %6s\n", "FNode", "Type", "Size", "Parent")
+	fmt.Printf("%-6s %-12s %10s %6s\n", "-----", "----", "----", "------")
+	for _, fnode := range orphans {
+		typeName, ok := rmximage.TypeNames[int(fnode.FType)]
+		if !ok {
+			typeName = fmt.Sprintf("Unknown %d", fnode.FType)
+		}
+		fmt.Printf("%-6d %-12s %10d %6d\n", fnode.Number, typeName, fnode.TotalSize, fnode.Parent)
+	}
+
+	if !reattach {
+		return
+	}
+
+	reattached, err := r.ReattachOrphans()
+	FatalErrCheck(err)
+	for _, ra := range reattached {
+		Infof("Reattached FNode %d as %s\n", ra.FNode.Number, ra.Path)
+	}
+
+	SaveImage(r)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+)
+
+/* RebuildDir writes a new directory file for a directory whose blocks were
+ * overwritten, from the Parent fields of the FNodes that were in it.
+ */
+
+func RebuildDir(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	var dir *rmximage.FNode
+	if n, convErr := strconv.Atoi(args[0]); convErr == nil {
+		dir, err = r.GetFNode(n)
+	} else {
+		dir, err = r.Lookup(nil, args[0])
+	}
+	FatalErrCheck(err)
+
+	entries, err := r.RebuildDirectory(dir)
+	FatalErrCheck(err)
+
+	fmt.Printf("%-15s %8s  %s\n", "Name", "FNode", "Name from")
+	fmt.Printf("%-15s %8s  %s\n", "----", "-----", "---------")
+	for _, entry := range entries {
+		from := "generated"
+		if entry.Recovered {
+			from = "old directory"
+		}
+		fmt.Printf("%-15s %8d  %s\n", entry.Name, entry.FNode, from)
+	}
+	Infof("Rebuilt directory FNode %d with %d entries\n", dir.Number, len(entries))
+
+	SaveImage(r)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+)
+
+/* Scan lists the iRMX volumes found within an image, such as the partitions of
+ * a Winchester disk dump, so that one of them can be chosen with --partition or
+ * --offset.
+ */
+
+func Scan(cmd *cobra.Command, args []string) {
+	// the whole image is scanned, whatever volume was chosen
+	offsetSpec = ""
+	partition = 0
+
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	volumes := r.ScanVolumes()
+	if len(volumes) == 0 {
+		fmt.Printf("No iRMX volumes found\n")
+		return
+	}
+
+	fmt.Printf("%-9s %12s %12s  %-10s  %s\n", "Partition", "Offset", "Size", "Name", "Byte order")
+	fmt.Printf("%-9s %12s %12s  %-10s  %s\n", "---------", "------", "----", "----", "----------")
+	for i, v := range volumes {
+		order := "normal"
+		if v.Swapped {
+			order = "swapped"
+		}
+		fmt.Printf("%-9d %12d %12d  %-10s  %s\n", i+1, v.Offset, v.Size, v.Name, order)
+	}
+}
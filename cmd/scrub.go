@@ -0,0 +1,20 @@
+package main
+
+import (
+	"github.com/spf13/cobra"
+)
+
+/* Scrub overwrites what deleted files left behind, in the free blocks, the unused
+ * directory entries and the free FNodes, so that an image can be published
+ * without them. Uniform free blocks also make IMD images much smaller.
+ */
+
+func Scrub(cmd *cobra.Command, args []string) {
+	r, err := LoadImage()
+	FatalErrCheck(err)
+
+	result, err := r.Scrub()
+	FatalErrCheck(err)
+	SaveImage(r)
+	Infof("Scrubbed %d free blocks, %d directory entries and %d free FNodes\n", result.Blocks, result.Slots, result.FNodes)
+}
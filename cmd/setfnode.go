@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* SetFNode changes fields of an FNode directly, for repairs that no other
+ * command makes, and shows the fields that changed. The system FNodes, 0 to 5,
+ * are changed only with --force.
+ */
+
+func SetFNode(cmd *cobra.Command, args []string) {
+	if len(args) < 2 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+	fnodeNumber, err := strconv.Atoi(args[0])
+	FatalErrCheck(err)
+
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	// GetFNode refuses numbers that are not FNodes of the volume
+	fnode, err := r.GetFNode(fnodeNumber)
+	FatalErrCheck(err)
+	if fnodeNumber <= 5 && !force {
+		FatalErrCheck(fmt.Errorf("FNode %d is a system FNode, use --force to change it", fnodeNumber))
+	}
+
+	before, err := r.RawFNode(fnodeNumber)
+	FatalErrCheck(err)
+	for _, arg := range args[1:] {
+		name, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			FatalErrCheck(fmt.Errorf("expected field=value, got %q", arg))
+		}
+		FatalErrCheck(fnode.SetField(name, value))
+	}
+	after := make([]byte, len(before))
+	fnode.Serialize(after)
+
+	changed := 0
+	for _, field := range rmximage.FNodeFields {
+		oldValue, newValue := field.Value(before), field.Value(after)
+		if oldValue != newValue {
+			fmt.Printf("%-26s %s -> %s\n", field.Name, oldValue, newValue)
+			changed++
+		}
+	}
+	if changed == 0 {
+		Infof("FNode %d is unchanged\n", fnodeNumber)
+		return
+	}
+
+	FatalErrCheck(r.PutFNode(fnodeNumber, fnode))
+	SaveImage(r)
+}
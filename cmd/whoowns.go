@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/rmximage"
+	"github.com/spf13/cobra"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* WhoOwns finds the file that holds a block, or a byte offset given in hex as a
+ * hex editor shows it, so that a read error or damage found in the image can be
+ * traced to the file it affects. Byte offsets are only accepted where the image
+ * file holds the volume as it is, at --offset: a raw image read without a
+ * geometry. Other formats, and raw dumps with interleave or skew, move the
+ * sectors about, so there blocks must be given.
+ */
+
+func WhoOwns(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		fmt.Printf("Usage: %s\n", cmd.Use)
+		os.Exit(-1)
+	}
+	r, err := LoadImage()
+	FatalErrCheck(err)
+	direct := r.GetFormat() == "raw" && r.GetGeometry() == nil
+	vl, err := r.GetVolumeLabel()
+	FatalErrCheck(err)
+	volMap, err := r.GetVolMap()
+	FatalErrCheck(err)
+	index, err := r.BlockIndex()
+	FatalErrCheck(err)
+	gran := int(vl.Gran)
+
+	for _, arg := range args {
+		// a byte offset is of the image, as a hex editor shows it; a block is of the volume
+		block, within := 0, -1
+		if strings.HasPrefix(strings.ToLower(arg), "0x") {
+			if !direct {
+				FatalErrCheck(fmt.Errorf("offset %s cannot be used, the %s image does not hold the volume as it is; give a block number", arg, r.GetFormat()))
+			}
+			offset, err := strconv.ParseInt(arg[2:], 16, 64)
+			FatalErrCheck(err)
+			volOffset := int(offset) - r.GetOffset()
+			if volOffset < 0 || volOffset >= r.Size() {
+				FatalErrCheck(fmt.Errorf("offset %s is outside of the volume", arg))
+			}
+			if r.IsByteSwapped() {
+				// the volume starts at an even offset, so each byte trades places with its neighbour
+				volOffset ^= 1
+			}
+			block, within = volOffset/gran, volOffset%gran
+			fmt.Printf("Offset %s is byte %d of block %d\n", arg, within, block)
+			if label := rmximage.LabelAt(volOffset); label != "" {
+				fmt.Printf("  %s\n", label)
+			}
+		} else {
+			block, err = strconv.Atoi(arg)
+			FatalErrCheck(err)
+			if block < 0 || block*gran >= r.Size() {
+				FatalErrCheck(fmt.Errorf("block %d is outside of the volume", block))
+			}
+			fmt.Printf("Block %d\n", block)
+		}
+
+		owners := index[block]
+		if len(owners) == 0 {
+			if volMap.IsAlloc(block) {
+				fmt.Printf("  allocated in the VolMap but used by no FNode\n")
+			} else {
+				fmt.Printf("  free\n")
+			}
+			continue
+		}
+		if len(owners) > 1 {
+			fmt.Printf("  cross-linked, used by %d FNodes\n", len(owners))
+		}
+		for _, owner := range owners {
+			name := owner.Path
+			if name == "" {
+				fnode, err := r.GetFNode(owner.FNode)
+				FatalErrCheck(err)
+				name = typeName(int(fnode.FType)) + " file"
+			}
+			switch {
+			case owner.Indirect:
+				fmt.Printf("  %s (FNode %d), indirect block\n", name, owner.FNode)
+			case within >= 0:
+				fmt.Printf("  %s (FNode %d), byte %d of the file\n", name, owner.FNode, owner.Offset+within)
+			default:
+				fmt.Printf("  %s (FNode %d), bytes %d-%d of the file\n", name, owner.FNode, owner.Offset, owner.Offset+gran-1)
+			}
+		}
+	}
+}
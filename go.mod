@@ -2,12 +2,15 @@ module github.com/sbelectronics/rmxtool
 
 go 1.24.3
 
+require (
+	github.com/spf13/cobra v1.9.1
+	github.com/stretchr/testify v1.10.0
+)
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	github.com/spf13/cobra v1.9.1 // indirect
 	github.com/spf13/pflag v1.0.6 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,142 @@
+package testvolume
+
+import (
+	"encoding/binary"
+)
+
+// The layout of the volume made by Make.
+const (
+	Gran       = 128
+	Blocks     = 64
+	FNodeBase  = 8  // block holding the first fnode
+	FNodeFile  = 7  // blocks of the fnode file
+	VolMap     = 15 // block holding the VolMap
+	FNodeMap   = 16 // block holding the FNodeMap
+	BadBlocks  = 17 // block holding the bad block map
+	Root       = 18 // block holding the root directory
+	Hello      = 19 // block holding hello.txt
+	Free       = 20 // first free block, all the rest are free
+	HelloFNode = 7  // fnode of hello.txt
+	RootFNode  = 6
+	MaxFNode   = 10
+	FNodeSize  = 87
+)
+
+// Where the labels are in a volume, and the fnode types and flags Make uses,
+// as the iRMX format utility writes them.
+const (
+	rmxLabelOffset = 384
+	isoLabelOffset = 768
+
+	typeFNode     = 0
+	typeVolMap    = 1
+	typeFNodeMap  = 2
+	typeAccount   = 3
+	typeBadBlock  = 4
+	typeDirectory = 6
+	typeData      = 8
+	typeVolLabel  = 9
+
+	allocated = 1
+	primary   = 4
+)
+
+// fnode describes an fnode of the volume made by Make, and the blocks that
+// hold its data.
+type fnode struct {
+	number int
+	ftype  uint8
+	block  int
+	blocks int
+	size   int
+}
+
+// putStr writes str to data, padded with zeros.
+func putStr(data []byte, str string) {
+	for i := range data {
+		data[i] = 0
+	}
+	copy(data, str)
+}
+
+// Label writes the iRMX volume label of a volume of size bytes, laid out as
+// Make lays it out, to the start of data.
+func Label(data []byte, name string, size int) {
+	label := data[rmxLabelOffset:]
+	putStr(label[0:10], name)
+	binary.LittleEndian.PutUint16(label[12:14], Gran)
+	binary.LittleEndian.PutUint32(label[14:18], uint32(size))
+	binary.LittleEndian.PutUint16(label[18:20], MaxFNode)
+	binary.LittleEndian.PutUint32(label[20:24], FNodeBase*Gran)
+	binary.LittleEndian.PutUint16(label[24:26], FNodeSize)
+	binary.LittleEndian.PutUint16(label[26:28], RootFNode)
+}
+
+// Make returns a small volume named TEST with a root directory holding one
+// file, hello.txt, laid out the way the iRMX format utility would. FNodes 8
+// and 9 are free.
+func Make() []byte {
+	data := make([]byte, Blocks*Gran)
+
+	iso := data[isoLabelOffset:]
+	copy(iso[0:3], "VOL")
+	putStr(iso[4:10], "TEST")
+	iso[10] = 'N'
+	iso[71] = '1'               // side
+	iso[76], iso[77] = '0', '1' // interleave
+	iso[79] = '4'               // version
+	Label(data, "TEST", len(data))
+
+	fnodes := []fnode{
+		{0, typeFNode, FNodeBase, FNodeFile, MaxFNode * FNodeSize},
+		{1, typeVolMap, VolMap, 1, Blocks / 8},
+		{2, typeFNodeMap, FNodeMap, 1, 2},
+		{3, typeAccount, 0, 0, 0},
+		{4, typeBadBlock, BadBlocks, 1, Blocks / 8},
+		{5, typeVolLabel, 0, 8, 8 * Gran},
+		{RootFNode, typeDirectory, Root, 1, 5 * 16},
+		{HelloFNode, typeData, Hello, 1, 5},
+	}
+	for _, f := range fnodes {
+		raw := data[FNodeBase*Gran+f.number*FNodeSize:]
+		binary.LittleEndian.PutUint16(raw[0:2], allocated|primary)
+		raw[2] = f.ftype
+		raw[3] = 1 // file granularity
+		binary.LittleEndian.PutUint32(raw[18:22], uint32(f.size))
+		binary.LittleEndian.PutUint32(raw[22:26], uint32(f.blocks))
+		binary.LittleEndian.PutUint16(raw[26:28], uint16(f.blocks))
+		raw[28], raw[29], raw[30] = byte(f.block), byte(f.block>>8), byte(f.block>>16)
+		binary.LittleEndian.PutUint32(raw[66:70], uint32(f.blocks*Gran))
+		binary.LittleEndian.PutUint16(raw[85:87], RootFNode) // parent
+	}
+
+	// blocks 0-19 are in use, and so are the fnodes above
+	volMap := data[VolMap*Gran:]
+	for i := 0; i < Blocks/8; i++ {
+		volMap[i] = 0xFF
+	}
+	volMap[0], volMap[1], volMap[2] = 0, 0, 0xF0
+	data[FNodeMap*Gran], data[FNodeMap*Gran+1] = 0, 0x03
+	// no blocks are bad
+	for i := 0; i < Blocks/8; i++ {
+		data[BadBlocks*Gran+i] = 0xFF
+	}
+
+	entries := []struct {
+		fnode int
+		name  string
+	}{
+		{1, "R?SPACEMAP"},
+		{2, "R?FNODEMAP"},
+		{4, "R?BADBLOCKMAP"},
+		{5, "R?VOLUMELABEL"},
+		{HelloFNode, "hello.txt"},
+	}
+	for i, entry := range entries {
+		slot := data[Root*Gran+i*16:]
+		binary.LittleEndian.PutUint16(slot[0:2], uint16(entry.fnode))
+		putStr(slot[2:16], entry.name)
+	}
+	copy(data[Hello*Gran:], "hello")
+	return data
+}
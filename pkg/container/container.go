@@ -0,0 +1,209 @@
+package container
+
+/* Container: disk image file formats
+ *
+ * A Container holds the sectors of a disk in some file format, and presents them
+ * to the rest of rmxtool as the logical blocks of a volume. Formats register
+ * themselves by name, together with the file extensions they use and a test for
+ * the magic bytes at the start of their files, so that new formats can be added
+ * without the code that works with volumes knowing anything about them.
+ */
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// BlockSize is the size of the logical blocks presented by every container. It
+// is the smallest sector size in use, so the granularity of any volume is a
+// multiple of it.
+const BlockSize = 128
+
+type Container interface {
+	// Name returns the name the container format is registered under.
+	Name() string
+	// Open loads the container from a file. If g is nil, the geometry recorded in
+	// the file is used, or for formats that do not record one, the logical blocks
+	// are taken to be the file itself.
+	Open(fileName string, g *geometry.Geometry) error
+	// Create initializes an empty container laid out according to g, holding a
+	// volume of at least size bytes.
+	Create(g *geometry.Geometry, size int) error
+	// NumBlocks returns the number of logical blocks in the volume.
+	NumBlocks() int
+	// ReadBlocks returns count logical blocks starting at block.
+	ReadBlocks(block int, count int) ([]byte, error)
+	// WriteBlocks replaces the logical blocks starting at block with data.
+	WriteBlocks(block int, data []byte) error
+	// Save writes the container to a file.
+	Save(fileName string) error
+	// Geometry describes the physical layout of the disk, or returns nil if the
+	// container is an unstructured sequence of blocks.
+	Geometry() *geometry.Geometry
+	// Close releases any file the container keeps open. The container cannot be
+	// used afterwards.
+	Close() error
+}
+
+type Format struct {
+	Name        string
+	Description string
+	Extensions  []string                 // file extensions, including the dot
+	Magic       func(header []byte) bool // returns true if the file starts with this format's magic bytes, may be nil
+	New         func() Container
+}
+
+// MagicSize is the number of bytes at the start of a file that are passed to the
+// Magic functions.
+const MagicSize = 512
+
+var formats = map[string]Format{}
+
+// Register makes a container format available by name, extension and magic.
+func Register(f Format) {
+	formats[f.Name] = f
+}
+
+// Lookup returns the format registered under name.
+func Lookup(name string) (Format, error) {
+	f, ok := formats[strings.ToLower(name)]
+	if !ok {
+		return Format{}, fmt.Errorf("unknown image format '%s' (known: %s)", name, strings.Join(Names(), ", "))
+	}
+	return f, nil
+}
+
+// Names returns the names of every registered format, sorted.
+func Names() []string {
+	names := []string{}
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ByExtension returns the format that uses the extension of fileName, or the raw
+// format if no format claims it.
+func ByExtension(fileName string) Format {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, name := range Names() {
+		for _, e := range formats[name].Extensions {
+			if e == ext {
+				return formats[name]
+			}
+		}
+	}
+	return formats["raw"]
+}
+
+// Detect works out the format of an existing file, first by its magic bytes and
+// then by its extension.
+func Detect(fileName string) (Format, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return Format{}, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	header := make([]byte, MagicSize)
+	n, _ := f.Read(header)
+	header = header[:n]
+
+	for _, name := range Names() {
+		format := formats[name]
+		if format.Magic != nil && format.Magic(header) {
+			return format, nil
+		}
+	}
+	return ByExtension(fileName), nil
+}
+
+// Open opens a container. If formatName is empty, the format is detected.
+func Open(fileName string, formatName string, g *geometry.Geometry) (Container, error) {
+	var format Format
+	var err error
+	if formatName != "" {
+		format, err = Lookup(formatName)
+	} else {
+		format, err = Detect(fileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := format.New()
+	err = c.Open(fileName, g)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Create creates an empty container. If formatName is empty, the format is
+// chosen by the extension of fileName.
+func Create(fileName string, formatName string, g *geometry.Geometry, size int) (Container, error) {
+	format := ByExtension(fileName)
+	if formatName != "" {
+		var err error
+		format, err = Lookup(formatName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := format.New()
+	err := c.Create(g, size)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// memory holds a logical volume in memory and implements the block access
+// methods of Container on it.
+type memory struct {
+	data []byte
+}
+
+func (m *memory) NumBlocks() int {
+	return (len(m.data) + BlockSize - 1) / BlockSize
+}
+
+func (m *memory) ReadBlocks(block int, count int) ([]byte, error) {
+	if block < 0 || count < 0 || block+count > m.NumBlocks() {
+		return nil, fmt.Errorf("blocks %d-%d are outside of the image (%d blocks)", block, block+count-1, m.NumBlocks())
+	}
+	data := make([]byte, count*BlockSize)
+	copy(data, m.data[block*BlockSize:min((block+count)*BlockSize, len(m.data))])
+	return data, nil
+}
+
+func (m *memory) WriteBlocks(block int, data []byte) error {
+	count := (len(data) + BlockSize - 1) / BlockSize
+	if block < 0 || block+count > m.NumBlocks() {
+		return fmt.Errorf("blocks %d-%d are outside of the image (%d blocks)", block, block+count-1, m.NumBlocks())
+	}
+	copy(m.data[block*BlockSize:], data)
+	return nil
+}
+
+func (m *memory) Close() error {
+	return nil
+}
+
+// writeFile replaces the named file with data.
+func writeFile(fileName string, data []byte) error {
+	err := os.Remove(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete existing file: %w", err)
+	}
+
+	return os.WriteFile(fileName, data, 0644)
+}
@@ -0,0 +1,252 @@
+package container
+
+import (
+	"bytes"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pattern returns size bytes in which every block is filled with its number.
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i / BlockSize)
+	}
+	return data
+}
+
+type ContainerSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *ContainerSuite) SetupTest() {
+	s.dir = s.T().TempDir()
+}
+
+// openStreamed opens a raw file the way a hard disk image is opened, reading the
+// blocks on demand.
+func (s *ContainerSuite) openStreamed(fileName string) *Raw {
+	threshold := StreamThreshold
+	StreamThreshold = 0
+	defer func() {
+		StreamThreshold = threshold
+	}()
+	c := &Raw{}
+	s.Require().NoError(c.Open(fileName, nil))
+	s.Require().NotNil(c.device)
+	return c
+}
+
+func (s *ContainerSuite) TestRegistry() {
+	s.Equal([]string{"hfe", "imd", "raw", "td0"}, Names())
+	f, err := Lookup("IMD")
+	s.Require().NoError(err)
+	s.Equal("imd", f.Name)
+	_, err = Lookup("d88")
+	s.ErrorContains(err, "known: hfe, imd, raw, td0")
+
+	s.Equal("imd", ByExtension("disk.IMD").Name)
+	s.Equal("td0", ByExtension("/tmp/disk.td0").Name)
+	s.Equal("raw", ByExtension("disk.img").Name)
+	s.Equal("raw", ByExtension("disk").Name)
+}
+
+func (s *ContainerSuite) TestDetect() {
+	cases := []struct {
+		fileName string
+		header   string
+		format   string
+	}{
+		{"a.img", "IMD 1.18: 01/01/2026", "imd"},
+		{"b.bin", "HXCPICFE", "hfe"},
+		{"d.imd", "", "imd"},
+		{"e.td0", "VOL", "td0"},
+		{"f.img", "IMD", "raw"},
+	}
+	for _, c := range cases {
+		fileName := filepath.Join(s.dir, c.fileName)
+		s.Require().NoError(os.WriteFile(fileName, []byte(c.header), 0644))
+		f, err := Detect(fileName)
+		s.Require().NoError(err)
+		s.Equal(c.format, f.Name, c.fileName)
+	}
+	_, err := Detect(filepath.Join(s.dir, "missing.img"))
+	s.Error(err)
+
+	// a TeleDisk header carries a CRC, so make a real one
+	g, err := geometry.Parse("intel-sssd")
+	s.Require().NoError(err)
+	c, err := Create("", "td0", g, g.Size())
+	s.Require().NoError(err)
+	fileName := filepath.Join(s.dir, "c.dsk")
+	s.Require().NoError(c.Save(fileName))
+	f, err := Detect(fileName)
+	s.Require().NoError(err)
+	s.Equal("td0", f.Name)
+}
+
+// roundTrip writes a volume to a new container and saves it, then opens it again
+// with its format detected and the geometry given to open it with.
+func (s *ContainerSuite) roundTrip(fileName string, formatName string, g *geometry.Geometry, open *geometry.Geometry) Container {
+	data := pattern(g.Size())
+	c, err := Create(fileName, formatName, g, len(data))
+	s.Require().NoError(err)
+	s.Equal(len(data)/BlockSize, c.NumBlocks())
+	s.Require().NoError(c.WriteBlocks(0, data))
+	s.Require().NoError(c.Save(fileName))
+
+	c, err = Open(fileName, "", open)
+	s.Require().NoError(err)
+	blocks, err := c.ReadBlocks(0, c.NumBlocks())
+	s.Require().NoError(err)
+	s.Equal(data, blocks[:len(data)])
+	return c
+}
+
+func (s *ContainerSuite) TestRawRoundTrip() {
+	g, err := geometry.Parse("cyls=4,heads=2,secsize=256,sectors=8,interleave=3")
+	s.Require().NoError(err)
+	fileName := filepath.Join(s.dir, "disk.img")
+	c := s.roundTrip(fileName, "", g, g)
+	s.Equal("raw", c.Name())
+	s.Equal(g, c.Geometry())
+
+	// the dump is interleaved, so without the geometry it reads out of order
+	c, err = Open(fileName, "", nil)
+	s.Require().NoError(err)
+	s.Nil(c.Geometry(), "a raw file does not record its geometry")
+	s.Equal(g.Size()/BlockSize, c.NumBlocks())
+	blocks, err := c.ReadBlocks(0, c.NumBlocks())
+	s.Require().NoError(err)
+	s.NotEqual(pattern(g.Size()), blocks)
+	s.Equal(pattern(256), blocks[:256])
+	s.Equal(pattern(4 * 256)[3*256:], blocks[256:512])
+
+	iso := g.Copy()
+	iso.Track.Interleave = geometry.InterleaveISO
+	_, err = Open(fileName, "raw", iso)
+	s.ErrorContains(err, "must be resolved")
+	_, err = Create(fileName, "raw", iso, g.Size())
+	s.ErrorContains(err, "must be given explicitly")
+}
+
+func (s *ContainerSuite) TestIMDRoundTrip() {
+	g, err := geometry.Parse("intel-dsdd")
+	s.Require().NoError(err)
+	c := s.roundTrip(filepath.Join(s.dir, "disk.imd"), "", g, nil)
+	s.Equal("imd", c.Name())
+	s.Require().NotNil(c.Geometry())
+	s.Equal(g.Size(), c.Geometry().Size())
+
+	// the format given explicitly wins over the extension, and the magic bytes
+	// find it again
+	c = s.roundTrip(filepath.Join(s.dir, "disk.img"), "imd", g, nil)
+	s.Equal("imd", c.Name())
+
+	_, err = Create(filepath.Join(s.dir, "nogeometry.imd"), "", nil, 1024)
+	s.ErrorContains(err, "a geometry is required")
+}
+
+func (s *ContainerSuite) TestDeviceRead() {
+	// the last block is only partly present in the file
+	fileName := filepath.Join(s.dir, "disk.img")
+	data := pattern(10*BlockSize + 50)
+	s.Require().NoError(os.WriteFile(fileName, data, 0644))
+
+	c := s.openStreamed(fileName)
+	defer func() {
+		_ = c.Close()
+	}()
+	s.Equal(11, c.NumBlocks())
+	blocks, err := c.ReadBlocks(2, 3)
+	s.Require().NoError(err)
+	s.Equal(data[2*BlockSize:5*BlockSize], blocks)
+	blocks, err = c.ReadBlocks(10, 1)
+	s.Require().NoError(err)
+	s.Equal(append(data[10*BlockSize:], make([]byte, BlockSize-50)...), blocks)
+
+	_, err = c.ReadBlocks(10, 2)
+	s.Error(err)
+	_, err = c.ReadBlocks(-1, 1)
+	s.Error(err)
+	s.Error(c.WriteBlocks(11, make([]byte, BlockSize)))
+}
+
+func (s *ContainerSuite) TestDeviceSave() {
+	fileName := filepath.Join(s.dir, "disk.img")
+	data := pattern(10*BlockSize + 50)
+	s.Require().NoError(os.WriteFile(fileName, data, 0644))
+
+	c := s.openStreamed(fileName)
+	defer func() {
+		_ = c.Close()
+	}()
+	s.Require().NoError(c.WriteBlocks(4, bytes.Repeat([]byte{0xAA}, BlockSize+10)))
+	s.Require().NoError(c.WriteBlocks(10, bytes.Repeat([]byte{0xBB}, BlockSize)))
+
+	// written blocks are read back before they are saved
+	blocks, err := c.ReadBlocks(4, 2)
+	s.Require().NoError(err)
+	s.Equal(bytes.Repeat([]byte{0xAA}, BlockSize+10), blocks[:BlockSize+10])
+	s.Equal(data[5*BlockSize+10:6*BlockSize], blocks[BlockSize+10:])
+	onDisk, err := os.ReadFile(fileName)
+	s.Require().NoError(err)
+	s.Equal(data, onDisk)
+
+	// a block changed behind the container's back survives the save, as only the
+	// written blocks go back to the file
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	s.Require().NoError(err)
+	_, err = f.WriteAt([]byte("outside"), 7*BlockSize)
+	s.Require().NoError(err)
+	s.Require().NoError(f.Close())
+
+	s.Require().NoError(c.Save(fileName))
+	expected := append([]byte{}, data...)
+	copy(expected[4*BlockSize:], bytes.Repeat([]byte{0xAA}, BlockSize+10))
+	copy(expected[7*BlockSize:], "outside")
+	copy(expected[10*BlockSize:], bytes.Repeat([]byte{0xBB}, 50))
+	onDisk, err = os.ReadFile(fileName)
+	s.Require().NoError(err)
+	s.Equal(expected, onDisk)
+	s.Empty(c.device.dirty)
+}
+
+func (s *ContainerSuite) TestDeviceCopy() {
+	fileName := filepath.Join(s.dir, "disk.img")
+	copyName := filepath.Join(s.dir, "copy.img")
+	data := pattern(10 * BlockSize)
+	s.Require().NoError(os.WriteFile(fileName, data, 0644))
+
+	c := s.openStreamed(fileName)
+	s.Require().NoError(c.WriteBlocks(1, bytes.Repeat([]byte{0xAA}, BlockSize)))
+	s.Require().NoError(c.Save(copyName))
+	expected := append([]byte{}, data...)
+	copy(expected[BlockSize:], bytes.Repeat([]byte{0xAA}, BlockSize))
+	onDisk, err := os.ReadFile(copyName)
+	s.Require().NoError(err)
+	s.Equal(expected, onDisk)
+
+	// the original is untouched, and later saves go to the copy
+	s.Require().NoError(c.WriteBlocks(2, bytes.Repeat([]byte{0xBB}, BlockSize)))
+	s.Require().NoError(c.Save(copyName))
+	copy(expected[2*BlockSize:], bytes.Repeat([]byte{0xBB}, BlockSize))
+	onDisk, err = os.ReadFile(copyName)
+	s.Require().NoError(err)
+	s.Equal(expected, onDisk)
+	onDisk, err = os.ReadFile(fileName)
+	s.Require().NoError(err)
+	s.Equal(data, onDisk)
+
+	s.Require().NoError(c.Close())
+	_, err = c.ReadBlocks(0, 1)
+	s.Error(err, "the file is closed")
+}
+
+func TestContainerSuite(t *testing.T) {
+	suite.Run(t, new(ContainerSuite))
+}
@@ -0,0 +1,126 @@
+package container
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// StreamThreshold is the size in bytes above which raw images without a geometry
+// are read and written on demand instead of being held in memory. Hard disk
+// images are usually far larger than the parts of them that a command touches.
+var StreamThreshold int64 = 8 << 20
+
+// device reads the blocks of a file on demand. Blocks that are written are kept
+// in memory until the file is saved, and only they are written back.
+type device struct {
+	file     *os.File
+	fileName string
+	size     int64
+	dirty    map[int][]byte
+}
+
+func openDevice(fileName string) (*device, error) {
+	file, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		// the file can still be read, and saving will report the problem
+		file, err = os.Open(fileName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &device{file: file, fileName: fileName, size: info.Size(), dirty: map[int][]byte{}}, nil
+}
+
+func (d *device) NumBlocks() int {
+	return int((d.size + BlockSize - 1) / BlockSize)
+}
+
+func (d *device) ReadBlocks(block int, count int) ([]byte, error) {
+	if block < 0 || count < 0 || block+count > d.NumBlocks() {
+		return nil, fmt.Errorf("blocks %d-%d are outside of the image (%d blocks)", block, block+count-1, d.NumBlocks())
+	}
+	data := make([]byte, count*BlockSize)
+	start := int64(block) * BlockSize
+	n := min(int64(len(data)), d.size-start)
+	_, err := d.file.ReadAt(data[:n], start)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	for i := 0; i < count; i++ {
+		if blk, ok := d.dirty[block+i]; ok {
+			copy(data[i*BlockSize:], blk)
+		}
+	}
+	return data, nil
+}
+
+func (d *device) WriteBlocks(block int, data []byte) error {
+	count := (len(data) + BlockSize - 1) / BlockSize
+	if block < 0 || block+count > d.NumBlocks() {
+		return fmt.Errorf("blocks %d-%d are outside of the image (%d blocks)", block, block+count-1, d.NumBlocks())
+	}
+	for i := 0; i < count; i++ {
+		blk, err := d.ReadBlocks(block+i, 1)
+		if err != nil {
+			return err
+		}
+		copy(blk, data[i*BlockSize:])
+		d.dirty[block+i] = blk
+	}
+	return nil
+}
+
+// save writes the dirty blocks back. Saving under a different name first copies
+// the file, and later saves go to the copy.
+func (d *device) save(fileName string) error {
+	if fileName != d.fileName {
+		err := d.copyTo(fileName)
+		if err != nil {
+			return err
+		}
+	}
+
+	blocks := []int{}
+	for block := range d.dirty {
+		blocks = append(blocks, block)
+	}
+	sort.Ints(blocks)
+	for _, block := range blocks {
+		start := int64(block) * BlockSize
+		n := min(BlockSize, d.size-start)
+		_, err := d.file.WriteAt(d.dirty[block][:n], start)
+		if err != nil {
+			return fmt.Errorf("failed to write block %d: %w", block, err)
+		}
+	}
+	d.dirty = map[int][]byte{}
+	return nil
+}
+
+func (d *device) copyTo(fileName string) error {
+	out, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, io.NewSectionReader(d.file, 0, d.size))
+	if err != nil {
+		_ = out.Close()
+		return err
+	}
+	_ = d.file.Close()
+	d.file = out
+	d.fileName = fileName
+	return nil
+}
+
+func (d *device) close() error {
+	d.dirty = map[int][]byte{}
+	return d.file.Close()
+}
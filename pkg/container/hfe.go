@@ -0,0 +1,17 @@
+package container
+
+import (
+	"github.com/sbelectronics/rmxtool/pkg/hfe"
+)
+
+func init() {
+	Register(Format{
+		Name:        "hfe",
+		Description: "HxC floppy emulator",
+		Extensions:  []string{".hfe"},
+		Magic: func(header []byte) bool {
+			return len(header) >= 8 && (string(header[:8]) == hfe.SignatureV1 || string(header[:8]) == hfe.SignatureV3)
+		},
+		New: func() Container { return NewSectors("hfe", hfe.NewHFE()) },
+	})
+}
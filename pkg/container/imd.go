@@ -0,0 +1,17 @@
+package container
+
+import (
+	"github.com/sbelectronics/rmxtool/pkg/imd"
+)
+
+func init() {
+	Register(Format{
+		Name:        "imd",
+		Description: "ImageDisk",
+		Extensions:  []string{".imd"},
+		Magic: func(header []byte) bool {
+			return len(header) >= 4 && string(header[:4]) == "IMD "
+		},
+		New: func() Container { return NewSectors("imd", imd.NewImageDisk()) },
+	})
+}
@@ -0,0 +1,125 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"os"
+)
+
+// Raw is a plain dump of the sectors of a disk. Without a geometry, the dump is
+// the logical volume. With one, the dump is split into tracks and sectors
+// according to it, which allows for track 0 exceptions, interleaved dumps and
+// head-major track order.
+//
+// Dumps without a geometry that are larger than StreamThreshold are not read into
+// memory, but accessed on demand.
+type Raw struct {
+	memory
+	raw      []byte
+	geometry *geometry.Geometry
+	device   *device
+}
+
+func init() {
+	Register(Format{
+		Name:        "raw",
+		Description: "raw sector dump",
+		Extensions:  []string{".img", ".raw", ".bin", ".dsk"},
+		New:         func() Container { return &Raw{} },
+	})
+}
+
+func (c *Raw) Name() string {
+	return "raw"
+}
+
+func (c *Raw) Open(fileName string, g *geometry.Geometry) error {
+	if g == nil {
+		info, err := os.Stat(fileName)
+		if err != nil {
+			return err
+		}
+		if info.Size() > StreamThreshold {
+			c.device, err = openDevice(fileName)
+			return err
+		}
+	} else if g.HasISOInterleave() {
+		return fmt.Errorf("the interleave of a raw image must be resolved before it is opened")
+	}
+
+	raw, err := os.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	c.raw = raw
+	c.geometry = g
+
+	if g == nil {
+		c.data = c.raw
+		return nil
+	}
+
+	c.data, err = c.geometry.Read(c.geometry.RawReader(c.raw))
+	return err
+}
+
+func (c *Raw) Create(g *geometry.Geometry, size int) error {
+	c.geometry = g
+	c.device = nil
+	if g == nil {
+		c.raw = make([]byte, size)
+		c.data = c.raw
+		return nil
+	}
+	if g.HasISOInterleave() {
+		return fmt.Errorf("the interleave of a new image must be given explicitly")
+	}
+	c.raw = make([]byte, g.RawSize())
+	c.data = make([]byte, g.Size())
+	return nil
+}
+
+func (c *Raw) NumBlocks() int {
+	if c.device != nil {
+		return c.device.NumBlocks()
+	}
+	return c.memory.NumBlocks()
+}
+
+func (c *Raw) ReadBlocks(block int, count int) ([]byte, error) {
+	if c.device != nil {
+		return c.device.ReadBlocks(block, count)
+	}
+	return c.memory.ReadBlocks(block, count)
+}
+
+func (c *Raw) WriteBlocks(block int, data []byte) error {
+	if c.device != nil {
+		return c.device.WriteBlocks(block, data)
+	}
+	return c.memory.WriteBlocks(block, data)
+}
+
+func (c *Raw) Save(fileName string) error {
+	if c.device != nil {
+		return c.device.save(fileName)
+	}
+	if c.geometry != nil {
+		err := c.geometry.Write(c.data, c.geometry.RawReader(c.raw), c.geometry.RawWriter(c.raw))
+		if err != nil {
+			return err
+		}
+	}
+	return writeFile(fileName, c.raw)
+}
+
+func (c *Raw) Geometry() *geometry.Geometry {
+	return c.geometry
+}
+
+func (c *Raw) Close() error {
+	if c.device != nil {
+		return c.device.close()
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package container
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+)
+
+// SectorImage is implemented by the packages for formats that record each sector
+// of the disk individually, such as IMD.
+type SectorImage interface {
+	Load(fileName string) error
+	Save(fileName string) error
+	// Format replaces the contents of the image with empty tracks.
+	Format(g *geometry.Geometry) error
+	ReadSector(cylinder int, head int, sector int) ([]byte, error)
+	WriteSector(cylinder int, head int, sector int, data []byte) error
+	// Geometry describes the tracks that are present in the image.
+	Geometry() *geometry.Geometry
+}
+
+// Sectors adapts a SectorImage to the Container interface. The logical volume is
+// assembled from the sectors when the image is opened, and scattered back into
+// them when it is saved.
+type Sectors struct {
+	memory
+	name     string
+	image    SectorImage
+	geometry *geometry.Geometry
+}
+
+// NewSectors returns a container that stores its volume in image.
+func NewSectors(name string, image SectorImage) *Sectors {
+	return &Sectors{name: name, image: image}
+}
+
+func (c *Sectors) Name() string {
+	return c.name
+}
+
+func (c *Sectors) Open(fileName string, g *geometry.Geometry) error {
+	err := c.image.Load(fileName)
+	if err != nil {
+		return err
+	}
+	if g == nil {
+		g = c.image.Geometry()
+	}
+	if g.HasISOInterleave() {
+		// the sector numbers are recorded in the image, so the order they were
+		// dumped in does not matter
+		g = g.WithISOInterleave(1)
+	}
+	c.geometry = g
+	c.data, err = g.Read(c.image.ReadSector)
+	return err
+}
+
+func (c *Sectors) Create(g *geometry.Geometry, size int) error {
+	if g == nil {
+		return fmt.Errorf("a geometry is required to create an image in %s format", c.name)
+	}
+	err := c.image.Format(g)
+	if err != nil {
+		return err
+	}
+	c.geometry = g
+	c.data = make([]byte, g.Size())
+	return nil
+}
+
+func (c *Sectors) Save(fileName string) error {
+	err := c.geometry.Write(c.data, c.image.ReadSector, c.image.WriteSector)
+	if err != nil {
+		return err
+	}
+	return c.image.Save(fileName)
+}
+
+func (c *Sectors) Geometry() *geometry.Geometry {
+	return c.geometry
+}
@@ -0,0 +1,17 @@
+package container
+
+import (
+	"github.com/sbelectronics/rmxtool/pkg/td0"
+)
+
+func init() {
+	Register(Format{
+		Name:        "td0",
+		Description: "TeleDisk",
+		Extensions:  []string{".td0"},
+		Magic: func(header []byte) bool {
+			return td0.IsTeleDisk(header)
+		},
+		New: func() Container { return NewSectors("td0", td0.NewTeleDisk()) },
+	})
+}
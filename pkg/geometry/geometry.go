@@ -0,0 +1,558 @@
+package geometry
+
+/* Geometry: physical layout of a disk
+ *
+ * A Geometry describes how the logical blocks of an iRMX volume are laid out on
+ * the physical sectors of a disk. Most tracks share one format, but Intel 8"
+ * disks usually record track 0 in FM with 128-byte sectors while the rest of the
+ * disk is MFM with 256, 512 or 1024-byte sectors, so individual tracks may be
+ * given a format of their own.
+ *
+ * The logical volume is built by concatenating the tracks in cylinder order,
+ * each track contributing its sectors in ascending sector number order. A track
+ * may occupy more (or less) room in the logical volume than it does on the disk,
+ * which is how formats that count track 0 as a full-sized track are described.
+ *
+ * Raw dumps are usually in that same logical order, but a dump read straight off
+ * a drive may have its sectors in physical (interleaved) order, and the tracks of
+ * double-sided media may be stored head by head rather than cylinder by cylinder.
+ * Interleave, Skew and HeadMajor describe such dumps. They have no effect on
+ * container formats such as IMD that record the number of every sector.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type TrackFormat struct {
+	SectorSize  int  // bytes per sector
+	SectorCount int  // sectors per track
+	FirstSector int  // number of the first sector on the track, usually 1
+	FM          bool // recorded in FM (single density) rather than MFM
+	LogicalSize int  // bytes the track occupies in the logical volume, 0 if the same as the physical size
+	Interleave  int  // physical sector interleave in raw dumps, 0 or 1 if in logical order
+}
+
+// InterleaveISO may be used as a TrackFormat Interleave to take the interleave
+// from the ISO volume label of the disk.
+const InterleaveISO = -1
+
+type Location struct {
+	Cylinder int
+	Head     int
+}
+
+type Geometry struct {
+	Name        string
+	Cylinders   int
+	Heads       int
+	Track       TrackFormat              // format of every track that is not listed in Exceptions
+	Exceptions  map[Location]TrackFormat // tracks with a format of their own, usually track 0
+	BlockSize   int                      // size of a logical block, defaults to Track.SectorSize
+	BlockOffset int                      // logical block of the disk at which the volume starts
+	Skew        int                      // sectors the interleave pattern is rotated by on each successive track
+	HeadMajor   bool                     // raw dumps hold every cylinder of head 0, then of head 1, and so on
+}
+
+// SectorReader returns the contents of a sector, or nil if the sector is not
+// present on the disk.
+type SectorReader func(cylinder int, head int, sector int) ([]byte, error)
+
+// SectorWriter replaces the contents of a sector.
+type SectorWriter func(cylinder int, head int, sector int, data []byte) error
+
+// PhysicalSize returns the number of bytes the track holds on the disk.
+func (t TrackFormat) PhysicalSize() int {
+	return t.SectorSize * t.SectorCount
+}
+
+// Size returns the number of bytes the track occupies in the logical volume.
+func (t TrackFormat) Size() int {
+	if t.LogicalSize != 0 {
+		return t.LogicalSize
+	}
+	return t.PhysicalSize()
+}
+
+func (t TrackFormat) String() string {
+	encoding := "MFM"
+	if t.FM {
+		encoding = "FM"
+	}
+	s := fmt.Sprintf("%dx%d %s", t.SectorCount, t.SectorSize, encoding)
+	if t.FirstSector != 1 {
+		s += fmt.Sprintf(" first=%d", t.FirstSector)
+	}
+	if t.LogicalSize != 0 {
+		s += fmt.Sprintf(" logical=%d", t.LogicalSize)
+	}
+	if t.Interleave == InterleaveISO {
+		s += " interleave=iso"
+	} else if t.Interleave > 1 {
+		s += fmt.Sprintf(" interleave=%d", t.Interleave)
+	}
+	return s
+}
+
+// slots returns the physical position of each logical sector of the track,
+// laying the sectors out Interleave positions apart starting at position skew.
+// A position that is already taken moves the sector to the next free one.
+func (t TrackFormat) slots(skew int) []int {
+	n := t.SectorCount
+	slots := make([]int, n)
+	used := make([]bool, n)
+	interleave := max(t.Interleave, 1)
+	pos := skew % n
+	for i := 0; i < n; i++ {
+		for used[pos] {
+			pos = (pos + 1) % n
+		}
+		slots[i] = pos
+		used[pos] = true
+		pos = (pos + interleave) % n
+	}
+	return slots
+}
+
+// Format returns the format of the given track.
+func (g *Geometry) Format(cylinder int, head int) TrackFormat {
+	tf, ok := g.Exceptions[Location{Cylinder: cylinder, Head: head}]
+	if ok {
+		return tf
+	}
+	return g.Track
+}
+
+// Tracks returns every track on the disk, in the order they appear in the
+// logical volume.
+func (g *Geometry) Tracks() []Location {
+	tracks := []Location{}
+	for c := 0; c < g.Cylinders; c++ {
+		for h := 0; h < g.Heads; h++ {
+			tracks = append(tracks, Location{Cylinder: c, Head: h})
+		}
+	}
+	return tracks
+}
+
+func (g *Geometry) blockSize() int {
+	if g.BlockSize != 0 {
+		return g.BlockSize
+	}
+	return g.Track.SectorSize
+}
+
+// offset returns the number of logical bytes of the disk that precede the volume.
+func (g *Geometry) offset() int {
+	return g.BlockOffset * g.blockSize()
+}
+
+// Size returns the number of bytes in the logical volume.
+func (g *Geometry) Size() int {
+	size := 0
+	for _, loc := range g.Tracks() {
+		size += g.Format(loc.Cylinder, loc.Head).Size()
+	}
+	return size - g.offset()
+}
+
+// RawSize returns the number of bytes in a raw dump of the disk.
+func (g *Geometry) RawSize() int {
+	size := 0
+	for _, loc := range g.Tracks() {
+		size += g.Format(loc.Cylinder, loc.Head).PhysicalSize()
+	}
+	return size
+}
+
+// RawTracks returns every track on the disk, in the order they appear in a raw
+// dump.
+func (g *Geometry) RawTracks() []Location {
+	if !g.HeadMajor {
+		return g.Tracks()
+	}
+	tracks := []Location{}
+	for h := 0; h < g.Heads; h++ {
+		for c := 0; c < g.Cylinders; c++ {
+			tracks = append(tracks, Location{Cylinder: c, Head: h})
+		}
+	}
+	return tracks
+}
+
+// RawOffset returns the position of a sector within a raw dump of the disk.
+func (g *Geometry) RawOffset(cylinder int, head int, sector int) int {
+	offset := 0
+	for _, loc := range g.RawTracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		if loc.Cylinder == cylinder && loc.Head == head {
+			index := sector - tf.FirstSector
+			if index < 0 || index >= tf.SectorCount {
+				return offset + index*tf.SectorSize
+			}
+			skew := (cylinder*g.Heads + head) * g.Skew
+			return offset + tf.slots(skew)[index]*tf.SectorSize
+		}
+		offset += tf.PhysicalSize()
+	}
+	return offset
+}
+
+// RawReader returns a SectorReader for a raw dump of the disk.
+func (g *Geometry) RawReader(raw []byte) SectorReader {
+	return func(cylinder int, head int, sector int) ([]byte, error) {
+		start := g.RawOffset(cylinder, head, sector)
+		end := start + g.Format(cylinder, head).SectorSize
+		if end > len(raw) {
+			return nil, nil
+		}
+		return raw[start:end], nil
+	}
+}
+
+// RawWriter returns a SectorWriter for a raw dump of the disk. Sectors that lie
+// beyond the end of the dump are not written.
+func (g *Geometry) RawWriter(raw []byte) SectorWriter {
+	return func(cylinder int, head int, sector int, data []byte) error {
+		start := g.RawOffset(cylinder, head, sector)
+		if start >= len(raw) {
+			return nil
+		}
+		copy(raw[start:], data)
+		return nil
+	}
+}
+
+// Read assembles the logical volume from the sectors of the disk. Sectors that
+// are missing are zero-filled.
+func (g *Geometry) Read(read SectorReader) ([]byte, error) {
+	data := []byte{}
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		track := make([]byte, max(tf.Size(), tf.PhysicalSize()))
+		for i := 0; i < tf.SectorCount; i++ {
+			secData, err := read(loc.Cylinder, loc.Head, tf.FirstSector+i)
+			if err != nil {
+				return nil, err
+			}
+			copy(track[i*tf.SectorSize:(i+1)*tf.SectorSize], secData)
+		}
+		data = append(data, track[:tf.Size()]...)
+	}
+
+	offset := g.offset()
+	if offset > 0 {
+		data = data[min(offset, len(data)):]
+	} else if offset < 0 {
+		data = append(make([]byte, -offset), data...)
+	}
+	return data, nil
+}
+
+// Write stores the logical volume into the sectors of the disk. Sectors that are
+// only partially covered by the volume are read first so the rest of their
+// contents is preserved.
+func (g *Geometry) Write(data []byte, read SectorReader, write SectorWriter) error {
+	pos := -g.offset() // position within data of the current track
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		for i := 0; i < tf.SectorCount; i++ {
+			start := pos + i*tf.SectorSize
+			end := start + tf.SectorSize
+			if (i+1)*tf.SectorSize > tf.Size() {
+				// this sector is not part of the logical volume
+				break
+			}
+			if end <= 0 || start >= len(data) {
+				continue
+			}
+			secData := make([]byte, tf.SectorSize)
+			if start < 0 || end > len(data) {
+				old, err := read(loc.Cylinder, loc.Head, tf.FirstSector+i)
+				if err != nil {
+					return err
+				}
+				copy(secData, old)
+			}
+			copy(secData[max(0, -start):], data[max(0, start):min(end, len(data))])
+			err := write(loc.Cylinder, loc.Head, tf.FirstSector+i, secData)
+			if err != nil {
+				return err
+			}
+		}
+		pos += tf.Size()
+	}
+	return nil
+}
+
+func (g *Geometry) String() string {
+	s := fmt.Sprintf("%d cylinders, %d heads, %s", g.Cylinders, g.Heads, g.Track)
+	locs := []Location{}
+	for loc := range g.Exceptions {
+		locs = append(locs, loc)
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].Cylinder != locs[j].Cylinder {
+			return locs[i].Cylinder < locs[j].Cylinder
+		}
+		return locs[i].Head < locs[j].Head
+	})
+	for _, loc := range locs {
+		s += fmt.Sprintf(", track %d/%d %s", loc.Cylinder, loc.Head, g.Exceptions[loc])
+	}
+	if g.BlockOffset != 0 {
+		s += fmt.Sprintf(", block offset %d", g.BlockOffset)
+	}
+	if g.Skew != 0 {
+		s += fmt.Sprintf(", skew %d", g.Skew)
+	}
+	if g.HeadMajor {
+		s += ", head-major"
+	}
+	return s
+}
+
+var intelTrack0 = TrackFormat{SectorSize: 128, SectorCount: 26, FirstSector: 1, FM: true}
+
+// Presets are the geometries of the common Intel 8" formats. Track 0 of side 0
+// is always FM with 26 128-byte sectors. The 512 and 1024-byte formats count
+// track 0 as a full-sized track in the logical volume.
+var Presets = map[string]*Geometry{
+	"intel-sssd": {
+		Name:      "intel-sssd",
+		Cylinders: 77,
+		Heads:     1,
+		Track:     intelTrack0,
+	},
+	"intel-ssdd": {
+		Name:       "intel-ssdd",
+		Cylinders:  77,
+		Heads:      1,
+		Track:      TrackFormat{SectorSize: 256, SectorCount: 26, FirstSector: 1},
+		Exceptions: map[Location]TrackFormat{{0, 0}: intelTrack0},
+	},
+	"intel-dsdd": {
+		Name:       "intel-dsdd",
+		Cylinders:  77,
+		Heads:      2,
+		Track:      TrackFormat{SectorSize: 256, SectorCount: 26, FirstSector: 1},
+		Exceptions: map[Location]TrackFormat{{0, 0}: intelTrack0},
+	},
+	"intel-dsdd-512": {
+		Name:      "intel-dsdd-512",
+		Cylinders: 77,
+		Heads:     2,
+		Track:     TrackFormat{SectorSize: 512, SectorCount: 15, FirstSector: 1},
+		Exceptions: map[Location]TrackFormat{
+			{0, 0}: {SectorSize: 128, SectorCount: 26, FirstSector: 1, FM: true, LogicalSize: 512 * 15},
+		},
+	},
+	"intel-dsdd-1024": {
+		Name:      "intel-dsdd-1024",
+		Cylinders: 77,
+		Heads:     2,
+		Track:     TrackFormat{SectorSize: 1024, SectorCount: 8, FirstSector: 1},
+		Exceptions: map[Location]TrackFormat{
+			{0, 0}: {SectorSize: 128, SectorCount: 26, FirstSector: 1, FM: true, LogicalSize: 1024 * 8},
+		},
+	},
+}
+
+// PresetNames returns the names of all presets, sorted.
+func PresetNames() []string {
+	names := []string{}
+	for name := range Presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasISOInterleave returns true if any track takes its interleave from the ISO
+// volume label.
+func (g *Geometry) HasISOInterleave() bool {
+	if g.Track.Interleave == InterleaveISO {
+		return true
+	}
+	for _, tf := range g.Exceptions {
+		if tf.Interleave == InterleaveISO {
+			return true
+		}
+	}
+	return false
+}
+
+// WithISOInterleave returns a copy of the geometry with every track that takes
+// its interleave from the ISO volume label set to the given interleave.
+func (g *Geometry) WithISOInterleave(interleave int) *Geometry {
+	c := g.Copy()
+	if c.Track.Interleave == InterleaveISO {
+		c.Track.Interleave = interleave
+	}
+	for loc, tf := range c.Exceptions {
+		if tf.Interleave == InterleaveISO {
+			tf.Interleave = interleave
+			c.Exceptions[loc] = tf
+		}
+	}
+	return c
+}
+
+// Copy returns a deep copy of the geometry.
+func (g *Geometry) Copy() *Geometry {
+	c := *g
+	c.Exceptions = map[Location]TrackFormat{}
+	for loc, tf := range g.Exceptions {
+		c.Exceptions[loc] = tf
+	}
+	return &c
+}
+
+// Parse builds a geometry from a specification. The specification is a
+// comma-separated list that may start with the name of a preset, followed by
+// key=value settings:
+//
+//	cyls, heads                      number of cylinders and heads
+//	secsize, sectors, first, fm      format of a normal track
+//	t0secsize, t0sectors, t0first,
+//	t0fm, t0logical                  format of track 0, side 0
+//	t0heads                          number of heads of cylinder 0 using the track 0 format
+//	blocksize, offset                logical block size and offset of the volume in blocks
+//	interleave, t0interleave         sector interleave of raw dumps, "iso" to use the ISO label
+//	skew, headmajor                  track skew and track order of raw dumps
+//
+// For example "intel-dsdd,offset=13" or "cyls=77,heads=2,secsize=256,sectors=26".
+func Parse(spec string) (*Geometry, error) {
+	g := &Geometry{
+		Name:  spec,
+		Heads: 1,
+		Track: TrackFormat{FirstSector: 1},
+	}
+	var t0 *TrackFormat
+	t0Heads := 1
+	// track 0 settings are applied after the loop, on top of the final format of
+	// a normal track, so that the order of the keys does not matter
+	t0Settings := map[string]int{}
+
+	for i, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, valueStr, found := strings.Cut(part, "=")
+		if !found {
+			preset, ok := Presets[strings.ToLower(part)]
+			if !ok || i != 0 {
+				return nil, fmt.Errorf("unknown geometry '%s' (known: %s)", part, strings.Join(PresetNames(), ", "))
+			}
+			g = preset.Copy()
+			g.Name = spec
+			tf, ok := g.Exceptions[Location{0, 0}]
+			if ok {
+				t0 = &tf
+				if _, ok := g.Exceptions[Location{0, 1}]; ok {
+					t0Heads = 2
+				}
+			}
+			continue
+		}
+		value, err := strconv.Atoi(valueStr)
+		if strings.EqualFold(valueStr, "iso") && (key == "interleave" || key == "t0interleave") {
+			value, err = InterleaveISO, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for geometry setting '%s': %s", key, valueStr)
+		}
+		switch key {
+		case "cyls":
+			g.Cylinders = value
+		case "heads":
+			g.Heads = value
+		case "secsize":
+			g.Track.SectorSize = value
+		case "sectors":
+			g.Track.SectorCount = value
+		case "first":
+			g.Track.FirstSector = value
+		case "fm":
+			g.Track.FM = value != 0
+		case "t0secsize", "t0sectors", "t0first", "t0fm", "t0logical", "t0interleave":
+			t0Settings[key] = value
+		case "interleave":
+			g.Track.Interleave = value
+		case "skew":
+			g.Skew = value
+		case "headmajor":
+			g.HeadMajor = value != 0
+		case "t0heads":
+			t0Heads = value
+		case "blocksize":
+			g.BlockSize = value
+		case "offset":
+			g.BlockOffset = value
+		default:
+			return nil, fmt.Errorf("unknown geometry setting '%s'", key)
+		}
+	}
+
+	if len(t0Settings) > 0 && t0 == nil {
+		t0 = &TrackFormat{}
+		*t0 = g.Track
+	}
+	for key, value := range t0Settings {
+		switch key {
+		case "t0secsize":
+			t0.SectorSize = value
+		case "t0sectors":
+			t0.SectorCount = value
+		case "t0first":
+			t0.FirstSector = value
+		case "t0fm":
+			t0.FM = value != 0
+		case "t0logical":
+			t0.LogicalSize = value
+		case "t0interleave":
+			t0.Interleave = value
+		}
+	}
+	if t0 != nil {
+		g.Exceptions = map[Location]TrackFormat{}
+		for h := 0; h < t0Heads; h++ {
+			g.Exceptions[Location{0, h}] = *t0
+		}
+	}
+
+	return g, g.Validate()
+}
+
+// Validate checks that the geometry describes a usable disk.
+func (g *Geometry) Validate() error {
+	if g.Cylinders <= 0 || g.Heads <= 0 {
+		return fmt.Errorf("geometry must have at least one cylinder and one head")
+	}
+	tracks := []TrackFormat{g.Track}
+	for _, tf := range g.Exceptions {
+		tracks = append(tracks, tf)
+	}
+	for _, tf := range tracks {
+		if tf.SectorSize <= 0 || tf.SectorCount <= 0 {
+			return fmt.Errorf("geometry track format %s must have a sector size and count", tf)
+		}
+		if tf.LogicalSize < 0 {
+			return fmt.Errorf("geometry track format %s has a negative logical size", tf)
+		}
+		if tf.Interleave < InterleaveISO || tf.Interleave >= max(tf.SectorCount, 2) {
+			return fmt.Errorf("geometry track format %s has an invalid interleave", tf)
+		}
+	}
+	if g.BlockSize < 0 {
+		return fmt.Errorf("geometry block size must not be negative")
+	}
+	if g.Skew < 0 {
+		return fmt.Errorf("geometry skew must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package geometry
+
+import (
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+// mapping is where a sector of a preset lies in a raw dump and in the volume.
+type mapping struct {
+	cylinder, head, sector int
+	raw                    int
+	logical                int
+}
+
+// presetCase gives the sizes of a preset and some of its sector mappings.
+type presetCase struct {
+	name     string
+	size     int
+	rawSize  int
+	mappings []mapping
+}
+
+var presetCases = []presetCase{
+	{"intel-sssd", 77 * 3328, 77 * 3328, []mapping{
+		{0, 0, 1, 0, 0},
+		{0, 0, 26, 25 * 128, 25 * 128},
+		{1, 0, 1, 3328, 3328},
+		{76, 0, 26, 76*3328 + 25*128, 76*3328 + 25*128},
+	}},
+	{"intel-ssdd", 3328 + 76*6656, 3328 + 76*6656, []mapping{
+		{0, 0, 1, 0, 0},
+		{0, 0, 26, 25 * 128, 25 * 128},
+		{1, 0, 1, 3328, 3328},
+		{1, 0, 2, 3328 + 256, 3328 + 256},
+		{76, 0, 26, 3328 + 75*6656 + 25*256, 3328 + 75*6656 + 25*256},
+	}},
+	{"intel-dsdd", 3328 + 153*6656, 3328 + 153*6656, []mapping{
+		{0, 0, 1, 0, 0},
+		{0, 0, 26, 25 * 128, 25 * 128},
+		{0, 1, 1, 3328, 3328},
+		{1, 0, 1, 3328 + 6656, 3328 + 6656},
+		{1, 1, 3, 3328 + 2*6656 + 2*256, 3328 + 2*6656 + 2*256},
+		{76, 1, 26, 3328 + 152*6656 + 25*256, 3328 + 152*6656 + 25*256},
+	}},
+	// track 0 counts as a full 512-byte track in the volume, but not on the disk
+	{"intel-dsdd-512", 154 * 7680, 3328 + 153*7680, []mapping{
+		{0, 0, 1, 0, 0},
+		{0, 0, 26, 25 * 128, 25 * 128},
+		{0, 1, 1, 3328, 7680},
+		{0, 1, 15, 3328 + 14*512, 7680 + 14*512},
+		{1, 0, 1, 3328 + 7680, 2 * 7680},
+		{76, 1, 15, 3328 + 152*7680 + 14*512, 153*7680 + 14*512},
+	}},
+	{"intel-dsdd-1024", 154 * 8192, 3328 + 153*8192, []mapping{
+		{0, 0, 1, 0, 0},
+		{0, 1, 1, 3328, 8192},
+		{0, 1, 8, 3328 + 7*1024, 8192 + 7*1024},
+		{1, 0, 1, 3328 + 8192, 2 * 8192},
+		{76, 1, 8, 3328 + 152*8192 + 7*1024, 153*8192 + 7*1024},
+	}},
+}
+
+// markedDump returns a raw dump of the disk in which every sector starts with
+// its cylinder, head and sector number.
+func markedDump(g *Geometry) []byte {
+	raw := make([]byte, g.RawSize())
+	write := g.RawWriter(raw)
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		for i := 0; i < tf.SectorCount; i++ {
+			sector := make([]byte, tf.SectorSize)
+			sector[0], sector[1], sector[2] = byte(loc.Cylinder), byte(loc.Head), byte(tf.FirstSector+i)
+			_ = write(loc.Cylinder, loc.Head, tf.FirstSector+i, sector)
+		}
+	}
+	return raw
+}
+
+type GeometrySuite struct {
+	suite.Suite
+}
+
+func (s *GeometrySuite) TestPresets() {
+	s.Equal(len(presetCases), len(Presets))
+	for _, pc := range presetCases {
+		g, err := Parse(pc.name)
+		s.Require().NoError(err, pc.name)
+		s.Equal(pc.size, g.Size(), pc.name)
+		s.Equal(pc.rawSize, g.RawSize(), pc.name)
+
+		raw := markedDump(g)
+		data, err := g.Read(g.RawReader(raw))
+		s.Require().NoError(err, pc.name)
+		s.Len(data, pc.size, pc.name)
+		for _, m := range pc.mappings {
+			s.Equal(m.raw, g.RawOffset(m.cylinder, m.head, m.sector), "%s %+v", pc.name, m)
+			mark := []byte{byte(m.cylinder), byte(m.head), byte(m.sector)}
+			s.Equal(mark, data[m.logical:m.logical+3], "%s %+v", pc.name, m)
+		}
+	}
+}
+
+func (s *GeometrySuite) TestTrack0() {
+	g, err := Parse("intel-dsdd")
+	s.Require().NoError(err)
+	s.Equal(TrackFormat{SectorSize: 128, SectorCount: 26, FirstSector: 1, FM: true}, g.Format(0, 0))
+	s.Equal(256, g.Format(0, 1).SectorSize)
+	s.Equal(256, g.Format(1, 0).SectorSize)
+
+	g, err = Parse("intel-dsdd-512")
+	s.Require().NoError(err)
+	s.Equal(3328, g.Format(0, 0).PhysicalSize())
+	s.Equal(7680, g.Format(0, 0).Size())
+}
+
+func (s *GeometrySuite) TestRoundTrip() {
+	for _, pc := range presetCases {
+		g, err := Parse(pc.name)
+		s.Require().NoError(err)
+		raw := markedDump(g)
+		data, err := g.Read(g.RawReader(raw))
+		s.Require().NoError(err)
+
+		again := make([]byte, g.RawSize())
+		s.Require().NoError(g.Write(data, g.RawReader(again), g.RawWriter(again)))
+		s.Equal(raw, again, pc.name)
+	}
+}
+
+func (s *GeometrySuite) TestBlockOffset() {
+	// the volume starts after track 0, which is 13 blocks of 256 bytes
+	g, err := Parse("intel-dsdd,offset=13")
+	s.Require().NoError(err)
+	s.Equal(153*6656, g.Size())
+	raw := markedDump(g)
+	data, err := g.Read(g.RawReader(raw))
+	s.Require().NoError(err)
+	s.Equal([]byte{0, 1, 1}, data[0:3])
+
+	// writing the volume leaves track 0 alone
+	again := make([]byte, len(raw))
+	copy(again, raw[:3328])
+	s.Require().NoError(g.Write(data, g.RawReader(again), g.RawWriter(again)))
+	s.Equal(raw, again)
+}
+
+func (s *GeometrySuite) TestParse() {
+	g, err := Parse("cyls=40,heads=2,secsize=256,sectors=16,first=0")
+	s.Require().NoError(err)
+	s.Equal(40, g.Cylinders)
+	s.Equal(TrackFormat{SectorSize: 256, SectorCount: 16, FirstSector: 0}, g.Track)
+	s.Empty(g.Exceptions)
+
+	g, err = Parse("intel-dsdd,offset=13,blocksize=1024")
+	s.Require().NoError(err)
+	s.Equal(13, g.BlockOffset)
+	s.Equal(1024, g.BlockSize)
+	s.Equal(intelTrack0, g.Format(0, 0))
+	s.Equal("intel-dsdd", Presets["intel-dsdd"].Name, "the preset itself is not changed")
+	s.Equal(0, Presets["intel-dsdd"].BlockOffset)
+
+	g, err = Parse("intel-dsdd,interleave=iso")
+	s.Require().NoError(err)
+	s.True(g.HasISOInterleave())
+	s.Equal(5, g.WithISOInterleave(5).Track.Interleave)
+	s.Equal(InterleaveISO, g.Track.Interleave)
+}
+
+func (s *GeometrySuite) TestParseTrack0Order() {
+	// the track 0 keys build on the final format of a normal track, wherever they are
+	for _, spec := range []string{
+		"t0fm=1,secsize=256,sectors=26,cyls=77,t0secsize=128",
+		"cyls=77,secsize=256,sectors=26,t0fm=1,t0secsize=128",
+		"t0secsize=128,t0fm=1,cyls=77,sectors=26,secsize=256",
+	} {
+		g, err := Parse(spec)
+		s.Require().NoError(err, spec)
+		s.Equal(TrackFormat{SectorSize: 128, SectorCount: 26, FirstSector: 1, FM: true}, g.Format(0, 0), spec)
+		s.Equal(TrackFormat{SectorSize: 256, SectorCount: 26, FirstSector: 1}, g.Format(1, 0), spec)
+	}
+
+	g, err := Parse("t0heads=2,cyls=77,heads=2,secsize=256,sectors=26,t0sectors=13")
+	s.Require().NoError(err)
+	s.Equal(13, g.Format(0, 1).SectorCount)
+	s.Equal(26, g.Format(1, 1).SectorCount)
+
+	// on a preset, track 0 settings change its own track 0
+	g, err = Parse("intel-dsdd-512,t0logical=0")
+	s.Require().NoError(err)
+	s.Equal(3328, g.Format(0, 0).Size())
+	s.Equal(128, g.Format(0, 0).SectorSize)
+}
+
+func (s *GeometrySuite) TestValidate() {
+	for _, spec := range []string{
+		"bogus",
+		"cyls=77,secsize=256,sectors=26,intel-dsdd",
+		"cyls=77,secsize=256,sectors=26,colour=1",
+		"cyls=77,secsize=256,sectors=x",
+		"secsize=256,sectors=26",
+		"cyls=77,secsize=256",
+		"cyls=77,secsize=256,sectors=26,t0sectors=0",
+		"cyls=77,secsize=256,sectors=26,interleave=26",
+		"cyls=77,secsize=256,sectors=26,interleave=-2",
+		"cyls=77,secsize=256,sectors=26,skew=-1",
+		"cyls=77,secsize=256,sectors=26,blocksize=-1",
+		"cyls=77,secsize=256,sectors=26,t0logical=-1",
+	} {
+		_, err := Parse(spec)
+		s.Error(err, spec)
+	}
+}
+
+func (s *GeometrySuite) TestSlots() {
+	cases := []struct {
+		sectors, interleave, skew int
+		slots                     []int
+	}{
+		{8, 1, 0, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{8, 0, 0, []int{0, 1, 2, 3, 4, 5, 6, 7}},
+		{8, 3, 0, []int{0, 3, 6, 1, 4, 7, 2, 5}},
+		{8, 3, 2, []int{2, 5, 0, 3, 6, 1, 4, 7}},
+		{8, 3, 10, []int{2, 5, 0, 3, 6, 1, 4, 7}},
+		// positions already taken move the sector to the next free one
+		{8, 2, 0, []int{0, 2, 4, 6, 1, 3, 5, 7}},
+		{6, 2, 1, []int{1, 3, 5, 2, 4, 0}},
+		{26, 5, 0, []int{0, 5, 10, 15, 20, 25, 4, 9, 14, 19, 24, 3, 8, 13, 18, 23, 2, 7, 12, 17, 22, 1, 6, 11, 16, 21}},
+	}
+	for _, c := range cases {
+		tf := TrackFormat{SectorSize: 128, SectorCount: c.sectors, FirstSector: 1, Interleave: c.interleave}
+		s.Equal(c.slots, tf.slots(c.skew), "%+v", c)
+	}
+}
+
+func (s *GeometrySuite) TestSkew() {
+	g, err := Parse("cyls=2,heads=2,secsize=128,sectors=8,interleave=3,skew=2")
+	s.Require().NoError(err)
+	// each track starts its pattern 2 positions after the one before
+	s.Equal(0, g.RawOffset(0, 0, 1))
+	s.Equal(3*128, g.RawOffset(0, 0, 2))
+	s.Equal(1024+2*128, g.RawOffset(0, 1, 1))
+	s.Equal(2048+4*128, g.RawOffset(1, 0, 1))
+	s.Equal(2048+7*128, g.RawOffset(1, 0, 2))
+	s.Equal(3072+6*128, g.RawOffset(1, 1, 1))
+}
+
+func (s *GeometrySuite) TestHeadMajor() {
+	g, err := Parse("cyls=3,heads=2,secsize=128,sectors=4,headmajor=1")
+	s.Require().NoError(err)
+	s.Equal([]Location{{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 1}, {2, 1}}, g.RawTracks())
+	s.Equal([]Location{{0, 0}, {0, 1}, {1, 0}, {1, 1}, {2, 0}, {2, 1}}, g.Tracks())
+	s.Equal(512, g.RawOffset(1, 0, 1))
+	s.Equal(3*512, g.RawOffset(0, 1, 1))
+	s.Equal(5*512+3*128, g.RawOffset(2, 1, 4))
+
+	// the volume is still in cylinder order
+	raw := markedDump(g)
+	data, err := g.Read(g.RawReader(raw))
+	s.Require().NoError(err)
+	s.Equal([]byte{0, 1, 1}, data[512:515])
+	s.Equal([]byte{1, 0, 1}, data[1024:1027])
+}
+
+func (s *GeometrySuite) TestConvert() {
+	from, err := Parse("cyls=4,heads=2,secsize=128,sectors=8,interleave=3,skew=1,headmajor=1")
+	s.Require().NoError(err)
+	to, err := Parse("cyls=4,heads=2,secsize=256,sectors=4")
+	s.Require().NoError(err)
+	s.Equal(from.Size(), to.Size())
+
+	volume := make([]byte, from.Size())
+	for i := range volume {
+		volume[i] = byte(i / 128)
+	}
+	raw := make([]byte, from.RawSize())
+	s.Require().NoError(from.Write(volume, from.RawReader(raw), from.RawWriter(raw)))
+	s.NotEqual(volume, raw, "the dump is interleaved")
+
+	// from the interleaved dump to a plain one and back
+	data, err := from.Read(from.RawReader(raw))
+	s.Require().NoError(err)
+	s.Equal(volume, data)
+	plain := make([]byte, to.RawSize())
+	s.Require().NoError(to.Write(data, to.RawReader(plain), to.RawWriter(plain)))
+	s.Equal(volume, plain)
+
+	data, err = to.Read(to.RawReader(plain))
+	s.Require().NoError(err)
+	again := make([]byte, from.RawSize())
+	s.Require().NoError(from.Write(data, from.RawReader(again), from.RawWriter(again)))
+	s.Equal(raw, again)
+}
+
+func TestGeometrySuite(t *testing.T) {
+	suite.Run(t, new(GeometrySuite))
+}
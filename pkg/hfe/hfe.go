@@ -0,0 +1,423 @@
+package hfe
+
+/* Hfe: HxC floppy emulator image reader/writer
+ *
+ * An HFE file holds the bitcells of every track, as the HxC firmware in Gotek and
+ * similar drives plays them back. The file starts with a 512-byte header, which
+ * points at a list of tracks. Each track is stored in 512-byte blocks, the first
+ * 256 bytes of a block for side 0 and the second 256 for side 1, with the cells
+ * of each byte in least significant bit first order.
+ *
+ * Version 1 files ("HXCPICFE") contain only cells. Version 3 files ("HXCHFEV3")
+ * may also contain opcodes for index pulses, bit rate changes, skipped and weak
+ * bits. Both are read. Images are always written as version 1.
+ *
+ * The tracks are decoded into sectors when the image is loaded, and encoded again
+ * from the sectors when it is saved, so anything on a track other than its
+ * sectors, such as copy protection, is lost.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"os"
+	"sort"
+)
+
+const (
+	SignatureV1 = "HXCPICFE"
+	SignatureV3 = "HXCHFEV3"
+
+	EncodingMFM = 0x00 // ISOIBM_MFM_ENCODING
+	EncodingFM  = 0x02 // ISOIBM_FM_ENCODING
+
+	InterfaceShugartDD = 0x07 // GENERIC_SHUGART_DD_FLOPPYMODE
+
+	blockSize = 512
+
+	// version 3 opcodes, as they appear in the file with their bits reversed
+	opNop      = 0x0F
+	opIndex    = 0x8F
+	opBitRate  = 0x4F
+	opSkipBits = 0xCF
+	opRandom   = 0x2F
+)
+
+type Sector struct {
+	Cylinder uint8 // as recorded in the sector ID
+	Head     uint8 // as recorded in the sector ID
+	Number   uint8
+	SizeCode uint8
+	Deleted  bool
+	Bad      bool // the data CRC was wrong
+	Data     []byte
+}
+
+type Track struct {
+	Cylinder      uint8
+	Head          uint8
+	FM            bool
+	SectorNumbers []uint8 // in the order they appear on the track
+	Sectors       map[int]Sector
+}
+
+type HFE struct {
+	FileName      string
+	Version       int
+	BitRate       int // in kbps, half the cell rate
+	RPM           int
+	InterfaceMode uint8
+	Tracks        map[int]map[int]*Track
+	CylCount      int
+	HeadCount     int
+}
+
+func NewHFE() *HFE {
+	hfe := &HFE{}
+	return hfe
+}
+
+func (hfe *HFE) SetTrack(track *Track) {
+	if hfe.Tracks == nil {
+		hfe.Tracks = make(map[int]map[int]*Track)
+	}
+	cTrack, okay := hfe.Tracks[int(track.Cylinder)]
+	if !okay {
+		cTrack = make(map[int]*Track)
+		hfe.Tracks[int(track.Cylinder)] = cTrack
+	}
+	cTrack[int(track.Head)] = track
+
+	hfe.CylCount = max(hfe.CylCount, int(track.Cylinder)+1)
+	hfe.HeadCount = max(hfe.HeadCount, int(track.Head)+1)
+}
+
+func (hfe *HFE) Load(fileName string) error {
+	hfe.FileName = fileName
+	data, err := os.ReadFile(hfe.FileName)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	return hfe.Parse(data)
+}
+
+// Parse decodes an HFE image held in memory.
+func (hfe *HFE) Parse(data []byte) error {
+	if len(data) < blockSize {
+		return fmt.Errorf("file too short: expected at least %d bytes, got %d", blockSize, len(data))
+	}
+	switch string(data[:8]) {
+	case SignatureV1:
+		hfe.Version = 1
+	case SignatureV3:
+		hfe.Version = 3
+	default:
+		return fmt.Errorf("invalid file format: expected '%s' or '%s', got '%s'", SignatureV1, SignatureV3, data[:8])
+	}
+
+	cylinders := int(data[9])
+	sides := int(data[10])
+	hfe.BitRate = int(binary.LittleEndian.Uint16(data[12:14]))
+	hfe.RPM = int(binary.LittleEndian.Uint16(data[14:16]))
+	hfe.InterfaceMode = data[16]
+	listOffset := int(binary.LittleEndian.Uint16(data[18:20])) * blockSize
+	hfe.Tracks = nil
+	hfe.CylCount = 0
+	hfe.HeadCount = 0
+
+	if sides < 1 || sides > 2 {
+		return fmt.Errorf("invalid number of sides %d", sides)
+	}
+	if listOffset+cylinders*4 > len(data) {
+		return fmt.Errorf("track list is outside of the file")
+	}
+
+	for c := 0; c < cylinders; c++ {
+		entry := data[listOffset+c*4:]
+		offset := int(binary.LittleEndian.Uint16(entry[0:2])) * blockSize
+		length := int(binary.LittleEndian.Uint16(entry[2:4]))
+		// the sides are interleaved in blocks, each holding 256 bytes of each side
+		if offset+((length/2+255)/256)*blockSize > len(data) {
+			return fmt.Errorf("track %d is outside of the file", c)
+		}
+
+		for h := 0; h < sides; h++ {
+			stream := []byte{}
+			for i := 0; i < length/2; i++ {
+				stream = append(stream, data[offset+(i/256)*blockSize+h*256+i%256])
+			}
+
+			cells := hfe.cells(stream)
+			sectors, fm := decodeAny(cells)
+			if len(sectors) == 0 {
+				continue
+			}
+
+			track := &Track{
+				Cylinder: uint8(c),
+				Head:     uint8(h),
+				FM:       fm,
+				Sectors:  make(map[int]Sector),
+			}
+			for _, sector := range sectors {
+				track.SectorNumbers = append(track.SectorNumbers, sector.Number)
+				track.Sectors[int(sector.Number)] = sector
+			}
+			hfe.SetTrack(track)
+		}
+	}
+
+	return nil
+}
+
+// cells expands the bytes of one side of a track into cells, interpreting the
+// opcodes of version 3 files.
+func (hfe *HFE) cells(stream []byte) []uint8 {
+	cells := make([]uint8, 0, len(stream)*8)
+	for i := 0; i < len(stream); i++ {
+		b := stream[i]
+		skip := 0
+		if hfe.Version == 3 {
+			switch b {
+			case opNop, opIndex:
+				continue
+			case opBitRate:
+				i++
+				continue
+			case opRandom:
+				b = 0
+			case opSkipBits:
+				if i+2 >= len(stream) {
+					return cells
+				}
+				skip = int(stream[i+1])
+				b = stream[i+2]
+				i += 2
+			}
+		}
+		for j := skip; j < 8; j++ {
+			cells = append(cells, (b>>j)&1)
+		}
+	}
+	return cells
+}
+
+// GetHFE encodes the image as a version 1 HFE file.
+func (hfe *HFE) GetHFE() ([]byte, error) {
+	if hfe.BitRate == 0 || hfe.RPM == 0 {
+		return nil, fmt.Errorf("bit rate and rotation speed must be set")
+	}
+
+	// every track holds one revolution of cells
+	count := hfe.BitRate * 1000 * 2 * 60 / hfe.RPM
+	count -= count % 8
+	sideLen := count / 8
+	blocks := (sideLen + 255) / 256
+
+	encoding := uint8(EncodingMFM)
+	allFM := true
+	for _, cTrack := range hfe.Tracks {
+		for _, track := range cTrack {
+			allFM = allFM && track.FM
+		}
+	}
+	if allFM {
+		encoding = EncodingFM
+	}
+
+	header := make([]byte, blockSize)
+	for i := range header {
+		header[i] = 0xFF
+	}
+	copy(header, SignatureV1)
+	header[8] = 0
+	header[9] = uint8(hfe.CylCount)
+	header[10] = uint8(max(hfe.HeadCount, 1))
+	header[11] = encoding
+	binary.LittleEndian.PutUint16(header[12:14], uint16(hfe.BitRate))
+	binary.LittleEndian.PutUint16(header[14:16], uint16(hfe.RPM))
+	header[16] = hfe.InterfaceMode
+	header[17] = 0x00
+	binary.LittleEndian.PutUint16(header[18:20], 1)
+	for h := 0; h < 2; h++ {
+		// track 0 may use a different encoding from the rest of the disk
+		track, ok := hfe.Tracks[0][h]
+		if ok && track.FM != allFM {
+			header[22+h*2] = 0x00
+			header[23+h*2] = EncodingMFM
+			if track.FM {
+				header[23+h*2] = EncodingFM
+			}
+		}
+	}
+
+	listBlocks := (hfe.CylCount*4 + blockSize - 1) / blockSize
+	list := make([]byte, listBlocks*blockSize)
+	for i := range list {
+		list[i] = 0xFF
+	}
+
+	data := append(header, list...)
+	for c := 0; c < hfe.CylCount; c++ {
+		offset := len(data) / blockSize
+		binary.LittleEndian.PutUint16(data[blockSize+c*4:], uint16(offset))
+		binary.LittleEndian.PutUint16(data[blockSize+c*4+2:], uint16(sideLen*2))
+
+		trackData := make([]byte, blocks*blockSize)
+		for h := 0; h < 2; h++ {
+			track, ok := hfe.Tracks[c][h]
+			if !ok {
+				track = &Track{Cylinder: uint8(c), Head: uint8(h), FM: allFM}
+			}
+			cells, err := encodeTrack(track, count, !allFM)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < sideLen; i++ {
+				b := uint8(0)
+				for j := 0; j < 8; j++ {
+					b |= cells[i*8+j] << j
+				}
+				trackData[(i/256)*blockSize+h*256+i%256] = b
+			}
+		}
+		data = append(data, trackData...)
+	}
+
+	return data, nil
+}
+
+// sortedNumbers returns the sector numbers of a track in ascending order.
+func (track *Track) sortedNumbers() []int {
+	numbers := []int{}
+	for _, n := range track.SectorNumbers {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+// ReadSector returns the contents of a sector, or nil if the sector is not
+// present in the image.
+func (hfe *HFE) ReadSector(cylinder int, head int, sector int) ([]byte, error) {
+	track, ok := hfe.Tracks[cylinder][head]
+	if !ok {
+		return nil, nil
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return nil, nil
+	}
+	return sec.Data, nil
+}
+
+// WriteSector replaces the contents of a sector that is present in the image.
+// The sector is written with a good CRC.
+func (hfe *HFE) WriteSector(cylinder int, head int, sector int, data []byte) error {
+	track, ok := hfe.Tracks[cylinder][head]
+	if !ok {
+		return fmt.Errorf("track %d/%d is not present in the image", cylinder, head)
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return fmt.Errorf("sector %d of track %d/%d is not present in the image", sector, cylinder, head)
+	}
+	copy(sec.Data, data)
+	sec.Bad = false
+	track.Sectors[sector] = sec
+	return nil
+}
+
+// Geometry describes the tracks in the image. The format of cylinder 1 is taken
+// to be the normal format, and every track that differs from it is recorded as
+// an exception.
+func (hfe *HFE) Geometry() *geometry.Geometry {
+	g := &geometry.Geometry{
+		Name:       "hfe",
+		Cylinders:  hfe.CylCount,
+		Heads:      hfe.HeadCount,
+		Exceptions: map[geometry.Location]geometry.TrackFormat{},
+	}
+	normal := min(1, hfe.CylCount-1)
+	g.Track = hfe.trackFormat(hfe.Tracks[normal][0])
+	for c := 0; c < hfe.CylCount; c++ {
+		for h := 0; h < hfe.HeadCount; h++ {
+			tf := hfe.trackFormat(hfe.Tracks[c][h])
+			if tf != g.Track {
+				g.Exceptions[geometry.Location{Cylinder: c, Head: h}] = tf
+			}
+		}
+	}
+	return g
+}
+
+func (hfe *HFE) trackFormat(track *Track) geometry.TrackFormat {
+	if track == nil || len(track.SectorNumbers) == 0 {
+		return geometry.TrackFormat{}
+	}
+	numbers := track.sortedNumbers()
+	return geometry.TrackFormat{
+		SectorSize:  128 << track.Sectors[numbers[0]].SizeCode,
+		SectorCount: len(numbers),
+		FirstSector: numbers[0],
+		FM:          track.FM,
+	}
+}
+
+// Save writes the image to the named file.
+func (hfe *HFE) Save(fileName string) error {
+	data, err := hfe.GetHFE()
+	if err != nil {
+		return fmt.Errorf("failed to get HFE data: %w", err)
+	}
+	hfe.FileName = fileName
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// Format replaces the contents of the image with empty tracks laid out according
+// to the geometry, for an 8" drive turning at 360 rpm. The bit rate is 500 kbps if
+// any track is MFM, in which case FM tracks are recorded at twice their cell
+// rate, and 250 kbps otherwise.
+func (hfe *HFE) Format(g *geometry.Geometry) error {
+	hfe.Tracks = nil
+	hfe.CylCount = 0
+	hfe.HeadCount = 0
+	hfe.Version = 1
+	hfe.RPM = 360
+	hfe.BitRate = 250
+	hfe.InterfaceMode = InterfaceShugartDD
+
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		sizeCode := 0
+		for 128<<sizeCode < tf.SectorSize {
+			sizeCode++
+		}
+		if 128<<sizeCode != tf.SectorSize || sizeCode > 6 {
+			return fmt.Errorf("sector size %d cannot be stored in an HFE image", tf.SectorSize)
+		}
+		if !tf.FM {
+			hfe.BitRate = 500
+		}
+		track := &Track{
+			Cylinder: uint8(loc.Cylinder),
+			Head:     uint8(loc.Head),
+			FM:       tf.FM,
+			Sectors:  make(map[int]Sector),
+		}
+		for i := 0; i < tf.SectorCount; i++ {
+			number := uint8(tf.FirstSector + i)
+			track.SectorNumbers = append(track.SectorNumbers, number)
+			track.Sectors[int(number)] = Sector{
+				Cylinder: uint8(loc.Cylinder),
+				Head:     uint8(loc.Head),
+				Number:   number,
+				SizeCode: uint8(sizeCode),
+				Data:     make([]byte, tf.SectorSize),
+			}
+		}
+		hfe.SetTrack(track)
+	}
+	return nil
+}
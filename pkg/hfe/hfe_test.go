@@ -0,0 +1,131 @@
+package hfe
+
+import (
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+type HFESuite struct {
+	suite.Suite
+}
+
+func (s *HFESuite) fill(hfe *HFE) {
+	for _, cTrack := range hfe.Tracks {
+		for _, track := range cTrack {
+			for n, sector := range track.Sectors {
+				for i := range sector.Data {
+					sector.Data[i] = byte(int(track.Cylinder)*3 + int(track.Head)*5 + n*7 + i)
+				}
+			}
+		}
+	}
+}
+
+func (s *HFESuite) TestRoundTrip() {
+	for _, preset := range []string{"intel-sssd", "intel-dsdd", "intel-dsdd-1024"} {
+		g, err := geometry.Parse(preset)
+		s.Require().NoError(err)
+
+		hfe := NewHFE()
+		s.Require().NoError(hfe.Format(g))
+		s.fill(hfe)
+
+		image, err := hfe.GetHFE()
+		s.Require().NoError(err, preset)
+
+		loaded := NewHFE()
+		s.Require().NoError(loaded.Parse(image), preset)
+		s.Equal(g.Cylinders, loaded.CylCount, preset)
+		s.Equal(g.Heads, loaded.HeadCount, preset)
+
+		for _, loc := range g.Tracks() {
+			expected := g.Format(loc.Cylinder, loc.Head)
+			actual := loaded.Geometry().Format(loc.Cylinder, loc.Head)
+			s.Equal(expected.PhysicalSize(), actual.PhysicalSize(), preset)
+			s.Equal(expected.FirstSector, actual.FirstSector, preset)
+			s.Equal(expected.FM, actual.FM, preset)
+			track := hfe.Tracks[loc.Cylinder][loc.Head]
+			for n, sector := range track.Sectors {
+				data, err := loaded.ReadSector(loc.Cylinder, loc.Head, n)
+				s.Require().NoError(err)
+				s.Equal(sector.Data, data, "%s %d/%d sector %d", preset, loc.Cylinder, loc.Head, n)
+			}
+		}
+	}
+}
+
+func (s *HFESuite) TestBadCRC() {
+	track := &Track{FM: false, Sectors: map[int]Sector{}}
+	for n := 1; n <= 2; n++ {
+		track.SectorNumbers = append(track.SectorNumbers, uint8(n))
+		track.Sectors[n] = Sector{Number: uint8(n), SizeCode: 1, Data: make([]byte, 256)}
+	}
+	cells, err := encodeTrack(track, 166656, false)
+	s.Require().NoError(err)
+
+	sectors := decodeTrack(cells, false)
+	s.Require().Len(sectors, 2)
+
+	// flip a data cell of sector 2: the preamble is 146 bytes, sector 1 takes
+	// 372 bytes, and the data of sector 2 starts 60 bytes later
+	cells[(146+372+60+100)*16+1] ^= 1
+
+	sectors = decodeTrack(cells, false)
+	s.Require().Len(sectors, 2)
+	s.False(sectors[0].Bad)
+	s.True(sectors[1].Bad)
+}
+
+func (s *HFESuite) TestVersion3Opcodes() {
+	hfe := &HFE{Version: 3}
+	stream := []byte{opIndex, 0x01, opSkipBits, 3, 0xF8, opBitRate, 0x50, opNop, 0x80}
+	s.Equal([]uint8{
+		1, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 1,
+		0, 0, 0, 0, 0, 0, 0, 1,
+	}, hfe.cells(stream))
+}
+
+// shortTrack returns a two sided image whose one track claims 600 bytes at
+// block 2, of which the file only holds the first block.
+func shortTrack() []byte {
+	data := make([]byte, 3*blockSize+88)
+	copy(data, SignatureV1)
+	data[9], data[10] = 1, 2
+	data[18] = 1
+	copy(data[blockSize:], []byte{2, 0, 0x58, 0x02})
+	return data
+}
+
+func (s *HFESuite) TestTrackOutsideFile() {
+	s.ErrorContains(NewHFE().Parse(shortTrack()), "track 0 is outside of the file")
+}
+
+func TestHFESuite(t *testing.T) {
+	suite.Run(t, new(HFESuite))
+}
+
+func FuzzParse(f *testing.F) {
+	g, err := geometry.Parse("intel-sssd")
+	if err != nil {
+		f.Fatal(err)
+	}
+	hfe := NewHFE()
+	if err := hfe.Format(g); err != nil {
+		f.Fatal(err)
+	}
+	image, err := hfe.GetHFE()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(image)
+	f.Add(shortTrack())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hfe := NewHFE()
+		if hfe.Parse(data) != nil {
+			return
+		}
+		_ = hfe.Geometry()
+	})
+}
@@ -0,0 +1,343 @@
+package hfe
+
+/* FM and MFM encoding of IBM format tracks
+ *
+ * A track is handled as a slice of bitcells, one cell per element, each 0 or 1.
+ * In both encodings every data bit takes two cells, a clock cell followed by a
+ * data cell. FM always writes a clock, while MFM writes one only between two zero
+ * data bits. Address marks are written with some clocks missing, which is how they
+ * are told apart from data.
+ *
+ * Tracks are laid out following IBM 3740 (FM) and IBM System/34 (MFM), with the
+ * gap sizes used on 8" disks.
+ */
+
+import (
+	"fmt"
+)
+
+const (
+	mfmSync  = 0x4489 // 0xA1 with a missing clock
+	mfmIndex = 0x5224 // 0xC2 with a missing clock
+
+	fmIndexMark   = 0xF77A // 0xFC with clock 0xD7
+	fmIDMark      = 0xF57E // 0xFE with clock 0xC7
+	fmDataMark    = 0xF56F // 0xFB with clock 0xC7
+	fmDeletedMark = 0xF56A // 0xF8 with clock 0xC7
+
+	markID      = 0xFE
+	markData    = 0xFB
+	markDeleted = 0xF8
+	markIndex   = 0xFC
+)
+
+// crcCCITT updates a CRC-CCITT (polynomial 0x1021) with data.
+func crcCCITT(crc uint16, data ...byte) uint16 {
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = (crc << 1) ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+type encoder struct {
+	cells  []uint8
+	fm     bool
+	double bool  // write every cell twice as long, for FM on an MFM rate track
+	last   uint8 // previous data bit, for MFM clocks
+	crc    uint16
+}
+
+func (e *encoder) cell(c uint8) {
+	e.cells = append(e.cells, c)
+	if e.double {
+		e.cells = append(e.cells, 0)
+	}
+}
+
+// pattern writes 16 cells verbatim, most significant first.
+func (e *encoder) pattern(p uint16) {
+	for i := 15; i >= 0; i-- {
+		e.cell(uint8(p>>i) & 1)
+	}
+}
+
+// write encodes data bytes, including them in the CRC.
+func (e *encoder) write(data ...byte) {
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			d := (b >> i) & 1
+			if e.fm {
+				e.cell(1)
+			} else if e.last == 0 && d == 0 {
+				e.cell(1)
+			} else {
+				e.cell(0)
+			}
+			e.cell(d)
+			e.last = d
+		}
+		e.crc = crcCCITT(e.crc, b)
+	}
+}
+
+func (e *encoder) fill(b byte, count int) {
+	for i := 0; i < count; i++ {
+		e.write(b)
+	}
+}
+
+// mark writes an address mark: for MFM the three sync bytes followed by the
+// mark byte, for FM the mark byte with its missing clocks. The CRC starts here.
+func (e *encoder) mark(b byte) {
+	e.crc = 0xFFFF
+	if e.fm {
+		switch b {
+		case markID:
+			e.pattern(fmIDMark)
+		case markData:
+			e.pattern(fmDataMark)
+		case markDeleted:
+			e.pattern(fmDeletedMark)
+		}
+		e.last = b & 1
+		e.crc = crcCCITT(e.crc, b)
+		return
+	}
+	for i := 0; i < 3; i++ {
+		e.pattern(mfmSync)
+		e.crc = crcCCITT(e.crc, 0xA1)
+	}
+	e.last = 1
+	e.write(b)
+}
+
+func (e *encoder) writeCRC() {
+	crc := e.crc
+	e.write(byte(crc>>8), byte(crc))
+}
+
+// encodeTrack encodes the sectors of a track into count cells. If double is set,
+// an FM track is written at twice its normal cell rate, which is how FM tracks are
+// recorded on a disk whose other tracks are MFM.
+func encodeTrack(track *Track, count int, double bool) ([]uint8, error) {
+	e := &encoder{fm: track.FM, double: double && track.FM}
+
+	// preamble, per sector overhead excluding the gap after the data, the largest
+	// gap after the data, and the gap byte
+	pre, per, maxGap, gap := 146, 62, 54, byte(0x4E)
+	if track.FM {
+		pre, per, maxGap, gap = 73, 33, 27, 0xFF
+	}
+
+	size := count / 16
+	if e.double {
+		size /= 2
+	}
+	free := size - pre
+	for _, n := range track.SectorNumbers {
+		free -= per + len(track.Sectors[int(n)].Data)
+	}
+	gap3 := maxGap
+	if len(track.SectorNumbers) > 0 {
+		gap3 = min(maxGap, free/len(track.SectorNumbers))
+	}
+	if gap3 < 1 {
+		return nil, fmt.Errorf("the sectors of track %d/%d do not fit on the track", track.Cylinder, track.Head)
+	}
+
+	if track.FM {
+		e.fill(0xFF, 40)
+		e.fill(0x00, 6)
+		e.pattern(fmIndexMark)
+		e.last = 0
+		e.fill(0xFF, 26)
+	} else {
+		e.fill(0x4E, 80)
+		e.fill(0x00, 12)
+		for i := 0; i < 3; i++ {
+			e.pattern(mfmIndex)
+		}
+		e.last = 0
+		e.write(markIndex)
+		e.fill(0x4E, 50)
+	}
+
+	sync, gap2 := 12, 22
+	if track.FM {
+		sync, gap2 = 6, 11
+	}
+	for _, n := range track.SectorNumbers {
+		sector := track.Sectors[int(n)]
+
+		e.fill(0x00, sync)
+		e.mark(markID)
+		e.write(sector.Cylinder, sector.Head, sector.Number, sector.SizeCode)
+		e.writeCRC()
+		e.fill(gap, gap2)
+
+		e.fill(0x00, sync)
+		if sector.Deleted {
+			e.mark(markDeleted)
+		} else {
+			e.mark(markData)
+		}
+		e.write(sector.Data...)
+		e.writeCRC()
+		e.fill(gap, gap3)
+	}
+
+	for len(e.cells) < count {
+		e.write(gap)
+	}
+	return e.cells[:count], nil
+}
+
+// readBytes decodes count bytes from the cells starting at pos, where pos is the
+// clock cell of the first bit. It returns nil if the cells run out.
+func readBytes(cells []uint8, pos int, count int) []byte {
+	if pos+count*16 > len(cells) {
+		return nil
+	}
+	data := make([]byte, count)
+	for i := range data {
+		for j := 0; j < 8; j++ {
+			data[i] = data[i]<<1 | cells[pos+i*16+j*2+1]
+		}
+	}
+	return data
+}
+
+// decodeTrack finds the sectors in a track. Sectors whose ID is damaged are
+// skipped, and sectors whose data CRC is wrong are returned marked Bad. Only the
+// first good copy of a sector is returned.
+func decodeTrack(cells []uint8, fm bool) []Sector {
+	sectors := []Sector{}
+	seen := map[uint8]int{}
+
+	var id []byte // ID of the sector whose data is expected next
+	shift := uint16(0)
+	for pos := 0; pos < len(cells); {
+		shift = shift<<1 | uint16(cells[pos])
+		pos++
+
+		mark := -1
+		crc := uint16(0xFFFF)
+		if fm {
+			switch shift {
+			case fmIDMark:
+				mark = markID
+			case fmDataMark:
+				mark = markData
+			case fmDeletedMark:
+				mark = markDeleted
+			}
+			if mark >= 0 {
+				crc = crcCCITT(crc, byte(mark))
+			}
+		} else if shift == mfmSync {
+			for pos+16 <= len(cells) && readPattern(cells[pos:pos+16]) == mfmSync {
+				pos += 16
+			}
+			b := readBytes(cells, pos, 1)
+			if b == nil {
+				break
+			}
+			mark = int(b[0])
+			pos += 16
+			crc = crcCCITT(crc, 0xA1, 0xA1, 0xA1, b[0])
+		}
+		if mark < 0 {
+			continue
+		}
+		shift = 0
+
+		switch mark {
+		case markID:
+			b := readBytes(cells, pos, 6)
+			if b == nil || crcCCITT(crc, b...) != 0 || b[3] > 6 {
+				id = nil
+				continue
+			}
+			id = b[:4]
+			pos += 6 * 16
+		case markData, markDeleted:
+			if id == nil {
+				continue
+			}
+			size := 128 << id[3]
+			b := readBytes(cells, pos, size+2)
+			if b == nil {
+				id = nil
+				continue
+			}
+			pos += (size + 2) * 16
+			sector := Sector{
+				Cylinder: id[0],
+				Head:     id[1],
+				Number:   id[2],
+				SizeCode: id[3],
+				Deleted:  mark == markDeleted,
+				Bad:      crcCCITT(crc, b...) != 0,
+				Data:     b[:size],
+			}
+			id = nil
+
+			i, ok := seen[sector.Number]
+			if !ok {
+				seen[sector.Number] = len(sectors)
+				sectors = append(sectors, sector)
+			} else if sectors[i].Bad && !sector.Bad {
+				sectors[i] = sector
+			}
+		}
+	}
+	return sectors
+}
+
+func readPattern(cells []uint8) uint16 {
+	p := uint16(0)
+	for _, c := range cells {
+		p = p<<1 | uint16(c)
+	}
+	return p
+}
+
+// halve returns every other cell, starting with cell phase.
+func halve(cells []uint8, phase int) []uint8 {
+	half := make([]uint8, 0, len(cells)/2+1)
+	for i := phase; i < len(cells); i += 2 {
+		half = append(half, cells[i])
+	}
+	return half
+}
+
+// decodeAny decodes a track in whichever encoding finds the most good sectors:
+// MFM, FM, or FM recorded at twice its normal cell rate.
+func decodeAny(cells []uint8) (sectors []Sector, fm bool) {
+	score := func(s []Sector) int {
+		n := 0
+		for _, sector := range s {
+			if !sector.Bad {
+				n += 2
+			} else {
+				n++
+			}
+		}
+		return n
+	}
+
+	sectors = decodeTrack(cells, false)
+	for _, candidate := range [][]uint8{cells, halve(cells, 0), halve(cells, 1)} {
+		if s := decodeTrack(candidate, true); score(s) > score(sectors) {
+			sectors, fm = s, true
+		}
+	}
+	return sectors, fm
+}
@@ -16,7 +16,9 @@ package imd
 
 import (
 	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
 	"os"
+	"time"
 )
 
 type Sector struct {
@@ -69,22 +71,17 @@ func (imd *ImageDisk) SetTrack(track *Track) {
 
 func (imd *ImageDisk) Load(fileName string) error {
 	imd.FileName = fileName
-	file, err := os.Open(imd.FileName)
-	if err != nil {
-		return fmt.Errorf("failed to open image file: %w", err)
-	}
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			fmt.Printf("Warning: failed to close image file: %v", err)
-		}
-	}()
-
 	data, err := os.ReadFile(imd.FileName)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
+	return imd.Parse(data)
+}
+
+// Parse reads an ImageDisk image from memory. Images that are truncated or whose
+// headers do not make sense are reported as errors.
+func (imd *ImageDisk) Parse(data []byte) error {
 	if len(data) < 5 {
 		return fmt.Errorf("file too short: expected at least 5 bytes, got %d", len(data))
 	}
@@ -96,10 +93,16 @@ func (imd *ImageDisk) Load(fileName string) error {
 		imd.Comment = append(imd.Comment, data[0])
 		data = data[1:]
 	}
+	if len(data) == 0 {
+		return fmt.Errorf("comment is not terminated")
+	}
 	imd.Comment = append(imd.Comment, 0x1A)
 	data = data[1:] // Skip the 0x1A byte
 
 	for len(data) > 0 {
+		if len(data) < 5 {
+			return fmt.Errorf("truncated track header")
+		}
 		track := &Track{
 			Mode:           data[0],
 			Cylinder:       data[1],
@@ -108,13 +111,27 @@ func (imd *ImageDisk) Load(fileName string) error {
 			SectorSizeCode: data[4],
 			Sectors:        make(map[int]Sector),
 		}
-		imd.SetTrack(track)
 		data = data[5:]
 
-		//fmt.Printf("Loading track: Mode=%d, Cylinder=%d, Head=%d, SectorCount=%d, SectorSizeCode=%d\n",
-		//	track.Mode, track.Cylinder, track.Head, track.SectorCount, track.SectorSizeCode)
+		// bits 7 and 6 of the head say that cylinder and head maps follow the
+		// sector numbering map
+		maps := 0
+		if track.Head&0x80 != 0 {
+			maps += 1
+		}
+		if track.Head&0x40 != 0 {
+			maps += 1
+		}
+		track.Head &= 0x3F
+		if track.Head > 1 {
+			return fmt.Errorf("track %d: invalid head %d", track.Cylinder, track.Head)
+		}
+		imd.SetTrack(track)
 
 		if track.SectorSizeCode == 0xFF {
+			if len(data) < int(track.SectorCount) {
+				return fmt.Errorf("track %d/%d: truncated sector size map", track.Cylinder, track.Head)
+			}
 			for i := 0; i < int(track.SectorCount); i++ {
 				track.SectorSizeCodes = append(track.SectorSizeCodes, data[0])
 				data = data[1:]
@@ -125,15 +142,24 @@ func (imd *ImageDisk) Load(fileName string) error {
 			}
 		}
 
+		if len(data) < int(track.SectorCount) {
+			return fmt.Errorf("track %d/%d: truncated sector numbering map", track.Cylinder, track.Head)
+		}
 		track.SectorNumbers = data[:track.SectorCount]
 		data = data[track.SectorCount:]
 
+		if len(data) < maps*int(track.SectorCount) {
+			return fmt.Errorf("track %d/%d: truncated cylinder or head map", track.Cylinder, track.Head)
+		}
+		data = data[maps*int(track.SectorCount):]
+
 		for i := 0; i < int(track.SectorCount); i++ {
+			if len(data) < 1 {
+				return fmt.Errorf("track %d/%d: truncated sector %d", track.Cylinder, track.Head, i)
+			}
 			dataType := data[0]
 			data = data[1:]
 
-			//fmt.Printf("Sector %d: DataType=%d\n", track.SectorNumbers[i], dataType)
-
 			// I am suspicious about this dataType logic. I followed the same rules that Eric did in his
 			// code, yet it seems to be this should be doable as simple bitwise checks.
 			// TODO: Find a specification for IMD and get to the bottom of it.
@@ -141,22 +167,31 @@ func (imd *ImageDisk) Load(fileName string) error {
 			if dataType > 0x08 {
 				return fmt.Errorf("invalid data type: %d", dataType)
 			}
+			if track.SectorSizeCodes[i] > 6 {
+				return fmt.Errorf("track %d/%d: invalid sector size code %d", track.Cylinder, track.Head, track.SectorSizeCodes[i])
+			}
 			bad := (dataType == 0x00 || dataType == 0x05 || dataType == 0x06 || dataType == 0x07 || dataType == 0x08)
 			deleted := (dataType == 0x03 || dataType == 0x04 || dataType == 0x07 || dataType == 0x08)
 			compressed := (dataType == 0x02 || dataType == 0x04 || dataType == 0x06 || dataType == 0x08)
 			secSize := 128 << track.SectorSizeCodes[i]
 
-			//fmt.Printf("SecSize=%d, Deleted=%t, Bad=%t, Compressed=%t\n",
-			//	secSize, deleted, bad, compressed)
-
 			var secData []byte
-			if compressed {
+			if dataType == 0x00 {
+				// the sector could not be read, and there is no data for it
+				secData = make([]byte, secSize)
+			} else if compressed {
+				if len(data) < 1 {
+					return fmt.Errorf("track %d/%d: truncated sector %d", track.Cylinder, track.Head, i)
+				}
 				secData = make([]byte, secSize)
 				for j := 0; j < secSize; j++ {
 					secData[j] = data[0]
 				}
 				data = data[1:]
 			} else {
+				if len(data) < secSize {
+					return fmt.Errorf("track %d/%d: truncated sector %d", track.Cylinder, track.Head, i)
+				}
 				secData = data[:secSize]
 				data = data[secSize:]
 			}
@@ -183,8 +218,10 @@ func (imd *ImageDisk) GetIMD() ([]byte, error) {
 	//data = append(data, 0x1A)
 	for i := 0; i < imd.CylCount; i++ {
 		for j := 0; j < imd.HeadCount; j++ {
-			//fmt.Printf("Writing track: Cylinder=%d, Head=%d\n", i, j)
 			track := imd.Tracks[i][j]
+			if track == nil {
+				continue
+			}
 			data = append(data, track.Mode)
 			data = append(data, track.Cylinder)
 			data = append(data, track.Head)
@@ -224,9 +261,6 @@ func (imd *ImageDisk) GetIMD() ([]byte, error) {
 
 				data = append(data, uint8(dataType))
 
-				//fmt.Printf("  %d: SectorNumber=%d, SizeCode=%d, DataType=%d, compress=%v len=%d\n",
-				//	k, track.SectorNumbers[k], track.SectorSizeCodes[k], dataType, compress, len(sector.Data))
-
 				if compress {
 					data = append(data, sector.Data[0]) // Compressed data is just the first byte repeated
 				} else {
@@ -244,6 +278,9 @@ func (imd *ImageDisk) GetData() []byte {
 	for i := 0; i < imd.CylCount; i++ {
 		for j := 0; j < imd.HeadCount; j++ {
 			track := imd.Tracks[i][j]
+			if track == nil {
+				continue
+			}
 			for k := 0; k < int(track.SectorCount); k++ {
 				data = append(data, track.Sectors[k+1].Data...)
 			}
@@ -256,6 +293,9 @@ func (imd *ImageDisk) SetData(data []byte) {
 	for i := 0; i < imd.CylCount; i++ {
 		for j := 0; j < imd.HeadCount; j++ {
 			track := imd.Tracks[i][j]
+			if track == nil {
+				continue
+			}
 			for k := 0; k < int(track.SectorCount); k++ {
 				secLen := len(track.Sectors[k+1].Data)
 				copy(track.Sectors[k+1].Data, data[:secLen])
@@ -264,3 +304,124 @@ func (imd *ImageDisk) SetData(data []byte) {
 		}
 	}
 }
+
+// ReadSector returns the contents of a sector, or nil if the sector is not
+// present in the image.
+func (imd *ImageDisk) ReadSector(cylinder int, head int, sector int) ([]byte, error) {
+	track, ok := imd.Tracks[cylinder][head]
+	if !ok {
+		return nil, nil
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return nil, nil
+	}
+	return sec.Data, nil
+}
+
+// WriteSector replaces the contents of a sector that is present in the image.
+func (imd *ImageDisk) WriteSector(cylinder int, head int, sector int, data []byte) error {
+	track, ok := imd.Tracks[cylinder][head]
+	if !ok {
+		return fmt.Errorf("track %d/%d is not present in the image", cylinder, head)
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return fmt.Errorf("sector %d of track %d/%d is not present in the image", sector, cylinder, head)
+	}
+	copy(sec.Data, data)
+	return nil
+}
+
+// Geometry describes the tracks in the image. The format of cylinder 1 is taken
+// to be the normal format, and every track that differs from it is recorded as
+// an exception.
+func (imd *ImageDisk) Geometry() *geometry.Geometry {
+	g := &geometry.Geometry{
+		Name:       "imd",
+		Cylinders:  imd.CylCount,
+		Heads:      imd.HeadCount,
+		Exceptions: map[geometry.Location]geometry.TrackFormat{},
+	}
+	normal := min(1, imd.CylCount-1)
+	g.Track = imd.trackFormat(imd.Tracks[normal][0])
+	for c := 0; c < imd.CylCount; c++ {
+		for h := 0; h < imd.HeadCount; h++ {
+			tf := imd.trackFormat(imd.Tracks[c][h])
+			if tf != g.Track {
+				g.Exceptions[geometry.Location{Cylinder: c, Head: h}] = tf
+			}
+		}
+	}
+	return g
+}
+
+func (imd *ImageDisk) trackFormat(track *Track) geometry.TrackFormat {
+	if track == nil || track.SectorCount == 0 {
+		return geometry.TrackFormat{}
+	}
+	first := int(track.SectorNumbers[0])
+	for _, n := range track.SectorNumbers {
+		first = min(first, int(n))
+	}
+	return geometry.TrackFormat{
+		SectorSize:  128 << track.SectorSizeCodes[0],
+		SectorCount: int(track.SectorCount),
+		FirstSector: first,
+		FM:          track.Mode <= 2, // modes 0-2 are FM, 3-5 are MFM
+	}
+}
+
+// Save writes the image to the named file.
+func (imd *ImageDisk) Save(fileName string) error {
+	data, err := imd.GetIMD()
+	if err != nil {
+		return fmt.Errorf("failed to get IMD data: %w", err)
+	}
+	imd.FileName = fileName
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// Format replaces the contents of the image with empty tracks laid out according
+// to the geometry. FM tracks are recorded as 500 kbps FM (mode 0) and MFM tracks
+// as 500 kbps MFM (mode 3), which is what 8" drives use.
+func (imd *ImageDisk) Format(g *geometry.Geometry) error {
+	imd.Tracks = nil
+	imd.CylCount = 0
+	imd.HeadCount = 0
+	imd.Comment = []byte(fmt.Sprintf("1.18: %s\r\nCreated by rmxtool\r\n\x1A", time.Now().Format("02/01/2006 15:04:05")))
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		sizeCode := 0
+		for 128<<sizeCode < tf.SectorSize {
+			sizeCode++
+		}
+		if 128<<sizeCode != tf.SectorSize || sizeCode > 6 {
+			return fmt.Errorf("sector size %d cannot be stored in an IMD image", tf.SectorSize)
+		}
+		mode := uint8(3)
+		if tf.FM {
+			mode = 0
+		}
+		track := &Track{
+			Mode:           mode,
+			Cylinder:       uint8(loc.Cylinder),
+			Head:           uint8(loc.Head),
+			SectorCount:    uint8(tf.SectorCount),
+			SectorSizeCode: uint8(sizeCode),
+			Sectors:        make(map[int]Sector),
+		}
+		for i := 0; i < tf.SectorCount; i++ {
+			number := uint8(tf.FirstSector + i)
+			track.SectorNumbers = append(track.SectorNumbers, number)
+			track.SectorSizeCodes = append(track.SectorSizeCodes, uint8(sizeCode))
+			track.Sectors[int(number)] = Sector{
+				SizeCode: uint8(sizeCode),
+				Data:     make([]byte, tf.SectorSize),
+				Number:   number,
+			}
+		}
+		imd.SetTrack(track)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package imd
+
+import (
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"github.com/stretchr/testify/suite"
+	"testing"
+)
+
+func formatted(preset string) []byte {
+	g, err := geometry.Parse(preset)
+	if err != nil {
+		panic(err)
+	}
+	imd := NewImageDisk()
+	err = imd.Format(g)
+	if err != nil {
+		panic(err)
+	}
+	imd.Tracks[0][0].Sectors[1].Data[0] = 0xE5 // so that one sector is not compressed
+	data, err := imd.GetIMD()
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+type IMDSuite struct {
+	suite.Suite
+}
+
+func (s *IMDSuite) TestRoundTrip() {
+	data := formatted("intel-dsdd")
+	imd := NewImageDisk()
+	s.Require().NoError(imd.Parse(data))
+	s.Equal(77, imd.CylCount)
+	s.Equal(2, imd.HeadCount)
+
+	again, err := imd.GetIMD()
+	s.Require().NoError(err)
+	s.Equal(data, again)
+}
+
+func (s *IMDSuite) TestTruncated() {
+	data := formatted("intel-sssd")
+	for _, n := range []int{3, 40, len(data) - 1} {
+		s.Error(NewImageDisk().Parse(data[:n]), "%d bytes", n)
+	}
+}
+
+func TestIMDSuite(t *testing.T) {
+	suite.Run(t, new(IMDSuite))
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(formatted("intel-sssd"))
+	f.Add([]byte("IMD \x1a\x00\x00\x00\x01\xff\x02\x01\x00"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		imd := NewImageDisk()
+		if imd.Parse(data) != nil {
+			return
+		}
+		_ = imd.Geometry()
+		out, err := imd.GetIMD()
+		if err != nil {
+			return
+		}
+		err = NewImageDisk().Parse(out)
+		if err != nil {
+			t.Errorf("image written from a parsed image does not parse: %v", err)
+		}
+	})
+}
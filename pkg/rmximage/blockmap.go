@@ -0,0 +1,97 @@
+package rmximage
+
+// Owner says what a block of the volume is used for.
+type Owner int
+
+const (
+	OwnerFree      Owner = iota // free in the VolMap and used by no fnode
+	OwnerSystem                 // the labels, the fnode file, the bitmaps and the other system files
+	OwnerDirectory              // a directory
+	OwnerData                   // a data file
+	OwnerLost                   // allocated in the VolMap but used by no fnode that can be reached
+	OwnerBad                    // marked bad in the bad block map
+	OwnerShared                 // used by more than one fnode
+)
+
+// OwnerNames are the names of the owners, for legends.
+var OwnerNames = map[Owner]string{
+	OwnerFree:      "Free",
+	OwnerSystem:    "System",
+	OwnerDirectory: "Directory",
+	OwnerData:      "Data",
+	OwnerLost:      "Lost",
+	OwnerBad:       "Bad",
+	OwnerShared:    "Cross-linked",
+}
+
+func (o Owner) String() string {
+	return OwnerNames[o]
+}
+
+// BlockUse describes one block of the volume.
+type BlockUse struct {
+	Owner Owner
+	FNode int // the fnode using the block, or -1; the first of them if it is shared
+}
+
+// BlockMap returns what every block of the volume, as counted by the VolMap, is
+// used for. The fnodes that can be reached from the root directory and the
+// system fnodes are walked; indirect blocks belong to the file they describe.
+// Fnodes whose pointers cannot be followed are left out, and their blocks show
+// as lost.
+func (r *RMXImage) BlockMap() ([]BlockUse, error) {
+	volMap, err := r.GetVolMap()
+	if err != nil {
+		return nil, err
+	}
+	fnodes, _, _, err := r.readableFNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make([]BlockUse, volMap.GetNumBits())
+	for i := range blocks {
+		blocks[i] = BlockUse{Owner: OwnerFree, FNode: -1}
+		if volMap.IsAlloc(i) {
+			blocks[i].Owner = OwnerLost
+		}
+	}
+
+	for _, fnode := range fnodes {
+		n := fnode.Number
+		owner := OwnerSystem
+		switch {
+		case n == 0 || n == 3:
+		case fnode.IsDirectory():
+			owner = OwnerDirectory
+		case fnode.FType == TypeData:
+			owner = OwnerData
+		}
+		used := append(append([]int{}, fnode.AllIndirectBlocks...), fnode.AllDataBlocks...)
+		for _, b := range used {
+			if b < 0 || b >= len(blocks) {
+				continue
+			}
+			if blocks[b].FNode >= 0 && blocks[b].FNode != n {
+				blocks[b].Owner = OwnerShared
+				blocks[b].FNode = min(blocks[b].FNode, n)
+				continue
+			}
+			blocks[b] = BlockUse{Owner: owner, FNode: n}
+		}
+	}
+
+	// the bad block map has the layout of the VolMap, with a 0 bit for a bad block
+	badBlocks, err := r.GetFNode(4)
+	if err == nil && badBlocks.IsAllocated() && badBlocks.FType == TypeBadBlock {
+		data, err := r.ReadFile(badBlocks)
+		if err == nil {
+			for i := range blocks {
+				if i/8 < len(data) && data[i/8]&(1<<(i%8)) == 0 {
+					blocks[i].Owner = OwnerBad
+				}
+			}
+		}
+	}
+	return blocks, nil
+}
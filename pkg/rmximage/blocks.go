@@ -0,0 +1,142 @@
+package rmximage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// Annotation describes a structure found in blocks read with ReadBlocks.
+type Annotation struct {
+	Offset int // the byte offset of the structure within the blocks
+	Length int
+	Text   string
+}
+
+// ReadBlocks returns count blocks of the volume, starting at block.
+func (r *RMXImage) ReadBlocks(block int, count int) ([]byte, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	gran := int(vl.Gran)
+	if block < 0 || count < 1 {
+		return nil, fmt.Errorf("invalid block range %d, count %d", block, count)
+	}
+	return r.readRange(block*gran, (block+count)*gran)
+}
+
+// WriteBlocks replaces the blocks of the volume starting at block with data,
+// which need not be a whole number of blocks. Pending changes are flushed first,
+// and the cached label, fnodes and bitmaps are dropped after, so that what was
+// written is what later reads see.
+func (r *RMXImage) WriteBlocks(block int, data []byte) error {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return err
+	}
+	if block < 0 {
+		return fmt.Errorf("invalid block %d", block)
+	}
+	err = r.Flush()
+	if err != nil {
+		return err
+	}
+	err = r.writeRange(block*int(vl.Gran), data)
+	if err != nil {
+		return err
+	}
+	r.logger.Debug("wrote blocks", "block", block, "bytes", len(data))
+	r.clearCache()
+	return nil
+}
+
+// Annotate decodes the structures in count blocks starting at block that it
+// knows of: the volume labels, the fnodes, directory entries and the entries of
+// indirect blocks. Annotations are in order of offset.
+func (r *RMXImage) Annotate(block int, count int) ([]Annotation, error) {
+	data, err := r.ReadBlocks(block, count)
+	if err != nil {
+		return nil, err
+	}
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	index, err := r.BlockIndex()
+	if err != nil {
+		return nil, err
+	}
+	gran := int(vl.Gran)
+	start := block * gran
+	notes := []Annotation{}
+
+	// the labels, in volume offsets
+	if start <= rmxLabelOffset && rmxLabelOffset+128 <= start+len(data) {
+		notes = append(notes, Annotation{rmxLabelOffset - start, 128, fmt.Sprintf("RMX volume label: name %q, granularity %d, size %d, %d FNodes at %d, root FNode %d",
+			vl.Name, vl.Gran, vl.Size, vl.MaxFnode, vl.FnodeStart, vl.RootFnode)})
+	}
+	if start <= isoLabelOffset && labelsEnd <= start+len(data) {
+		ivl, err := r.GetIsoVolumeLabel()
+		if err == nil {
+			notes = append(notes, Annotation{isoLabelOffset - start, labelsEnd - isoLabelOffset,
+				fmt.Sprintf("ISO volume label: id %q, name %q", ivl.LabelId, ivl.Name)})
+		}
+	}
+
+	for i := 0; i < len(data); i += gran {
+		for _, owner := range index[block+i/gran] {
+			fnode, err := r.GetFNode(owner.FNode)
+			if err != nil {
+				continue
+			}
+			switch {
+			case owner.Indirect:
+				for _, entry := range decodeIndirect(data[i : i+gran]) {
+					notes = append(notes, Annotation{i + entry.Offset, 4, fmt.Sprintf("indirect entry of FNode %d: %d blocks at %d", owner.FNode, entry.NumBlocks, entry.BlockPointer)})
+				}
+			case fnode.IsDirectory():
+				for j := i; j+16 <= i+gran && owner.Offset+j-i < int(fnode.TotalSize); j += 16 {
+					entry := int(binary.LittleEndian.Uint16(data[j : j+2]))
+					if entry == 0 {
+						continue
+					}
+					notes = append(notes, Annotation{j, 16, fmt.Sprintf("directory entry of FNode %d: FNode %d, %q", owner.FNode, entry, getStr(data[j+2:j+16]))})
+				}
+			}
+		}
+	}
+
+	// the fnodes, wherever the label says they are
+	fnodeSize := int(vl.FnodeSize)
+	for n := 0; n < int(vl.MaxFnode); n++ {
+		offset := int(vl.FnodeStart) + n*fnodeSize - start
+		if offset+fnodeSize <= 0 {
+			continue
+		}
+		if offset >= len(data) {
+			break
+		}
+		if offset < 0 || offset+fnodeSize > len(data) {
+			continue
+		}
+		f := &FNode{}
+		if f.Deserialize(data[offset:offset+fnodeSize]) != nil {
+			continue
+		}
+		text := fmt.Sprintf("FNode %d: free", n)
+		if f.IsAllocated() {
+			typeName, ok := TypeNames[int(f.FType)]
+			if !ok {
+				typeName = fmt.Sprintf("type %d", f.FType)
+			}
+			text = fmt.Sprintf("FNode %d: %s, %d bytes in %d blocks, parent %d", n, typeName, f.TotalSize, f.TotalBlocks, f.Parent)
+		}
+		notes = append(notes, Annotation{offset, fnodeSize, text})
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].Offset < notes[j].Offset
+	})
+	return notes, nil
+}
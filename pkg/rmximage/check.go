@@ -0,0 +1,431 @@
+package rmximage
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Severity says how serious a Finding is.
+type Severity int
+
+const (
+	// SeverityWarning is a problem that does not lose data, such as a block
+	// that is allocated but not used.
+	SeverityWarning Severity = iota
+	// SeverityError is a problem that loses data or will corrupt the volume
+	// when it is next written.
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// The kinds of Finding that Check reports.
+const (
+	KindLabel       = "label"        // the volume label cannot be read
+	KindIsoLabel    = "iso-label"    // the ISO volume label is missing or implausible
+	KindBitmap      = "bitmap"       // the VolMap or FNodeMap cannot be read
+	KindSystem      = "system"       // a system fnode is missing, of the wrong type or too small
+	KindFNode       = "fnode"        // an fnode cannot be read, or is not allocated
+	KindType        = "type"         // an fnode has an unknown type
+	KindParent      = "parent"       // the Parent of an fnode is not its directory
+	KindSize        = "size"         // TotalSize, TotalBlocks or ThisSize disagree with the blocks
+	KindPointer     = "pointer"      // a block pointer lies beyond the end of the volume
+	KindIndirect    = "indirect"     // the indirect blocks of a long file are damaged
+	KindFile        = "file"         // the data of an fnode cannot be read
+	KindDirectory   = "directory"    // a directory cannot be read
+	KindDuplicate   = "duplicate"    // a name appears more than once in a directory
+	KindCycle       = "cycle"        // a directory contains one of its ancestors
+	KindMultiLink   = "multi-link"   // an fnode is linked from more than one directory entry
+	KindSharedBlock = "shared-block" // a block belongs to more than one fnode
+	KindFreeBlock   = "free-block"   // a block is in use but marked free
+	KindLostBlock   = "lost-block"   // a block is marked allocated but not used
+	KindFreeFNode   = "free-fnode"   // an fnode is in use but marked free
+	KindLostFNode   = "lost-fnode"   // an fnode is marked allocated but not used
+)
+
+// Finding is a problem found by Check. FNode and Block are -1 when the problem
+// is not about a particular fnode or block.
+type Finding struct {
+	Severity Severity
+	Kind     string
+	FNode    int
+	Block    int
+	Path     string // the path of the fnode, when it was reached from the root
+	Message  string
+}
+
+func (f Finding) String() string {
+	where := ""
+	if f.FNode >= 0 {
+		where = fmt.Sprintf("FNode %d: ", f.FNode)
+		if f.Path != "" {
+			where = fmt.Sprintf("FNode %d (%s): ", f.FNode, f.Path)
+		}
+	} else if f.Block >= 0 {
+		where = fmt.Sprintf("Block %d: ", f.Block)
+	}
+	return fmt.Sprintf("%s: %s%s", f.Severity, where, f.Message)
+}
+
+// systemFNodes are the fnodes that the iRMX format utility creates on every
+// volume, other than the root directory.
+var systemFNodes = []struct {
+	number int
+	ftype  int
+	name   string
+	inRoot bool // whether the root directory lists it
+}{
+	{0, TypeFNode, "FNode file", false},
+	{1, TypeVolMap, "VolMap", true},
+	{2, TypeFNodeMap, "FNodeMap", true},
+	{4, TypeBadBlock, "bad block map", true},
+	{5, TypeVolLabel, "volume label file", true},
+}
+
+// checker holds the state of a Check as it walks the volume.
+type checker struct {
+	r         *RMXImage
+	vl        *RmxVolumeLabel
+	volBlocks int           // the number of blocks in the volume, from the label
+	blocks    map[int][]int // block number to the fnodes that use it
+	fnodes    map[int]bool  // fnodes reached from the special fnodes and the root
+	paths     map[int]string
+	findings  []Finding
+}
+
+func (c *checker) add(severity Severity, kind string, fnode int, block int, pathName string, format string, args ...interface{}) {
+	c.findings = append(c.findings, Finding{
+		Severity: severity,
+		Kind:     kind,
+		FNode:    fnode,
+		Block:    block,
+		Path:     pathName,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// Check walks the volume from its special fnodes and the root directory, checks
+// each fnode and directory it reaches, and reconciles the blocks and fnodes it
+// reaches with the VolMap and FNodeMap. It does not change the volume. An empty
+// result means no problems were found.
+func (r *RMXImage) Check() []Finding {
+	c := &checker{r: r, blocks: map[int][]int{}, fnodes: map[int]bool{}, paths: map[int]string{}}
+
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		c.add(SeverityError, KindLabel, -1, -1, "", "cannot read the volume label: %v", err)
+		return c.findings
+	}
+	c.vl = vl
+	c.volBlocks = int(vl.Size) / int(vl.Gran)
+
+	r.logger.Debug("checking volume", "name", vl.Name)
+	c.checkIsoLabel()
+	c.checkFNode(0, "FNodeList", "", -1, nil)
+	c.checkFNode(3, "Unused FNode", "", -1, nil)
+	c.checkFNode(int(vl.RootFnode), "RootDirectory", "/", -1, nil)
+	c.checkSystemFNodes()
+
+	volMap, err := r.GetVolMap()
+	if err != nil {
+		c.add(SeverityError, KindBitmap, 1, -1, "", "cannot read the VolMap: %v", err)
+		return c.findings
+	}
+
+	r.logger.Debug("reconciling free lists")
+	for i := 0; i < volMap.GetNumBits(); i++ {
+		users, used := c.blocks[i]
+		if len(users) > 1 {
+			c.add(SeverityError, KindSharedBlock, -1, i, "", "block is used by FNodes %v", users)
+		}
+		if volMap.IsAlloc(i) && !used {
+			c.add(SeverityWarning, KindLostBlock, -1, i, "", "block is marked allocated in the VolMap but is not used")
+		} else if !volMap.IsAlloc(i) && used {
+			c.add(SeverityError, KindFreeBlock, -1, i, "", "block is marked free in the VolMap but is used by FNode %d", users[0])
+		}
+	}
+	beyond := []int{}
+	for block := range c.blocks {
+		if block >= volMap.GetNumBits() {
+			beyond = append(beyond, block)
+		}
+	}
+	sort.Ints(beyond)
+	for _, block := range beyond {
+		c.add(SeverityError, KindFreeBlock, -1, block, "", "block used by FNode %d is beyond the end of the VolMap", c.blocks[block][0])
+	}
+
+	fnodeMap, err := r.GetFNodeMap()
+	if err != nil {
+		c.add(SeverityError, KindBitmap, 2, -1, "", "cannot read the FNodeMap: %v", err)
+		return c.findings
+	}
+
+	for i := 0; i < fnodeMap.GetNumBits(); i++ {
+		if fnodeMap.IsAlloc(i) && !c.fnodes[i] {
+			c.add(SeverityWarning, KindLostFNode, i, -1, "", "FNode is marked allocated in the FNodeMap but is not used")
+		} else if !fnodeMap.IsAlloc(i) && c.fnodes[i] {
+			c.add(SeverityError, KindFreeFNode, i, -1, "", "FNode is marked free in the FNodeMap but is used")
+		}
+	}
+
+	return c.findings
+}
+
+// checkIsoLabel checks that the fields of the ISO volume label hold the digits
+// and printable characters that the format utility writes.
+func (c *checker) checkIsoLabel() {
+	ivl, err := c.r.GetIsoVolumeLabel()
+	if err != nil {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "cannot read the ISO volume label: %v", err)
+		return
+	}
+	if ivl.LabelId != "VOL" {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "there is no ISO volume label")
+		return
+	}
+	if !isPrintable(ivl.Name) || !isPrintable(ivl.Struc) {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "the ISO volume label name %q or structure %q is not printable", ivl.Name, ivl.Struc)
+	}
+	if ivl.Side < 0 || ivl.Side > 2 {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "the ISO volume label side %d is not 0, 1 or 2", ivl.Side)
+	}
+	if ivl.Interleave < 0 || ivl.Interleave > 99 {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "the ISO volume label interleave %d is not two digits", ivl.Interleave)
+	}
+	if ivl.IsoVersion < 0 || ivl.IsoVersion > 9 {
+		c.add(SeverityWarning, KindIsoLabel, -1, -1, "", "the ISO volume label version %d is not a digit", ivl.IsoVersion)
+	}
+}
+
+func isPrintable(s string) bool {
+	for _, ch := range s {
+		if ch < ' ' || ch > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSystemFNodes checks the system fnodes themselves. They are normally
+// reached through the root directory; any that were not are checked here so
+// that their blocks are accounted for.
+func (c *checker) checkSystemFNodes() {
+	for _, sys := range systemFNodes {
+		if sys.inRoot && !c.fnodes[sys.number] {
+			c.add(SeverityWarning, KindSystem, sys.number, -1, "", "the %s is not in the root directory", sys.name)
+			c.checkFNode(sys.number, sys.name, "", -1, nil)
+		}
+		fnode, err := c.r.GetFNode(sys.number)
+		if err != nil {
+			continue // already reported
+		}
+		if int(fnode.FType) != sys.ftype {
+			c.add(SeverityError, KindSystem, sys.number, -1, "", "the %s has type %d, not %d", sys.name, fnode.FType, sys.ftype)
+			continue
+		}
+
+		need := 0
+		switch sys.ftype {
+		case TypeFNode:
+			need = int(c.vl.MaxFnode) * int(c.vl.FnodeSize)
+		case TypeVolMap:
+			need = (c.volBlocks + 7) / 8
+		case TypeFNodeMap:
+			need = (int(c.vl.MaxFnode) + 7) / 8
+		case TypeVolLabel:
+			if fnode.Pointers[0].BlockPointer != 0 {
+				c.add(SeverityWarning, KindSystem, sys.number, -1, "", "the %s does not start at block 0", sys.name)
+			}
+			need = labelsEnd
+		}
+		if int(fnode.TotalSize) < need {
+			c.add(SeverityError, KindSystem, sys.number, -1, "", "the %s holds %d bytes, it needs %d", sys.name, fnode.TotalSize, need)
+		}
+	}
+}
+
+// markBlocks records the blocks that fnode uses.
+func (c *checker) markBlocks(fnode *FNode) {
+	for _, b := range fnode.AllIndirectBlocks {
+		c.blocks[b] = append(c.blocks[b], fnode.Number)
+	}
+	for _, b := range fnode.AllDataBlocks {
+		c.blocks[b] = append(c.blocks[b], fnode.Number)
+	}
+}
+
+// checkFNode checks an fnode and, if it is a directory, everything in it. parent
+// is the directory the fnode was found in, or -1, and ancestors are the
+// directories above it.
+func (c *checker) checkFNode(fnodeNumber int, name string, pathName string, parent int, ancestors map[int]bool) {
+	c.r.logger.Debug("checking FNode", "fnode", fnodeNumber, "name", name)
+	if c.fnodes[fnodeNumber] {
+		if ancestors[fnodeNumber] {
+			c.add(SeverityError, KindCycle, fnodeNumber, -1, pathName, "directory contains itself")
+		} else {
+			c.add(SeverityError, KindMultiLink, fnodeNumber, -1, pathName, "FNode is also linked as %q", c.paths[fnodeNumber])
+		}
+		return // don't follow directory loops
+	}
+	fnode, err := c.r.GetFNode(fnodeNumber)
+	if err != nil {
+		c.add(SeverityError, KindFNode, fnodeNumber, -1, pathName, "cannot read FNode: %v", err)
+		return // stop looking at this fnode
+	}
+	c.fnodes[fnodeNumber] = true
+	c.paths[fnodeNumber] = pathName
+	if !fnode.IsAllocated() {
+		c.add(SeverityError, KindFNode, fnodeNumber, -1, pathName, "FNode is not allocated")
+	}
+	if _, ok := TypeNames[int(fnode.FType)]; !ok {
+		c.add(SeverityError, KindType, fnodeNumber, -1, pathName, "FNode has unknown type %d", fnode.FType)
+	}
+	if parent >= 0 && int(fnode.Parent) != parent {
+		c.add(SeverityWarning, KindParent, fnodeNumber, -1, pathName, "Parent is %d, but the FNode is in directory %d", fnode.Parent, parent)
+	}
+
+	dataBlocks, indirectBlocks, ok := c.checkPointers(fnode, pathName)
+	if !ok {
+		return // ReadFile would only report the same problem again
+	}
+	_, err = c.r.ReadFile(fnode)
+	if err != nil {
+		c.add(SeverityError, KindFile, fnodeNumber, -1, pathName, "cannot read file: %v", err)
+		return // stop looking at this fnode
+	}
+	c.checkSizes(fnode, pathName, dataBlocks, indirectBlocks)
+	c.markBlocks(fnode)
+	if fnode.IsDirectory() {
+		below := map[int]bool{fnodeNumber: true}
+		for n := range ancestors {
+			below[n] = true
+		}
+		c.checkDir(fnode, pathName, below)
+	}
+}
+
+// checkPointers checks that the blocks an fnode points to, and for a long file
+// its indirect blocks, lie within the volume. It returns the number of data
+// and indirect blocks, and false if the file cannot be read.
+func (c *checker) checkPointers(fnode *FNode, pathName string) (int, int, bool) {
+	ok := true
+	dataBlocks, indirectBlocks := 0, 0
+	inVolume := func(block int, count int, what string) bool {
+		if block+count > c.volBlocks {
+			c.add(SeverityError, KindPointer, fnode.Number, -1, pathName, "%s beyond the end of the volume (%d blocks)", what, c.volBlocks)
+			ok = false
+			return false
+		}
+		return true
+	}
+
+	if !fnode.IsLong() {
+		for _, pointer := range fnode.Pointers {
+			if pointer.NumBlocks == 0 {
+				continue
+			}
+			inVolume(int(pointer.BlockPointer), int(pointer.NumBlocks),
+				fmt.Sprintf("blocks %d-%d lie", pointer.BlockPointer, int(pointer.BlockPointer)+int(pointer.NumBlocks)-1))
+			dataBlocks += int(pointer.NumBlocks)
+		}
+		return dataBlocks, 0, ok
+	}
+
+	// the indirect blocks describe as many data blocks as TotalBlocks says,
+	// less the indirect blocks themselves
+	for _, pointer := range fnode.Pointers {
+		if pointer.NumBlocks != 0 {
+			indirectBlocks++
+		}
+	}
+	remaining := int(fnode.TotalBlocks)
+	for _, pointer := range fnode.Pointers {
+		if pointer.NumBlocks == 0 {
+			continue
+		}
+		remaining-- // the indirect block itself, counted as ReadFile does
+		if !inVolume(int(pointer.BlockPointer), 1, fmt.Sprintf("indirect block %d lies", pointer.BlockPointer)) {
+			continue
+		}
+		start := int(pointer.BlockPointer) * int(c.vl.Gran)
+		blockfile, err := c.r.readRange(start, start+int(c.vl.Gran)*int(fnode.Gran))
+		if err != nil {
+			c.add(SeverityError, KindIndirect, fnode.Number, int(pointer.BlockPointer), pathName, "cannot read indirect block: %v", err)
+			ok = false
+			continue
+		}
+		for _, entry := range decodeIndirect(blockfile) {
+			if remaining <= 0 {
+				break
+			}
+			inVolume(entry.BlockPointer, entry.NumBlocks,
+				fmt.Sprintf("blocks %d-%d, listed in indirect block %d, lie", entry.BlockPointer, entry.BlockPointer+entry.NumBlocks-1, pointer.BlockPointer))
+			dataBlocks += entry.NumBlocks
+			remaining -= entry.NumBlocks
+		}
+	}
+	if remaining > 0 {
+		c.add(SeverityError, KindIndirect, fnode.Number, -1, pathName, "the indirect blocks describe %d blocks, TotalBlocks says %d", dataBlocks+indirectBlocks, fnode.TotalBlocks)
+		ok = false
+	}
+	return dataBlocks, indirectBlocks, ok
+}
+
+// checkSizes checks TotalSize, TotalBlocks and ThisSize against the blocks the
+// fnode points to, and its file granularity.
+func (c *checker) checkSizes(fnode *FNode, pathName string, dataBlocks int, indirectBlocks int) {
+	gran := int(c.vl.Gran)
+	if fnode.Gran == 0 {
+		c.add(SeverityError, KindSize, fnode.Number, -1, pathName, "file granularity is 0")
+	} else if int(fnode.ThisSize)%(int(fnode.Gran)*gran) != 0 {
+		c.add(SeverityWarning, KindSize, fnode.Number, -1, pathName, "ThisSize %d is not a multiple of the file granularity of %d blocks", fnode.ThisSize, fnode.Gran)
+	}
+	if int(fnode.TotalBlocks) != dataBlocks+indirectBlocks {
+		c.add(SeverityWarning, KindSize, fnode.Number, -1, pathName, "TotalBlocks is %d, but the FNode points to %d blocks", fnode.TotalBlocks, dataBlocks+indirectBlocks)
+	}
+	if int(fnode.ThisSize) != dataBlocks*gran {
+		c.add(SeverityWarning, KindSize, fnode.Number, -1, pathName, "ThisSize is %d, but the FNode has %d bytes of data blocks", fnode.ThisSize, dataBlocks*gran)
+	}
+	if fnode.TotalSize > fnode.ThisSize {
+		c.add(SeverityWarning, KindSize, fnode.Number, -1, pathName, "TotalSize %d is larger than ThisSize %d", fnode.TotalSize, fnode.ThisSize)
+	}
+}
+
+func (c *checker) checkDir(dir *FNode, pathName string, ancestors map[int]bool) {
+	dirList, err := c.r.GetDirectory(dir)
+	if err != nil {
+		c.add(SeverityError, KindDirectory, dir.Number, -1, pathName, "cannot read directory: %v", err)
+		return
+	}
+	names := map[string]bool{}
+	for _, entry := range dirList.Entries {
+		if entry.FNode == 0 {
+			continue
+		}
+		entryPath := path.Join(pathName, entry.Name)
+		key := strings.ToUpper(entry.Name)
+		if names[key] {
+			c.add(SeverityError, KindDuplicate, int(entry.FNode), -1, entryPath, "name %q appears more than once in directory %d", entry.Name, dir.Number)
+		}
+		names[key] = true
+		c.checkFNode(int(entry.FNode), entry.Name, entryPath, dir.Number, ancestors)
+	}
+}
+
+// HasErrors returns true if any of findings is an error rather than a warning.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,145 @@
+package rmximage
+
+import (
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/container"
+)
+
+const (
+	rmxLabelOffset = 384
+	isoLabelOffset = 768
+	labelsEnd      = 896
+	minFnodeSize   = 87
+)
+
+// CheckVolumeLabel checks that the iRMX volume label of a volume is plausible:
+// the granularity is a multiple of 128, the fnode file lies within the volume,
+// and the root fnode is one of the fnodes.
+func CheckVolumeLabel(data []byte) error {
+	if len(data) < labelsEnd {
+		return fmt.Errorf("image is too small to hold a volume label (%d bytes)", len(data))
+	}
+	vl := &RmxVolumeLabel{}
+	err := vl.Deserialize(data[rmxLabelOffset:])
+	if err != nil {
+		return err
+	}
+
+	if vl.Gran == 0 || vl.Gran%128 != 0 {
+		return fmt.Errorf("granularity %d is not a multiple of 128", vl.Gran)
+	}
+	if vl.Size < labelsEnd {
+		return fmt.Errorf("volume size %d is too small", vl.Size)
+	}
+	if vl.FnodeSize < minFnodeSize || vl.FnodeSize > 512 {
+		return fmt.Errorf("fnode size %d is implausible", vl.FnodeSize)
+	}
+	if vl.MaxFnode <= vl.RootFnode || vl.RootFnode == 0 {
+		return fmt.Errorf("root fnode %d is not one of the %d fnodes", vl.RootFnode, vl.MaxFnode)
+	}
+	if vl.FnodeStart < labelsEnd || uint64(vl.FnodeStart)+uint64(vl.MaxFnode)*uint64(vl.FnodeSize) > uint64(vl.Size) {
+		return fmt.Errorf("fnodes at %d are not within the volume of %d bytes", vl.FnodeStart, vl.Size)
+	}
+	return nil
+}
+
+// hasIsoVolumeLabel returns true if the volume has an ISO volume label.
+func hasIsoVolumeLabel(data []byte) bool {
+	return len(data) >= labelsEnd && string(data[isoLabelOffset:isoLabelOffset+3]) == "VOL"
+}
+
+// labelScore rates how much the labels of a volume look like those of an iRMX
+// volume.
+func labelScore(data []byte) int {
+	score := 0
+	if CheckVolumeLabel(data) == nil {
+		score += 2
+	}
+	if hasIsoVolumeLabel(data) {
+		score += 1
+	}
+	return score
+}
+
+// detectByteSwap returns true if the labels of the volume are more plausible
+// with its bytes swapped than as they are.
+func detectByteSwap(data []byte) bool {
+	if len(data) < labelsEnd {
+		return false
+	}
+	swapped := make([]byte, labelsEnd)
+	copy(swapped, data[:labelsEnd])
+	swapBytes(swapped)
+	return labelScore(swapped) > labelScore(data)
+}
+
+// Volume is an iRMX volume found within a larger image.
+type Volume struct {
+	Offset  int    // in bytes from the start of the image
+	Size    int    // in bytes, according to the volume label
+	Name    string // from the volume label
+	Swapped bool   // the volume label only makes sense with its bytes swapped
+}
+
+// ScanVolumes finds the iRMX volumes in an image, such as the partitions of a
+// hard disk, by looking for plausible volume labels in either byte order at every
+// 128-byte boundary. The search continues after the end of each volume found, so
+// that disk images stored as files within a volume are not reported.
+func ScanVolumes(data []byte) []Volume {
+	return scanVolumes(len(data), func(offset int, count int) ([]byte, error) {
+		return data[offset:min(offset+count, len(data))], nil
+	})
+}
+
+// scanWindow is the number of bytes scanVolumes reads at a time.
+const scanWindow = 1 << 20
+
+func scanVolumes(size int, read func(offset int, count int) ([]byte, error)) []Volume {
+	volumes := []Volume{}
+	swapped := make([]byte, labelsEnd)
+	window := []byte{}
+	windowStart := 0
+	for offset := 0; offset+labelsEnd <= size; offset += 128 {
+		if offset+labelsEnd > windowStart+len(window) {
+			var err error
+			windowStart = offset
+			window, err = read(offset, min(scanWindow, size-offset))
+			if err != nil {
+				break
+			}
+		}
+
+		label := window[offset-windowStart : offset-windowStart+labelsEnd]
+		isSwapped := false
+		if CheckVolumeLabel(label) != nil {
+			copy(swapped, label)
+			swapBytes(swapped)
+			if CheckVolumeLabel(swapped) != nil {
+				continue
+			}
+			label = swapped
+			isSwapped = true
+		}
+
+		vl := &RmxVolumeLabel{}
+		err := vl.Deserialize(label[rmxLabelOffset:])
+		if err != nil {
+			continue
+		}
+		volumes = append(volumes, Volume{
+			Offset:  offset,
+			Size:    int(vl.Size),
+			Name:    vl.Name,
+			Swapped: isSwapped,
+		})
+		offset += (int(vl.Size) - 1) / 128 * 128
+	}
+	return volumes
+}
+
+// ScanVolumes finds the iRMX volumes anywhere in the image, whatever volume was
+// chosen when it was loaded. Swapped is relative to the bytes as stored in the
+// image file.
+func (r *RMXImage) ScanVolumes() []Volume {
+	return scanVolumes(r.container.NumBlocks()*container.BlockSize, r.readImage)
+}
@@ -0,0 +1,48 @@
+package rmximage
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned by the operations on an image are wrapped around these, so
+// that callers can tell them apart with errors.Is.
+var (
+	ErrNotFound       = errors.New("not found")
+	ErrNotDirectory   = errors.New("is not a directory")
+	ErrExists         = errors.New("already exists")
+	ErrVolumeFull     = errors.New("volume is full")
+	ErrNoFreeFNode    = errors.New("no free FNodes")
+	ErrTooManyExtents = errors.New("too many extents")
+	ErrCorrupt        = errors.New("corrupt")
+)
+
+// CorruptError reports a structure on the volume whose contents cannot be right,
+// such as a block pointer that lies beyond the end of the volume.
+type CorruptError struct {
+	What   string // the structure, such as "FNode 12" or "volume label"
+	Offset int    // where the structure is in the volume, in bytes
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("%s at offset %d is corrupt: %s", e.What, e.Offset, e.Reason)
+}
+
+// Is makes every CorruptError match ErrCorrupt.
+func (e *CorruptError) Is(target error) bool {
+	return target == ErrCorrupt
+}
+
+func corrupt(what string, offset int, format string, args ...interface{}) error {
+	return &CorruptError{What: what, Offset: offset, Reason: fmt.Sprintf(format, args...)}
+}
+
+// fnodeCorrupt reports that fnode n is corrupt.
+func (r *RMXImage) fnodeCorrupt(n int, format string, args ...interface{}) error {
+	offset := 0
+	if r.label != nil {
+		offset, _ = r.fnodeRange(n)
+	}
+	return corrupt(fmt.Sprintf("FNode %d", n), offset, format, args...)
+}
@@ -0,0 +1,127 @@
+package rmximage
+
+import (
+	"bytes"
+	"github.com/sbelectronics/rmxtool/internal/testvolume"
+	"testing"
+)
+
+func FuzzFNode(f *testing.F) {
+	volume := testvolume.Make()
+	f.Add(volume[testFnodeBase*testGran : testFnodeBase*testGran+minFnodeSize])
+	f.Add(volume[testFnodeBase*testGran+testHelloFNode*minFnodeSize : testFnodeBase*testGran+(testHelloFNode+1)*minFnodeSize])
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fnode := &FNode{}
+		if fnode.Deserialize(data) != nil {
+			return
+		}
+		// every byte of an fnode belongs to a field
+		out := make([]byte, minFnodeSize)
+		fnode.Serialize(out)
+		if !bytes.Equal(out, data[:minFnodeSize]) {
+			t.Errorf("FNode did not survive a round trip: %x became %x", data[:minFnodeSize], out)
+		}
+	})
+}
+
+func FuzzDirectory(f *testing.F) {
+	volume := testvolume.Make()
+	f.Add(volume[testRoot*testGran:(testRoot+1)*testGran], 16)
+	f.Add([]byte{}, 0)
+	f.Add([]byte{1, 2, 3}, 16)
+	f.Fuzz(func(t *testing.T, data []byte, length int) {
+		dir := &Directory{}
+		if dir.Deserialize(data, length) != nil {
+			return
+		}
+		out := make([]byte, 16*len(dir.Entries))
+		dir.Serialize(out)
+		again := &Directory{}
+		err := again.Deserialize(out, len(out))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again.Entries) != len(dir.Entries) {
+			t.Fatalf("%d entries became %d", len(dir.Entries), len(again.Entries))
+		}
+		for i := range dir.Entries {
+			if again.Entries[i].FNode != dir.Entries[i].FNode {
+				t.Errorf("entry %d: FNode %d became %d", i, dir.Entries[i].FNode, again.Entries[i].FNode)
+			}
+		}
+	})
+}
+
+func FuzzVolumeLabel(f *testing.F) {
+	volume := testvolume.Make()
+	f.Add(volume[:labelsEnd])
+	f.Add(volume[:rmxLabelOffset+10])
+	f.Fuzz(func(t *testing.T, data []byte) {
+		_ = CheckVolumeLabel(data)
+		_ = detectByteSwap(data)
+		_ = ScanVolumes(data)
+
+		iso := &IsoVolumeLabel{}
+		if len(data) >= labelsEnd {
+			_ = iso.Deserialize(data[isoLabelOffset:])
+		}
+
+		vl := &RmxVolumeLabel{}
+		if len(data) < rmxLabelOffset || vl.Deserialize(data[rmxLabelOffset:]) != nil {
+			return
+		}
+		out := make([]byte, 128)
+		vl.Serialize(out)
+		again := &RmxVolumeLabel{}
+		err := again.Deserialize(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.Size != vl.Size || again.FnodeStart != vl.FnodeStart || again.RootFnode != vl.RootFnode {
+			t.Errorf("volume label did not survive a round trip: %+v became %+v", vl, again)
+		}
+	})
+}
+
+// FuzzVolume reads and writes a damaged volume the way the commands do. Errors
+// are expected, panics are not.
+func FuzzVolume(f *testing.F) {
+	f.Add(testvolume.Make())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := loadBytes(data)
+		vl, err := r.GetVolumeLabel()
+		if err != nil {
+			return
+		}
+		_, _ = r.GetIsoVolumeLabel()
+		if volMap, err := r.GetVolMap(); err == nil {
+			_, _ = volMap.NextFree()
+		}
+		if fnodeMap, err := r.GetFNodeMap(); err == nil {
+			_, _ = fnodeMap.NextFree()
+		}
+
+		for i := 0; i < min(int(vl.MaxFnode), 64); i++ {
+			fnode, err := r.GetFNode(i)
+			if err != nil {
+				continue
+			}
+			_, _ = r.ReadFile(fnode)
+			_, _, _ = r.SalvageFile(fnode)
+		}
+
+		root, err := r.GetRootDirectory()
+		if err != nil {
+			return
+		}
+		if dir, err := r.GetDirectory(root); err == nil {
+			for _, entry := range dir.Entries {
+				_, _ = r.Lookup(nil, entry.Name)
+			}
+		}
+		_ = r.Check()
+		_, _ = r.PutFile(root, "fuzz.txt", []byte("fuzz"), false)
+		_ = r.Flush()
+	})
+}
@@ -0,0 +1,132 @@
+package rmximage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// layoutFields are the label fields that describe where the structures of the
+// volume are, or what the ISO label is, and so cannot be changed by SetLabelField.
+var layoutFields = map[string]string{
+	"gran":       "the granularity",
+	"size":       "the size",
+	"maxfnode":   "the number of FNodes (use incfnode)",
+	"fnodestart": "the position of the FNodes",
+	"fnodesize":  "the size of the FNodes",
+	"rootfnode":  "the root directory",
+	"labelid":    "the ISO label id",
+	"struc":      "the ISO structure",
+	"isoversion": "the ISO version",
+}
+
+// labelNumber parses value as a number from 0 to max.
+func labelNumber(name string, value string, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("%s must be a number from 0 to %d, got %q", name, max, value)
+	}
+	return n, nil
+}
+
+// SetLabelField changes a field of the volume labels. name sets the name in
+// both labels, cut to 6 characters in the ISO label; isoname sets only the ISO
+// name. fill is in the RMX label, and side and interleave are in the ISO label.
+// The fields that give the layout of the volume are refused. So is a change of
+// the interleave of a volume that holds files, unless force is set: a raw dump
+// read with interleave=iso has its sectors where the old interleave put them,
+// and would be read back through the new one.
+func (r *RMXImage) SetLabelField(name string, value string, force bool) error {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return err
+	}
+	ivl, err := r.GetIsoVolumeLabel()
+	if err != nil {
+		return err
+	}
+
+	field := strings.ToLower(name)
+	if what, ok := layoutFields[field]; ok {
+		return fmt.Errorf("%s cannot be changed, it is %s of the volume", name, what)
+	}
+	hasIso := ivl.LabelId == "VOL"
+	if !hasIso && (field == "isoname" || field == "side" || field == "interleave") {
+		return fmt.Errorf("%s is in the ISO volume label, and there is none", name)
+	}
+	switch field {
+	case "name", "isoname":
+		max := 10
+		if field == "isoname" {
+			max = 6
+		}
+		if len(value) > max || !isPrintable(value) {
+			return fmt.Errorf("%s must be up to %d printable characters, got %q", name, max, value)
+		}
+		if field == "name" {
+			vl.Name = value
+		}
+		ivl.Name = value[:min(len(value), 6)]
+	case "fill":
+		n, err := labelNumber(name, value, 255)
+		if err != nil {
+			return err
+		}
+		vl.Fill = uint8(n)
+	case "side":
+		ivl.Side, err = labelNumber(name, value, 2)
+	case "interleave":
+		n, err := labelNumber(name, value, 99)
+		if err != nil {
+			return err
+		}
+		if n != ivl.Interleave && !force {
+			files, err := r.holdsFiles()
+			if err != nil {
+				return err
+			}
+			if files {
+				return fmt.Errorf("the volume holds files laid out with interleave %d, use --force to change it", ivl.Interleave)
+			}
+		}
+		ivl.Interleave = n
+	default:
+		return fmt.Errorf("unknown label field %q", name)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = vl.Update()
+	if err != nil {
+		return err
+	}
+	// the ISO label is only written if there is one
+	if hasIso {
+		err = ivl.Update()
+		if err != nil {
+			return err
+		}
+	}
+	r.logger.Debug("changed volume label", "field", field, "value", value)
+	return nil
+}
+
+// holdsFiles returns true if any FNode other than the system FNodes and the root
+// directory is allocated.
+func (r *RMXImage) holdsFiles() (bool, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return false, err
+	}
+	fm, err := r.GetFNodeMap()
+	if err != nil {
+		return false, err
+	}
+	for i := 6; i < fm.GetNumBits(); i++ {
+		if i != int(vl.RootFnode) && fm.IsAlloc(i) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,254 @@
+package rmximage
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Field is a field of an on-disk structure, giving where its bytes are so that
+// they can be shown next to its value.
+type Field struct {
+	Name   string
+	Offset int
+	Length int  // 1 to 4 bytes hold a little endian number
+	Text   bool // the bytes hold characters
+}
+
+// IsoLabelFields are the fields of the ISO volume label that are decoded.
+var IsoLabelFields = []Field{
+	{"LabelId", 0, 3, true},
+	{"Name", 4, 6, true},
+	{"Struc", 10, 1, true},
+	{"Side", 71, 1, true},
+	{"Interleave", 76, 2, true},
+	{"IsoVersion", 79, 1, true},
+}
+
+// RmxLabelFields are the fields of the RMX volume label.
+var RmxLabelFields = []Field{
+	{"Name", 0, 10, true},
+	{"Fill", 10, 1, false},
+	{"Driver", 11, 1, false},
+	{"Granularity", 12, 2, false},
+	{"Size", 14, 4, false},
+	{"Max Fnode", 18, 2, false},
+	{"Fnode Start", 20, 4, false},
+	{"Fnode Size", 24, 2, false},
+	{"Root Fnode", 26, 2, false},
+}
+
+// FNodeFields are the fields of an fnode.
+var FNodeFields = fnodeFields()
+
+func fnodeFields() []Field {
+	fields := []Field{
+		{"Flags", 0, 2, false},
+		{"FType", 2, 1, false},
+		{"Gran", 3, 1, false},
+		{"Owner", 4, 2, false},
+		{"CreateTime", 6, 4, false},
+		{"AccessTime", 10, 4, false},
+		{"ModifyTime", 14, 4, false},
+		{"TotalSize", 18, 4, false},
+		{"TotalBlocks", 22, 4, false},
+	}
+	for i := 0; i < NumPointers; i++ {
+		fields = append(fields,
+			Field{fmt.Sprintf("Pointer[%d].NumBlocks", i), 26 + i*5, 2, false},
+			Field{fmt.Sprintf("Pointer[%d].BlockPointer", i), 28 + i*5, 3, false})
+	}
+	fields = append(fields,
+		Field{"ThisSize", 66, 4, false},
+		Field{"ReservedA", 70, 2, false},
+		Field{"ReservedB", 72, 2, false},
+		Field{"IDCount", 74, 2, false})
+	for i := 0; i < 3; i++ {
+		fields = append(fields,
+			Field{fmt.Sprintf("Accessor[%d].Access", i), 76 + i*3, 1, false},
+			Field{fmt.Sprintf("Accessor[%d].Id", i), 77 + i*3, 2, false})
+	}
+	return append(fields, Field{"Parent", 85, 2, false})
+}
+
+// Value returns the value of the field in data, which holds the whole structure.
+func (f Field) Value(data []byte) string {
+	if f.Offset+f.Length > len(data) {
+		return "(missing)"
+	}
+	b := data[f.Offset : f.Offset+f.Length]
+	if f.Text {
+		return fmt.Sprintf("%q", getStr(b))
+	}
+	value := 0
+	for i := len(b) - 1; i >= 0; i-- {
+		value = value<<8 | int(b[i])
+	}
+	return fmt.Sprintf("%d", value)
+}
+
+// RawIsoLabel returns the bytes of the ISO volume label.
+func (r *RMXImage) RawIsoLabel() ([]byte, error) {
+	return r.readRange(isoLabelOffset, labelsEnd)
+}
+
+// RawRmxLabel returns the bytes of the RMX volume label.
+func (r *RMXImage) RawRmxLabel() ([]byte, error) {
+	return r.readRange(rmxLabelOffset, rmxLabelOffset+128)
+}
+
+// RawFNode returns the bytes of fnode n, as stored in the fnode file. Changes
+// that have not been flushed are not included.
+func (r *RMXImage) RawFNode(n int) ([]byte, error) {
+	err := r.checkFNodeIndex(n)
+	if err != nil {
+		return nil, err
+	}
+	offset, end := r.fnodeRange(n)
+	return r.readRange(offset, end)
+}
+
+// IndirectEntry is an entry of an indirect block of a long file, naming a run
+// of data blocks.
+type IndirectEntry struct {
+	Block        int // the indirect block holding the entry
+	Offset       int // the byte offset of the entry in the indirect block
+	NumBlocks    int
+	BlockPointer int
+	Raw          []byte
+}
+
+// IndirectEntries returns the entries of the indirect blocks of a long file
+// that are not empty.
+func (r *RMXImage) IndirectEntries(fnode *FNode) ([]IndirectEntry, error) {
+	if !fnode.IsLong() {
+		return nil, fmt.Errorf("FNode %d is not a long file", fnode.Number)
+	}
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	gran := int(vl.Gran) * int(fnode.Gran)
+	entries := []IndirectEntry{}
+	for _, pointer := range fnode.Pointers {
+		if pointer.NumBlocks == 0 {
+			continue
+		}
+		start := int(pointer.BlockPointer) * int(vl.Gran)
+		if start+gran > r.size {
+			return entries, r.fnodeCorrupt(fnode.Number, "indirect block %d lies beyond the end of the volume", pointer.BlockPointer)
+		}
+		data, err := r.readRange(start, start+gran)
+		if err != nil {
+			return entries, err
+		}
+		for _, entry := range decodeIndirect(data) {
+			entry.Block = int(pointer.BlockPointer)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// decodeIndirect returns the entries of an indirect block that are not empty.
+// Each entry is 4 bytes: the number of blocks in the run, followed by the
+// 24-bit number of its first block. Block is left for the caller to set.
+func decodeIndirect(data []byte) []IndirectEntry {
+	entries := []IndirectEntry{}
+	for offset := 0; offset+4 <= len(data); offset += 4 {
+		if data[offset] == 0 {
+			continue
+		}
+		entries = append(entries, IndirectEntry{
+			Offset:       offset,
+			NumBlocks:    int(data[offset]),
+			BlockPointer: int(data[offset+1]) | int(data[offset+2])<<8 | int(data[offset+3])<<16,
+			Raw:          data[offset : offset+4],
+		})
+	}
+	return entries
+}
+
+// FlagNames are the names of the fnode flags, as Print shows them.
+var FlagNames = map[string]uint16{
+	"ALLOC":      Allocated,
+	"LONG":       LongFile,
+	"PRIMARY":    Primary,
+	"UNMODIFIED": Unmodified,
+	"NODELETE":   NoDelete,
+}
+
+// parseFlags returns the flags that value gives. It is a number, or names from
+// FlagNames separated by '|', which replace the flags, or names each preceded
+// by '+' or '-', which set or clear them.
+func parseFlags(flags uint16, value string) (uint16, error) {
+	if n, err := strconv.ParseUint(value, 0, 16); err == nil {
+		return uint16(n), nil
+	}
+	relative := strings.HasPrefix(value, "+") || strings.HasPrefix(value, "-")
+	if !relative {
+		flags = 0
+	}
+	for _, name := range strings.FieldsFunc(value, func(c rune) bool { return c == '|' || c == ',' }) {
+		op := byte('|')
+		if relative {
+			op, name = name[0], name[1:]
+			if op != '+' && op != '-' {
+				return 0, fmt.Errorf("flag %q must be preceded by + or -", name)
+			}
+		}
+		flag, ok := FlagNames[strings.ToUpper(name)]
+		if !ok {
+			return 0, fmt.Errorf("unknown flag %q", name)
+		}
+		if op == '-' {
+			flags &^= flag
+		} else {
+			flags |= flag
+		}
+	}
+	return flags, nil
+}
+
+// SetField sets a field of the fnode, named as in FNodeFields, from a number.
+// Flags may also be given by name, as parseFlags describes, and FType by the
+// name of the type. The fnode is changed only in memory.
+func (f *FNode) SetField(name string, value string) error {
+	var field *Field
+	for i := range FNodeFields {
+		if strings.EqualFold(FNodeFields[i].Name, name) {
+			field = &FNodeFields[i]
+		}
+	}
+	if field == nil {
+		return fmt.Errorf("unknown FNode field %q", name)
+	}
+
+	var n uint64
+	var err error
+	switch {
+	case field.Name == "Flags":
+		var flags uint16
+		flags, err = parseFlags(f.Flags, value)
+		n = uint64(flags)
+	case field.Name == "FType":
+		n, err = strconv.ParseUint(value, 0, 8)
+		for t, typeName := range TypeNames {
+			if strings.EqualFold(typeName, value) {
+				n, err = uint64(t), nil
+			}
+		}
+	default:
+		n, err = strconv.ParseUint(value, 0, field.Length*8)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q for %s: %w", value, field.Name, err)
+	}
+
+	data := make([]byte, minFnodeSize)
+	f.Serialize(data)
+	for i := 0; i < field.Length; i++ {
+		data[field.Offset+i] = byte(n >> (8 * i))
+	}
+	return f.Deserialize(data)
+}
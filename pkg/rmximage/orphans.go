@@ -0,0 +1,243 @@
+package rmximage
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+)
+
+// LostFoundName is the directory in the root that orphans are reattached to
+// when their recorded parent is gone.
+const LostFoundName = "LOST+FOUND"
+
+// Reattachment records where ReattachOrphans linked an orphaned fnode.
+type Reattachment struct {
+	FNode *FNode
+	Dir   *FNode
+	Path  string // the path the fnode now has
+}
+
+// reach adds fnodeNumber to paths, and if it is a directory everything in it.
+// Fnodes that cannot be read are left out.
+func (r *RMXImage) reach(fnodeNumber int, pathName string, paths map[int]string) {
+	if _, seen := paths[fnodeNumber]; seen {
+		return
+	}
+	fnode, err := r.GetFNode(fnodeNumber)
+	if err != nil {
+		return
+	}
+	paths[fnodeNumber] = pathName
+	if !fnode.IsDirectory() {
+		return
+	}
+	dirList, err := r.GetDirectory(fnode)
+	if err != nil {
+		return
+	}
+	for _, entry := range dirList.Entries {
+		if entry.FNode != 0 {
+			r.reach(int(entry.FNode), path.Join(pathName, entry.Name), paths)
+		}
+	}
+}
+
+// reachable returns the path of every fnode that can be reached from the root
+// directory. The system fnodes are always reachable.
+func (r *RMXImage) reachable() (map[int]string, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	paths := map[int]string{}
+	r.reach(int(vl.RootFnode), "/", paths)
+	for _, n := range []int{0, 1, 2, 3, 4, 5} {
+		if _, ok := paths[n]; !ok {
+			paths[n] = ""
+		}
+	}
+	return paths, nil
+}
+
+// SkippedFNode is an fnode that can be reached from the root directory but that
+// the reports on the blocks of the volume leave out.
+type SkippedFNode struct {
+	FNode  int
+	Path   string // empty for the system fnodes that are not in a directory
+	Reason string
+}
+
+// readableFNodes returns, in order of number, the allocated fnodes that can be
+// reached from the root directory and whose blocks can be followed, with
+// AllDataBlocks and AllIndirectBlocks filled in. It also returns the path of
+// every reachable fnode, and the reachable fnodes it left out. BlockMap,
+// BlockIndex, Stats and Scrub all walk the volume through it, so that they
+// agree on which fnodes they leave out.
+func (r *RMXImage) readableFNodes() ([]*FNode, map[int]string, []SkippedFNode, error) {
+	paths, err := r.reachable()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	numbers := []int{}
+	for n := range paths {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+
+	fnodes := []*FNode{}
+	skipped := []SkippedFNode{}
+	for _, n := range numbers {
+		fnode, err := r.GetFNode(n)
+		if err == nil && !fnode.IsAllocated() {
+			err = errors.New("FNode is not allocated")
+		}
+		if err == nil {
+			_, err = r.ReadFile(fnode)
+		}
+		if err != nil {
+			r.logger.Debug("leaving out FNode", "fnode", n, "error", err)
+			skipped = append(skipped, SkippedFNode{FNode: n, Path: paths[n], Reason: err.Error()})
+			continue
+		}
+		fnodes = append(fnodes, fnode)
+	}
+	return fnodes, paths, skipped, nil
+}
+
+// Orphans returns the fnodes that are allocated, both in the FNodeMap and in
+// their own flags, but that cannot be reached from the root directory.
+func (r *RMXImage) Orphans() ([]*FNode, error) {
+	paths, err := r.reachable()
+	if err != nil {
+		return nil, err
+	}
+	fnodeMap, err := r.GetFNodeMap()
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := []*FNode{}
+	for i := 0; i < fnodeMap.GetNumBits(); i++ {
+		if _, ok := paths[i]; ok || !fnodeMap.IsAlloc(i) {
+			continue
+		}
+		fnode, err := r.GetFNode(i)
+		if err != nil || !fnode.IsAllocated() {
+			continue
+		}
+		orphans = append(orphans, fnode)
+	}
+	return orphans, nil
+}
+
+// ReattachOrphans links every orphan into the directory its Parent field names,
+// if that is a directory that can still be reached, or else into /LOST+FOUND,
+// which is created if needed. Orphans are given generated names, as their own
+// names were in the directory entry that was lost. Orphans inside an orphaned
+// directory come back with it and are not linked separately.
+func (r *RMXImage) ReattachOrphans() ([]Reattachment, error) {
+	orphans, err := r.Orphans()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := r.reachable()
+	if err != nil {
+		return nil, err
+	}
+
+	// reattach the orphans that no orphaned directory holds first, so that
+	// their contents come back with them
+	held := map[int]string{}
+	for _, orphan := range orphans {
+		if orphan.IsDirectory() {
+			below := map[int]string{}
+			r.reach(orphan.Number, "", below)
+			for n := range below {
+				if n != orphan.Number {
+					held[n] = ""
+				}
+			}
+		}
+	}
+	sort.SliceStable(orphans, func(i, j int) bool {
+		_, iHeld := held[orphans[i].Number]
+		_, jHeld := held[orphans[j].Number]
+		return !iHeld && jHeld
+	})
+
+	reattached := []Reattachment{}
+	for _, orphan := range orphans {
+		if _, ok := paths[orphan.Number]; ok {
+			continue // came back inside a directory reattached earlier
+		}
+
+		dir, dirPath, err := r.orphanDir(orphan, paths)
+		if err != nil {
+			return reattached, err
+		}
+		dirList, err := r.GetDirectory(dir)
+		if err != nil {
+			return reattached, err
+		}
+		name := fmt.Sprintf("FNODE%d", orphan.Number)
+		for i := 1; ; i++ {
+			if _, err := dirList.Find(name); err != nil {
+				break
+			}
+			name = fmt.Sprintf("FNODE%d.%d", orphan.Number, i)
+		}
+
+		_, err = dirList.AddEntry(orphan.Number, name)
+		if err != nil {
+			return reattached, err
+		}
+		err = dirList.Update()
+		if err != nil {
+			return reattached, err
+		}
+		orphan.Parent = uint16(dir.Number)
+		orphan.Name = name
+		orphan.Directory = dirList
+		err = orphan.Update()
+		if err != nil {
+			return reattached, err
+		}
+
+		orphanPath := path.Join(dirPath, name)
+		r.logger.Debug("reattached FNode", "fnode", orphan.Number, "path", orphanPath)
+		reattached = append(reattached, Reattachment{FNode: orphan, Dir: dir, Path: orphanPath})
+		r.reach(orphan.Number, orphanPath, paths)
+	}
+	return reattached, nil
+}
+
+// orphanDir returns the directory an orphan is to be linked into, and its path.
+func (r *RMXImage) orphanDir(orphan *FNode, paths map[int]string) (*FNode, string, error) {
+	parent := int(orphan.Parent)
+	if dirPath, ok := paths[parent]; ok && dirPath != "" && parent != orphan.Number {
+		dir, err := r.GetFNode(parent)
+		if err == nil && dir.IsAllocated() && dir.IsDirectory() {
+			return dir, dirPath, nil
+		}
+	}
+
+	root, err := r.GetRootDirectory()
+	if err != nil {
+		return nil, "", err
+	}
+	dir, err := r.Lookup(root, LostFoundName)
+	if errors.Is(err, ErrNotFound) {
+		dir, err = r.Mkdir(root, LostFoundName)
+		if err == nil {
+			paths[dir.Number] = "/" + LostFoundName
+		}
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if !dir.IsDirectory() {
+		return nil, "", fmt.Errorf("/%s %w", LostFoundName, ErrNotDirectory)
+	}
+	return dir, "/" + LostFoundName, nil
+}
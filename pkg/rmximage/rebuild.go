@@ -0,0 +1,180 @@
+package rmximage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// rootNames are the names the format utility gives the system fnodes in the
+// root directory.
+var rootNames = map[int]string{
+	1: "R?SPACEMAP",
+	2: "R?FNODEMAP",
+	4: "R?BADBLOCKMAP",
+	5: "R?VOLUMELABEL",
+}
+
+// RebuiltEntry is an entry of a directory written by RebuildDirectory.
+type RebuiltEntry struct {
+	DirEntry
+	Recovered bool // the name was found in what was left of the old directory
+}
+
+// leftoverNames returns the names that the blocks of a damaged directory still
+// hold, by fnode. Only slots whose name is plausible are used.
+func (r *RMXImage) leftoverNames(dir *FNode) map[int]string {
+	names := map[int]string{}
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return names
+	}
+	gran := int(vl.Gran)
+	for _, blk := range r.dataBlocks(dir, gran) {
+		start := blk * gran
+		if start+gran > r.size {
+			continue
+		}
+		data, err := r.readRange(start, start+gran)
+		if err != nil {
+			continue
+		}
+		for offset := 0; offset+16 <= len(data); offset += 16 {
+			fnodeNumber := int(binary.LittleEndian.Uint16(data[offset : offset+2]))
+			name := getStr(data[offset+2 : offset+16])
+			if fnodeNumber == 0 || name == "" || !isPrintable(name) {
+				continue
+			}
+			if _, ok := names[fnodeNumber]; !ok {
+				names[fnodeNumber] = name
+			}
+		}
+	}
+	return names
+}
+
+// dataBlocks returns the data blocks an fnode points to, following the indirect
+// blocks of a long file as far as TotalBlocks says. Unlike SalvageFile it does
+// not read the data, and skips the indirect blocks it cannot read.
+func (r *RMXImage) dataBlocks(fnode *FNode, gran int) []int {
+	blocks := []int{}
+	add := func(numBlocks int, blockPointer int) {
+		for i := 0; i < numBlocks; i++ {
+			blocks = append(blocks, blockPointer+i)
+		}
+	}
+	if !fnode.IsLong() {
+		for _, pointer := range fnode.Pointers {
+			add(int(pointer.NumBlocks), int(pointer.BlockPointer))
+		}
+		return blocks
+	}
+	remaining := int(fnode.TotalBlocks)
+	for _, pointer := range fnode.Pointers {
+		if pointer.NumBlocks == 0 {
+			continue
+		}
+		remaining-- // the indirect block itself
+		start := int(pointer.BlockPointer) * gran
+		blockfile, err := r.readRange(start, start+gran*int(fnode.Gran))
+		if err != nil {
+			continue
+		}
+		for _, entry := range decodeIndirect(blockfile) {
+			if remaining <= 0 {
+				break
+			}
+			add(entry.NumBlocks, entry.BlockPointer)
+			remaining -= entry.NumBlocks
+		}
+	}
+	return blocks
+}
+
+// isDirectory returns true if fnodeNumber is an allocated directory.
+func (r *RMXImage) isDirectory(fnodeNumber int) bool {
+	fnode, err := r.GetFNode(fnodeNumber)
+	return err == nil && fnode.IsAllocated() && fnode.IsDirectory()
+}
+
+// RebuildDirectory writes a new directory file for dir, listing every allocated
+// fnode whose Parent field names dir, and those the old directory still lists
+// whose Parent is not a directory. The names are taken from the slots left
+// in the old directory blocks where possible, and generated otherwise. The old
+// blocks of the directory are freed if its pointers can still be followed.
+func (r *RMXImage) RebuildDirectory(dir *FNode) ([]RebuiltEntry, error) {
+	if !dir.IsDirectory() {
+		return nil, fmt.Errorf("FNode %d %w", dir.Number, ErrNotDirectory)
+	}
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	fnodeMap, err := r.GetFNodeMap()
+	if err != nil {
+		return nil, err
+	}
+
+	leftover := r.leftoverNames(dir)
+	entries := []RebuiltEntry{}
+	taken := map[string]bool{}
+	for i := 0; i < int(vl.MaxFnode); i++ {
+		// FNodes 0 and 3 record the root as their parent, but are not listed in it
+		if i == dir.Number || i == 0 || i == 3 || !fnodeMap.IsAlloc(i) {
+			continue
+		}
+		fnode, err := r.GetFNode(i)
+		if err != nil || !fnode.IsAllocated() {
+			continue
+		}
+		name, recovered := leftover[i]
+		// an fnode the old directory still lists is kept if its Parent does not
+		// name another directory, as older tools left Parent at 0
+		if int(fnode.Parent) != dir.Number && (!recovered || r.isDirectory(int(fnode.Parent))) {
+			continue
+		}
+
+		entry := RebuiltEntry{DirEntry: DirEntry{FNode: uint16(i)}}
+		if !recovered && dir.Number == int(vl.RootFnode) {
+			name = rootNames[i]
+		}
+		if name == "" || taken[strings.ToUpper(name)] {
+			name = fmt.Sprintf("FNODE%d", i)
+			recovered = false
+		}
+		entry.Name = name
+		entry.Recovered = recovered
+		taken[strings.ToUpper(name)] = true
+		entries = append(entries, entry)
+	}
+
+	newDir := &Directory{}
+	for _, entry := range entries {
+		newDir.Entries = append(newDir.Entries, entry.DirEntry)
+	}
+	data := make([]byte, 16*len(newDir.Entries))
+	newDir.Serialize(data)
+
+	// free the old blocks if they can be found, otherwise leave them for chkdsk
+	err = r.TruncateFNode(dir)
+	if err != nil {
+		r.logger.Debug("cannot free the old blocks of the directory", "fnode", dir.Number, "error", err)
+		for i := range dir.Pointers {
+			dir.Pointers[i] = Pointer{}
+		}
+		dir.TotalSize, dir.ThisSize, dir.TotalBlocks = 0, 0, 0
+	}
+	dir.Flags &^= LongFile
+	dir.AllDataBlocks, dir.AllIndirectBlocks = nil, nil
+
+	if len(data) > 0 {
+		err = r.PutData(dir, data, false)
+	} else {
+		err = dir.Update()
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.logger.Debug("rebuilt directory", "fnode", dir.Number, "entries", len(entries))
+	return entries, nil
+}
@@ -3,8 +3,13 @@ package rmximage
 import (
 	"encoding/binary"
 	"fmt"
-	"github.com/sbelectronics/rmxtool/pkg/imd"
+	"github.com/sbelectronics/rmxtool/pkg/container"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"io"
+	"log/slog"
+	"math"
 	"os"
+	"sort"
 	"strings"
 )
 
@@ -36,10 +41,27 @@ const (
 )
 
 type RMXImage struct {
-	contents []byte
-	byteSwap bool
-	fileName string
-	im       *imd.ImageDisk // if the image is loaded from an IMD file, this will be set
+	size            int // size of the volume in bytes
+	byteSwap        bool
+	detectByteOrder bool // if set, Load swaps the bytes of images whose labels only make sense swapped
+	swapDetected    bool // the bytes were swapped because of detection rather than by request
+	fileName        string
+	offset          int // offset of the volume within the image, in bytes
+	partition       int // if nonzero, the volume to use among those found by ScanVolumes, counting from 1
+	container       container.Container
+	format          string             // container format to use instead of detecting it
+	geometry        *geometry.Geometry // if set, maps logical blocks onto physical sectors
+	logger          *slog.Logger       // debug and progress events go here, never nil
+	scrub           bool               // if set, freed blocks and the names of deleted entries are zeroed
+
+	// metadata read from the volume, kept until the image is loaded again.
+	// Changes to them are written to the container by Flush.
+	label       *RmxVolumeLabel
+	labelDirty  bool
+	fnodes      map[int]*FNode
+	dirtyFnodes map[int]bool
+	volMap      *Bitmap
+	fnodeMap    *Bitmap
 }
 
 type IsoVolumeLabel struct {
@@ -53,7 +75,8 @@ type IsoVolumeLabel struct {
 	Interleave int // offset 72+4 = 76
 	// reserved - offset 78
 	IsoVersion int // offset 79
-	slice      []byte
+
+	Image *RMXImage // reference to the RMXImage this label belongs to, set by GetIsoVolumeLabel()
 }
 
 var TypeNames = map[int]string{
@@ -117,19 +140,22 @@ func accessStr(access int) string {
 	return astr
 }
 
-func (v *IsoVolumeLabel) Deserialize(data []byte) {
+func (v *IsoVolumeLabel) Deserialize(data []byte) error {
+	if len(data) < 80 {
+		return fmt.Errorf("ISO volume label needs 80 bytes, got %d", len(data))
+	}
 	v.LabelId = getStr(data[0:3])
 	v.Name = getStr(data[4:10])
 	v.Struc = string(data[10])
 	v.Side = int(data[71]) - '0'
 	v.Interleave = (int(data[76]-'0') * 10) + int(data[77]-'0')
 	v.IsoVersion = int(data[79] - '0')
-	v.slice = data
+	return nil
 }
 
 func (v *IsoVolumeLabel) Serialize(data []byte) {
 	copy(data[0:3], v.LabelId)
-	copy(data[4:10], v.Name)
+	putStr(data[4:10], v.Name, 6)
 	data[10] = v.Struc[0]
 	data[71] = byte(v.Side + '0')
 	data[76] = byte((v.Interleave / 10) + '0')
@@ -137,17 +163,20 @@ func (v *IsoVolumeLabel) Serialize(data []byte) {
 	data[79] = byte(v.IsoVersion + '0')
 }
 
-func (v *IsoVolumeLabel) Update() {
-	v.Serialize(v.slice)
+func (v *IsoVolumeLabel) Update() error {
+	if v.Image == nil {
+		return fmt.Errorf("ISO Volume Label does not have an associated RMXImage")
+	}
+	return v.Image.PutIsoVolumeLabel(v)
 }
 
-func (v *IsoVolumeLabel) Print() {
-	fmt.Printf("LabelId: %s\n", v.LabelId)
-	fmt.Printf("Name: %s\n", v.Name)
-	fmt.Printf("Struc: %s\n", v.Struc)
-	fmt.Printf("Side: %d\n", v.Side)
-	fmt.Printf("Interleave: %d\n", v.Interleave)
-	fmt.Printf("IsoVersion: %d\n", v.IsoVersion)
+func (v *IsoVolumeLabel) Print(w io.Writer) {
+	fmt.Fprintf(w, "LabelId: %s\n", v.LabelId)
+	fmt.Fprintf(w, "Name: %s\n", v.Name)
+	fmt.Fprintf(w, "Struc: %s\n", v.Struc)
+	fmt.Fprintf(w, "Side: %d\n", v.Side)
+	fmt.Fprintf(w, "Interleave: %d\n", v.Interleave)
+	fmt.Fprintf(w, "IsoVersion: %d\n", v.IsoVersion)
 }
 
 type RmxVolumeLabel struct {
@@ -164,7 +193,10 @@ type RmxVolumeLabel struct {
 	Image *RMXImage // reference to the RMXImage this FNode belongs to, set by GetFNode()
 }
 
-func (v *RmxVolumeLabel) Deserialize(data []byte) {
+func (v *RmxVolumeLabel) Deserialize(data []byte) error {
+	if len(data) < 28 {
+		return fmt.Errorf("volume label needs 28 bytes, got %d", len(data))
+	}
 	v.Name = getStr(data[0:10])
 	v.Fill = data[10]
 	v.Driver = data[11]
@@ -174,6 +206,7 @@ func (v *RmxVolumeLabel) Deserialize(data []byte) {
 	v.FnodeStart = binary.LittleEndian.Uint32(data[20:24])
 	v.FnodeSize = binary.LittleEndian.Uint16(data[24:26])
 	v.RootFnode = binary.LittleEndian.Uint16(data[26:28])
+	return nil
 }
 
 func (v *RmxVolumeLabel) Serialize(data []byte) {
@@ -188,16 +221,16 @@ func (v *RmxVolumeLabel) Serialize(data []byte) {
 	binary.LittleEndian.PutUint16(data[26:28], v.RootFnode)
 }
 
-func (v *RmxVolumeLabel) Print() {
-	fmt.Printf("Name: %s\n", v.Name)
-	fmt.Printf("Fill: %d\n", v.Fill)
-	fmt.Printf("Driver: %d\n", v.Driver)
-	fmt.Printf("Granularity: %d\n", v.Gran)
-	fmt.Printf("Size: %d\n", v.Size)
-	fmt.Printf("Max Fnode: %d\n", v.MaxFnode)
-	fmt.Printf("Fnode Start: %d\n", v.FnodeStart)
-	fmt.Printf("Fnode Size: %d\n", v.FnodeSize)
-	fmt.Printf("Root Fnode: %d\n", v.RootFnode)
+func (v *RmxVolumeLabel) Print(w io.Writer) {
+	fmt.Fprintf(w, "Name: %s\n", v.Name)
+	fmt.Fprintf(w, "Fill: %d\n", v.Fill)
+	fmt.Fprintf(w, "Driver: %d\n", v.Driver)
+	fmt.Fprintf(w, "Granularity: %d\n", v.Gran)
+	fmt.Fprintf(w, "Size: %d\n", v.Size)
+	fmt.Fprintf(w, "Max Fnode: %d\n", v.MaxFnode)
+	fmt.Fprintf(w, "Fnode Start: %d\n", v.FnodeStart)
+	fmt.Fprintf(w, "Fnode Size: %d\n", v.FnodeSize)
+	fmt.Fprintf(w, "Root Fnode: %d\n", v.RootFnode)
 }
 
 func (v *RmxVolumeLabel) Update() error {
@@ -240,7 +273,10 @@ type FNode struct {
 	AllIndirectBlocks []int
 }
 
-func (f *FNode) Deserialize(data []byte) {
+func (f *FNode) Deserialize(data []byte) error {
+	if len(data) < minFnodeSize {
+		return fmt.Errorf("FNode needs %d bytes, got %d", minFnodeSize, len(data))
+	}
 	f.Flags = binary.LittleEndian.Uint16(data[0:2])
 	f.FType = data[2]
 	f.Gran = data[3]
@@ -263,6 +299,7 @@ func (f *FNode) Deserialize(data []byte) {
 		f.Accessor[i].Id = binary.LittleEndian.Uint16(data[77+i*3 : 79+i*3])
 	}
 	f.Parent = binary.LittleEndian.Uint16(data[85:87])
+	return nil
 }
 
 func (f *FNode) Serialize(data []byte) {
@@ -292,42 +329,42 @@ func (f *FNode) Serialize(data []byte) {
 	binary.LittleEndian.PutUint16(data[85:87], f.Parent)
 }
 
-func (f *FNode) Print() {
-	fmt.Printf("Flags: %d", f.Flags)
+func (f *FNode) Print(w io.Writer) {
+	fmt.Fprintf(w, "Flags: %d", f.Flags)
 	if f.IsAllocated() {
-		fmt.Print(" ALLOC")
+		fmt.Fprint(w, " ALLOC")
 	}
 	if f.IsLong() {
-		fmt.Print(" LONG")
+		fmt.Fprint(w, " LONG")
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 
-	fmt.Printf("FType: %d", f.FType)
+	fmt.Fprintf(w, "FType: %d", f.FType)
 	typeName, ok := TypeNames[int(f.FType)]
 	if ok {
-		fmt.Printf(" (%s)\n", typeName)
+		fmt.Fprintf(w, " (%s)\n", typeName)
 	} else {
-		fmt.Printf(" (Unknown Type %d)\n", f.FType)
+		fmt.Fprintf(w, " (Unknown Type %d)\n", f.FType)
 	}
 
-	fmt.Printf("Gran: %d\n", f.Gran)
-	fmt.Printf("Owner: %d\n", f.Owner)
-	fmt.Printf("CreateTime: %d\n", f.CreateTime)
-	fmt.Printf("AccessTime: %d\n", f.AccessTime)
-	fmt.Printf("ModifyTime: %d\n", f.ModifyTime)
-	fmt.Printf("TotalSize: %d\n", f.TotalSize)
-	fmt.Printf("TotalBlocks: %d\n", f.TotalBlocks)
+	fmt.Fprintf(w, "Gran: %d\n", f.Gran)
+	fmt.Fprintf(w, "Owner: %d\n", f.Owner)
+	fmt.Fprintf(w, "CreateTime: %d\n", f.CreateTime)
+	fmt.Fprintf(w, "AccessTime: %d\n", f.AccessTime)
+	fmt.Fprintf(w, "ModifyTime: %d\n", f.ModifyTime)
+	fmt.Fprintf(w, "TotalSize: %d\n", f.TotalSize)
+	fmt.Fprintf(w, "TotalBlocks: %d\n", f.TotalBlocks)
 	for i, p := range f.Pointers {
-		fmt.Printf("Pointer[%d]: NumBlocks=%d, BlockPointer=%d\n", i, p.NumBlocks, p.BlockPointer)
+		fmt.Fprintf(w, "Pointer[%d]: NumBlocks=%d, BlockPointer=%d\n", i, p.NumBlocks, p.BlockPointer)
 	}
-	fmt.Printf("ThisSize: %d\n", f.ThisSize)
-	fmt.Printf("ReservedA: %d\n", f.ReservedA)
-	fmt.Printf("ReservedB: %d\n", f.ReservedB)
-	fmt.Printf("IDCount: %d\n", f.IDCount)
+	fmt.Fprintf(w, "ThisSize: %d\n", f.ThisSize)
+	fmt.Fprintf(w, "ReservedA: %d\n", f.ReservedA)
+	fmt.Fprintf(w, "ReservedB: %d\n", f.ReservedB)
+	fmt.Fprintf(w, "IDCount: %d\n", f.IDCount)
 	for i, acc := range f.Accessor {
-		fmt.Printf("Accessor[%d]: Access=%d, Id=%d\n", i, acc.Access, acc.Id)
+		fmt.Fprintf(w, "Accessor[%d]: Access=%d, Id=%d\n", i, acc.Access, acc.Id)
 	}
-	fmt.Printf("Parent: %d\n", f.Parent)
+	fmt.Fprintf(w, "Parent: %d\n", f.Parent)
 }
 
 func (f *FNode) IsAllocated() bool {
@@ -390,12 +427,17 @@ func (f *FNode) UpdateDataInPlace(data []byte) error {
 	}
 	index := 0
 	for len(data) > 0 {
+		if index >= len(f.AllDataBlocks) {
+			return fmt.Errorf("data does not fit in the %d blocks of FNode %d", len(f.AllDataBlocks), f.Number)
+		}
 		blkSize := min(len(data), int(vl.Gran))
 		blk := data[:blkSize]
 		blkNum := f.AllDataBlocks[index]
 		start := blkNum * int(vl.Gran)
-		end := start + blkSize
-		copy(f.Image.contents[start:end], blk)
+		err := f.Image.writeRange(start, blk)
+		if err != nil {
+			return err
+		}
 
 		data = data[blkSize:]
 		index += 1
@@ -409,7 +451,7 @@ func (f *FNode) GetFreePointer() (int, error) {
 			return i, nil
 		}
 	}
-	return 0, fmt.Errorf("no free pointer available in FNode")
+	return 0, fmt.Errorf("FNode %d has no free pointer: %w", f.Number, ErrTooManyExtents)
 }
 
 func (f *FNode) Expand() error {
@@ -431,6 +473,7 @@ func (f *FNode) Expand() error {
 		return err
 	}
 
+	f.Image.logger.Debug("expanding FNode", "fnode", f.Number, "block", freeBlock)
 	volMap.SetAlloc(freeBlock, true)
 	err = volMap.Update()
 	if err != nil {
@@ -483,7 +526,10 @@ type Directory struct {
 	fnode   *FNode // the FNode this Directory belongs to, set by GetDirectory()
 }
 
-func (d *Directory) Deserialize(data []byte, length int) {
+func (d *Directory) Deserialize(data []byte, length int) error {
+	if length < 0 || length > len(data) {
+		return fmt.Errorf("directory of %d bytes holds only %d", length, len(data))
+	}
 	d.Entries = []DirEntry{}
 	offset := 0
 	for length >= 16 {
@@ -494,6 +540,7 @@ func (d *Directory) Deserialize(data []byte, length int) {
 		length -= 16
 		d.Entries = append(d.Entries, entry)
 	}
+	return nil
 }
 
 func (d *Directory) Serialize(data []byte) {
@@ -511,70 +558,70 @@ func (d *Directory) Serialize(data []byte) {
 	}
 }
 
-func (d *Directory) Print() {
+func (d *Directory) Print(w io.Writer) {
 	for _, entry := range d.Entries {
 		if entry.FNode != 0 {
-			fmt.Printf("%-15s %8d\n", entry.Name, entry.FNode)
+			fmt.Fprintf(w, "%-15s %8d\n", entry.Name, entry.FNode)
 		}
 	}
 }
 
-func (d *Directory) PrintLong() {
-	fmt.Printf("%-15s %8s %8s %-12s %s %s\n", "Name", "FNode", "Size", " Type", "Flags", " Accessors")
-	fmt.Printf("%-15s %8s %8s %-12s %s %s\n", "----", "-----", "----", " ----", "-----", " ---------")
+func (d *Directory) PrintLong(w io.Writer) {
+	fmt.Fprintf(w, "%-15s %8s %8s %-12s %s %s\n", "Name", "FNode", "Size", " Type", "Flags", " Accessors")
+	fmt.Fprintf(w, "%-15s %8s %8s %-12s %s %s\n", "----", "-----", "----", " ----", "-----", " ---------")
 	for _, entry := range d.Entries {
 		if entry.FNode == 0 {
 			continue
 		}
-		fmt.Printf("%-15s %8d", entry.Name, entry.FNode)
+		fmt.Fprintf(w, "%-15s %8d", entry.Name, entry.FNode)
 		fnode, err := d.image.GetFNode(int(entry.FNode))
 		if err != nil {
-			fmt.Printf("ERR\n")
+			fmt.Fprintf(w, "ERR\n")
 		} else {
-			fmt.Printf(" %8d", fnode.TotalSize)
+			fmt.Fprintf(w, " %8d", fnode.TotalSize)
 
 			typeName, ok := TypeNames[int(fnode.FType)]
 			if ok {
-				fmt.Printf("  %-12s", typeName)
+				fmt.Fprintf(w, "  %-12s", typeName)
 			} else {
-				fmt.Printf("  %-12s", "Unknown")
+				fmt.Fprintf(w, "  %-12s", "Unknown")
 			}
 
 			if fnode.IsAllocated() {
-				fmt.Print("A")
+				fmt.Fprint(w, "A")
 			} else {
-				fmt.Print(" ")
+				fmt.Fprint(w, " ")
 			}
 			if fnode.IsLong() {
-				fmt.Print("L")
+				fmt.Fprint(w, "L")
 			} else {
-				fmt.Print(" ")
+				fmt.Fprint(w, " ")
 			}
 			if fnode.IsPrimary() {
-				fmt.Print("P")
+				fmt.Fprint(w, "P")
 			} else {
-				fmt.Print(" ")
+				fmt.Fprint(w, " ")
 			}
 			if fnode.IsUnmodified() {
-				fmt.Print("U")
+				fmt.Fprint(w, "U")
 			} else {
-				fmt.Print(" ")
+				fmt.Fprint(w, " ")
 			}
 			if fnode.IsNoDelete() {
-				fmt.Print("N")
+				fmt.Fprint(w, "N")
 			} else {
-				fmt.Print(" ")
+				fmt.Fprint(w, " ")
 			}
 
-			fmt.Printf(" ")
+			fmt.Fprintf(w, " ")
 			for i := 0; i < int(fnode.IDCount); i++ {
 				accessor := fnode.Accessor[i]
 				if accessor.Access != 0 {
-					fmt.Printf(" %s:%d", accessStr(int(accessor.Access)), accessor.Id)
+					fmt.Fprintf(w, " %s:%d", accessStr(int(accessor.Access)), accessor.Id)
 				}
 			}
 		}
-		fmt.Println()
+		fmt.Fprintln(w)
 	}
 }
 
@@ -584,7 +631,7 @@ func (d *Directory) Find(entryName string) (int, error) {
 			return int(d.Entries[i].FNode), nil
 		}
 	}
-	return 0, fmt.Errorf("entry '%s' not found in directory", entryName)
+	return 0, fmt.Errorf("entry '%s' in directory: %w", entryName, ErrNotFound)
 }
 
 func (d *Directory) Unlink(entryName string) error {
@@ -596,7 +643,7 @@ func (d *Directory) Unlink(entryName string) error {
 		}
 	}
 	if !found {
-		return fmt.Errorf("entry '%s' not found in directory", entryName)
+		return fmt.Errorf("entry '%s' in directory: %w", entryName, ErrNotFound)
 	}
 	return nil
 }
@@ -647,6 +694,8 @@ type Bitmap struct {
 	data    []byte
 	fnode   *FNode
 	numBits int
+	dirty   bool  // changed since the image was last flushed
+	full    error // what running out of free bits means
 }
 
 func (v *Bitmap) IsAlloc(n int) bool {
@@ -661,6 +710,9 @@ func (v *Bitmap) IsAlloc(n int) bool {
 func (v *Bitmap) SetAlloc(n int, alloc bool) {
 	byteIndex := n / 8
 	bitIndex := n % 8
+	if n < 0 || byteIndex >= len(v.data) {
+		return
+	}
 	if !alloc {
 		v.data[byteIndex] |= (1 << bitIndex)
 	} else {
@@ -674,7 +726,7 @@ func (v *Bitmap) NextFree() (int, error) {
 			return i, nil
 		}
 	}
-	return 0, fmt.Errorf("no free bits")
+	return 0, v.full
 }
 
 func (v *Bitmap) GetFreeRange(count int, contig bool) ([]int, error) {
@@ -697,13 +749,13 @@ func (v *Bitmap) GetFreeRange(count int, contig bool) ([]int, error) {
 		}
 	}
 	if contig {
-		return nil, fmt.Errorf("no contiguous free ranges for size %d", count)
+		return nil, fmt.Errorf("no contiguous free ranges for size %d: %w", count, v.full)
 	} else {
-		return nil, fmt.Errorf("not enough free bits for size %d", count)
+		return nil, fmt.Errorf("not enough free bits for size %d: %w", count, v.full)
 	}
 }
 
-func (v *Bitmap) Print() {
+func (v *Bitmap) Print(w io.Writer) {
 	start := -1
 	for i := 0; i < v.numBits; i++ {
 		if v.IsAlloc(i) {
@@ -712,206 +764,708 @@ func (v *Bitmap) Print() {
 			}
 		} else {
 			if start >= 0 {
-				fmt.Printf("%d-%d ", start, i-1)
+				fmt.Fprintf(w, "%d-%d ", start, i-1)
 				start = -1
 			}
 		}
 	}
 	if start >= 0 {
-		fmt.Printf("%d-%d ", start, v.numBits-1)
+		fmt.Fprintf(w, "%d-%d ", start, v.numBits-1)
 	}
-	fmt.Println()
+	fmt.Fprintln(w)
 }
 
 func (v *Bitmap) GetNumBits() int {
 	return v.numBits
 }
 
+// Grow extends the bitmap to numBits bits, marking the new ones free. The file
+// that holds the bitmap must already have room for them.
+func (v *Bitmap) Grow(numBits int) error {
+	if v.fnode == nil {
+		return fmt.Errorf("Bitmap does not have an associated FNode")
+	}
+	size := (numBits + 7) / 8
+	if size > int(v.fnode.ThisSize) {
+		return fmt.Errorf("bitmap of %d bits does not fit in the %d bytes of FNode %d", numBits, v.fnode.ThisSize, v.fnode.Number)
+	}
+	for len(v.data) < size {
+		v.data = append(v.data, 0)
+	}
+	for i := v.numBits; i < numBits; i++ {
+		v.SetAlloc(i, false)
+	}
+	v.numBits = max(v.numBits, numBits)
+	v.fnode.TotalSize = uint32(len(v.data))
+	v.dirty = true
+	return v.fnode.Update()
+}
+
+// Update marks the bitmap to be written back when the image is flushed.
 func (v *Bitmap) Update() error {
 	if v.fnode == nil {
 		return fmt.Errorf("Bitmap does not have an associated FNode")
 	}
-	return v.fnode.UpdateDataInPlace(v.data)
+	v.dirty = true
+	return nil
 }
 
 func NewRMXImage() *RMXImage {
-	return &RMXImage{}
+	return &RMXImage{detectByteOrder: true, logger: slog.New(slog.DiscardHandler)}
+}
+
+// SetLogger sets the logger that debug and progress events are sent to. Nothing
+// is logged by default, and a nil logger turns logging off again.
+func (r *RMXImage) SetLogger(logger *slog.Logger) {
+	if logger == nil {
+		logger = slog.New(slog.DiscardHandler)
+	}
+	r.logger = logger
+}
+
+// SetGeometry sets the physical layout used to find logical blocks within the
+// image. It must be called before Load. Without a geometry, the layout recorded
+// in the image is used, or for raw images, the image is taken to be the sectors
+// of the disk concatenated in order.
+func (r *RMXImage) SetGeometry(g *geometry.Geometry) {
+	r.geometry = g
+}
+
+// SetDetectByteOrder controls whether Load detects images whose bytes are
+// swapped, by checking which byte order gives plausible volume labels. Detection
+// is on by default. It must be called before Load.
+func (r *RMXImage) SetDetectByteOrder(detect bool) {
+	r.detectByteOrder = detect
+}
+
+// SetScrub controls whether TruncateFNode and DeleteFNode zero the blocks they
+// free and the names of the directory entries they unlink, so that no old data
+// is left in the volume. It is off by default.
+func (r *RMXImage) SetScrub(scrub bool) {
+	r.scrub = scrub
 }
 
+// SetOffset sets the offset in bytes of the volume within the image, for disk
+// images that hold more than the volume. Only the volume is read, and only the
+// volume is written back. It must be called before Load.
+func (r *RMXImage) SetOffset(offset int) {
+	r.offset = offset
+}
+
+// SetPartition selects one of the volumes found in the image by ScanVolumes,
+// counting from 1, instead of giving its offset. It must be called before Load.
+func (r *RMXImage) SetPartition(partition int) {
+	r.partition = partition
+}
+
+// GetOffset returns the offset in bytes of the volume within the image.
+func (r *RMXImage) GetOffset() int {
+	return r.offset
+}
+
+// SetFormat sets the container format of the image, overriding detection. It
+// must be called before Load.
+func (r *RMXImage) SetFormat(format string) {
+	r.format = format
+}
+
+// Load reads the image from a file. If byteSwap is set, the low and high bytes
+// of every word are swapped; otherwise they are swapped only if byte order
+// detection is on and finds that the image needs it.
 func (r *RMXImage) Load(fileName string, byteSwap bool) error {
 	r.fileName = fileName
 	r.byteSwap = byteSwap
+	r.swapDetected = false
+	r.clearCache()
 
-	var data []byte
-	if strings.HasSuffix(fileName, ".imd") || strings.HasSuffix(fileName, ".IMD") {
-		im := imd.NewImageDisk()
-		err := im.Load(fileName)
+	g := r.geometry
+	if g != nil && g.HasISOInterleave() {
+		var err error
+		g, err = r.resolveISOInterleave(fileName)
 		if err != nil {
 			return err
 		}
-		data = im.GetData()
+		r.logger.Debug("interleave from ISO volume label", "interleave", g.Track.Interleave)
+	}
+	c, err := container.Open(fileName, r.format, g)
+	if err != nil {
+		return err
+	}
 
-		/*
-			err = os.WriteFile("imdtest.img", data, 0644)
-			if err != nil {
-				return err
-			}
-		*/
-		r.im = im
-	} else {
-		var err error
-		data, err = os.ReadFile(fileName)
-		if err != nil {
-			return err
+	err = r.Close()
+	if err != nil {
+		return err
+	}
+	r.container = c
+
+	size := c.NumBlocks() * container.BlockSize
+	region := r.offset != 0 || r.partition != 0
+	if r.partition != 0 {
+		volumes := r.ScanVolumes()
+		if r.partition < 1 || r.partition > len(volumes) {
+			return fmt.Errorf("partition %d not found, the image holds %d volumes", r.partition, len(volumes))
 		}
+		r.offset = volumes[r.partition-1].Offset
+		r.logger.Debug("found partition", "partition", r.partition, "offset", r.offset, "name", volumes[r.partition-1].Name)
+	}
+	if r.offset < 0 || r.offset >= size {
+		return fmt.Errorf("offset %d is outside of the image (size %d)", r.offset, size)
 	}
+	r.size = size - r.offset
 
-	if byteSwap {
-		for i := 0; i < len(data); i += 2 {
-			if i+1 < len(data) {
-				data[i], data[i+1] = data[i+1], data[i]
-			}
+	labels, err := r.readImage(r.offset, min(r.size, labelsEnd))
+	if err != nil {
+		return err
+	}
+	if !byteSwap && r.detectByteOrder && detectByteSwap(labels) {
+		r.byteSwap = true
+		r.swapDetected = true
+	}
+	if r.byteSwap {
+		if r.offset%2 != 0 {
+			return fmt.Errorf("cannot swap the bytes of a volume at the odd offset %d", r.offset)
+		}
+		swapBytes(labels)
+	}
+
+	if region && CheckVolumeLabel(labels) == nil {
+		vl := &RmxVolumeLabel{}
+		err = vl.Deserialize(labels[rmxLabelOffset:])
+		if err != nil {
+			return err
 		}
+		r.size = min(r.size, int(vl.Size))
 	}
 
-	r.contents = data
+	r.logger.Debug("loaded image", "file", fileName, "format", c.Name(), "offset", r.offset, "size", r.size,
+		"byteswap", r.byteSwap, "detected", r.swapDetected)
 	return nil
 }
 
+// resolveISOInterleave returns the geometry of the image with every track that
+// takes its interleave from the ISO volume label set to the interleave recorded
+// there. The label lives on track 0, which must therefore be in logical order.
+// The label is accepted in either byte order.
+func (r *RMXImage) resolveISOInterleave(fileName string) (*geometry.Geometry, error) {
+	c, err := container.Open(fileName, r.format, r.geometry.WithISOInterleave(1))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = c.Close()
+	}()
+	if c.NumBlocks()*container.BlockSize < labelsEnd {
+		return nil, fmt.Errorf("image is too small to hold an ISO volume label")
+	}
+	labels, err := c.ReadBlocks(0, labelsEnd/container.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if string(labels[isoLabelOffset:isoLabelOffset+3]) != "VOL" {
+		swapBytes(labels)
+	}
+	label := &IsoVolumeLabel{}
+	err = label.Deserialize(labels[isoLabelOffset:])
+	if err != nil {
+		return nil, err
+	}
+	if label.LabelId != "VOL" || label.Interleave < 1 || label.Interleave > 99 {
+		return nil, fmt.Errorf("no usable interleave in the ISO volume label")
+	}
+	return r.geometry.WithISOInterleave(label.Interleave), nil
+}
+
+// GetGeometry returns the geometry of the image, with any interleave taken from
+// the ISO volume label filled in. It returns nil for raw images without one.
+func (r *RMXImage) GetGeometry() *geometry.Geometry {
+	return r.container.Geometry()
+}
+
+// IsByteSwapped returns true if the bytes of the image are swapped.
+func (r *RMXImage) IsByteSwapped() bool {
+	return r.byteSwap
+}
+
+// IsByteSwapDetected returns true if the bytes of the image were swapped because
+// detection found it necessary, rather than because Load was asked to.
+func (r *RMXImage) IsByteSwapDetected() bool {
+	return r.swapDetected
+}
+
+// Size returns the size of the volume in bytes.
+func (r *RMXImage) Size() int {
+	return r.size
+}
+
+// CheckVolumeLabel checks that the iRMX volume label of the image is plausible.
+func (r *RMXImage) CheckVolumeLabel() error {
+	labels, err := r.readRange(0, min(r.size, labelsEnd))
+	if err != nil {
+		return err
+	}
+	return CheckVolumeLabel(labels)
+}
+
+// GetFormat returns the name of the container format of the image.
+func (r *RMXImage) GetFormat() string {
+	return r.container.Name()
+}
+
+func swapBytes(data []byte) {
+	for i := 0; i+1 < len(data); i += 2 {
+		data[i], data[i+1] = data[i+1], data[i]
+	}
+}
+
+// Save writes the image back to its file, after flushing any changes to the
+// volume label, fnodes and bitmaps.
 func (r *RMXImage) Save() error {
 	if r.fileName == "" {
 		return fmt.Errorf("no file name specified for saving RMXImage")
 	}
+	err := r.Flush()
+	if err != nil {
+		return err
+	}
+	r.logger.Info("saving image", "file", r.fileName, "format", r.container.Name())
+	return r.container.Save(r.fileName)
+}
 
-	var data []byte
+// Close releases the image file. Changes that were not saved are lost.
+func (r *RMXImage) Close() error {
+	if r.container == nil {
+		return nil
+	}
+	err := r.container.Close()
+	r.container = nil
+	return err
+}
 
-	if strings.HasSuffix(r.fileName, ".imd") || strings.HasSuffix(r.fileName, ".IMD") {
-		var err error
-		r.im.SetData(r.contents)
-		data, err = r.im.GetIMD()
+func (r *RMXImage) clearCache() {
+	r.label = nil
+	r.labelDirty = false
+	r.fnodes = map[int]*FNode{}
+	r.dirtyFnodes = map[int]bool{}
+	r.volMap = nil
+	r.fnodeMap = nil
+}
+
+// Flush writes the changed volume label, fnodes and bitmaps to the container.
+// The label is written first, so that the fnodes go where it says they are, and
+// the bitmaps last, so that their files are written with their final pointers.
+func (r *RMXImage) Flush() error {
+	r.logger.Debug("flushing metadata", "label", r.labelDirty, "fnodes", len(r.dirtyFnodes),
+		"volmap", r.volMap != nil && r.volMap.dirty, "fnodemap", r.fnodeMap != nil && r.fnodeMap.dirty)
+	if r.labelDirty {
+		data, err := r.readRange(rmxLabelOffset, rmxLabelOffset+128)
 		if err != nil {
-			return fmt.Errorf("failed to get IMD data: %w", err)
+			return err
 		}
-	} else {
-		data = r.contents
+		r.label.Serialize(data)
+		err = r.writeRange(rmxLabelOffset, data)
+		if err != nil {
+			return err
+		}
+		r.labelDirty = false
 	}
 
-	if r.byteSwap {
-		for i := 0; i < len(r.contents); i += 2 {
-			if i+1 < len(r.contents) {
-				data[i], data[i+1] = data[i+1], data[i]
-			}
+	numbers := []int{}
+	for n := range r.dirtyFnodes {
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	for _, n := range numbers {
+		offset, end := r.fnodeRange(n)
+		data, err := r.readRange(offset, end)
+		if err != nil {
+			return fmt.Errorf("FNode %d: %w", n, err)
+		}
+		r.fnodes[n].Serialize(data)
+		err = r.writeRange(offset, data)
+		if err != nil {
+			return err
 		}
+		delete(r.dirtyFnodes, n)
 	}
 
-	err := os.Remove(r.fileName)
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to delete existing file: %w", err)
+	for _, b := range []*Bitmap{r.volMap, r.fnodeMap} {
+		if b == nil || !b.dirty {
+			continue
+		}
+		err := b.fnode.UpdateDataInPlace(b.data)
+		if err != nil {
+			return err
+		}
+		b.dirty = false
+	}
+	return nil
+}
+
+// SaveAs saves the image under a new name, in the given container format and
+// laid out according to the given geometry. An empty format is chosen by the
+// extension of the new name, and a nil geometry keeps the current one. Only the
+// volume is saved, at the start of the new image.
+func (r *RMXImage) SaveAs(fileName string, format string, g *geometry.Geometry) error {
+	if g == nil {
+		g = r.container.Geometry()
 	}
 
-	return os.WriteFile(r.fileName, data, 0644)
+	err := r.Flush()
+	if err != nil {
+		return err
+	}
+
+	c, err := container.Create(fileName, format, g, r.size)
+	if err != nil {
+		return err
+	}
+
+	size := min(r.size, c.NumBlocks()*container.BlockSize)
+	if size < r.size {
+		vl, err := r.GetVolumeLabel()
+		if err == nil && int(vl.Size) > size {
+			return fmt.Errorf("volume of %d bytes does not fit in the %d bytes of the new image", vl.Size, size)
+		}
+	}
+
+	// copy the volume as it is stored, so that swapped bytes stay swapped
+	r.logger.Info("copying volume", "file", fileName, "format", c.Name(), "size", size)
+	data, err := r.readImage(r.offset, size)
+	if err != nil {
+		return err
+	}
+	err = c.WriteBlocks(0, data)
+	if err != nil {
+		return err
+	}
+
+	err = r.Close()
+	if err != nil {
+		return err
+	}
+	r.fileName = fileName
+	r.container = c
+	r.offset = 0
+	r.size = size
+	return r.Save()
 }
 
 func (r *RMXImage) GetIsoVolumeLabel() (*IsoVolumeLabel, error) {
-	if len(r.contents) < 896 {
+	if r.size < 896 {
 		return nil, os.ErrInvalid
 	}
+	data, err := r.readRange(768, 896)
+	if err != nil {
+		return nil, err
+	}
 	label := &IsoVolumeLabel{}
-	label.Deserialize(r.contents[768:])
+	err = label.Deserialize(data)
+	if err != nil {
+		return nil, err
+	}
+	label.Image = r
 	return label, nil
 }
 
+func (r *RMXImage) PutIsoVolumeLabel(label *IsoVolumeLabel) error {
+	if r.size < 896 {
+		return os.ErrInvalid
+	}
+	data, err := r.readRange(768, 896)
+	if err != nil {
+		return err
+	}
+	label.Serialize(data)
+	return r.writeRange(768, data)
+}
+
+// GetVolumeLabel returns a copy of the iRMX volume label. The label is read once
+// and kept; Update on the copy replaces it.
 func (r *RMXImage) GetVolumeLabel() (*RmxVolumeLabel, error) {
-	if len(r.contents) < 512 {
-		return nil, os.ErrInvalid
+	if r.label == nil {
+		if r.size < 512 {
+			return nil, os.ErrInvalid
+		}
+		data, err := r.readRange(rmxLabelOffset, rmxLabelOffset+128)
+		if err != nil {
+			return nil, err
+		}
+		label := &RmxVolumeLabel{Image: r}
+		err = label.Deserialize(data)
+		if err != nil {
+			return nil, err
+		}
+		// the fnodes and blocks cannot be found without these
+		if label.Gran == 0 {
+			return nil, corrupt("volume label", rmxLabelOffset, "granularity is zero")
+		}
+		if label.FnodeSize < minFnodeSize {
+			return nil, corrupt("volume label", rmxLabelOffset, "FNode size %d is smaller than %d", label.FnodeSize, minFnodeSize)
+		}
+		r.label = label
 	}
-	label := &RmxVolumeLabel{}
-	label.Deserialize(r.contents[384:])
-	label.Image = r
-	return label, nil
+	label := *r.label
+	return &label, nil
 }
 
+// PutVolumeLabel replaces the volume label. It is written when the image is
+// flushed.
 func (r *RMXImage) PutVolumeLabel(label *RmxVolumeLabel) error {
-	if len(r.contents) < 512 {
+	if r.size < 512 {
 		return os.ErrInvalid
 	}
-	label.Serialize(r.contents[384:])
+	saved := *label
+	saved.Image = r
+	r.label = &saved
+	r.labelDirty = true
 	return nil
 }
 
-func (r *RMXImage) GetFNode(fnodeIndex int) (*FNode, error) {
-	vl, err := r.GetVolumeLabel()
+// fnodeRange returns where fnode n lies within the volume.
+func (r *RMXImage) fnodeRange(n int) (int, int) {
+	offset := int(r.label.FnodeStart) + n*int(r.label.FnodeSize)
+	return offset, offset + int(r.label.FnodeSize)
+}
+
+// checkFNodeIndex returns an error unless fnode n is one of the fnodes of the
+// volume and lies within it.
+func (r *RMXImage) checkFNodeIndex(n int) error {
+	_, err := r.GetVolumeLabel()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	offset := vl.FnodeStart + uint32(fnodeIndex)*uint32(vl.FnodeSize)
-	fnode := &FNode{Image: r, Number: fnodeIndex}
-	fnode.Deserialize(r.contents[offset : offset+uint32(vl.FnodeSize)])
-	return fnode, nil
+	if n < 0 || n >= int(r.label.MaxFnode) {
+		return fmt.Errorf("FNode %d does not exist, the volume has %d: %w", n, r.label.MaxFnode, ErrNotFound)
+	}
+	_, end := r.fnodeRange(n)
+	if end > r.size {
+		return r.fnodeCorrupt(n, "it lies beyond the end of the volume (size %d)", r.size)
+	}
+	return nil
 }
 
+// GetFNode returns a copy of fnode fnodeIndex. Fnodes are read once and kept, so
+// walking a tree does not read them again.
+func (r *RMXImage) GetFNode(fnodeIndex int) (*FNode, error) {
+	cached, ok := r.fnodes[fnodeIndex]
+	if !ok {
+		err := r.checkFNodeIndex(fnodeIndex)
+		if err != nil {
+			return nil, err
+		}
+		offset, end := r.fnodeRange(fnodeIndex)
+		data, err := r.readRange(offset, end)
+		if err != nil {
+			return nil, err
+		}
+		cached = &FNode{Image: r, Number: fnodeIndex}
+		err = cached.Deserialize(data)
+		if err != nil {
+			return nil, err
+		}
+		r.fnodes[fnodeIndex] = cached
+	}
+	fnode := *cached
+	return &fnode, nil
+}
+
+// PutFNode replaces fnode fnodeIndex. It is written when the image is flushed.
 func (r *RMXImage) PutFNode(fnodeIndex int, fnode *FNode) error {
-	vl, err := r.GetVolumeLabel()
+	err := r.checkFNodeIndex(fnodeIndex)
 	if err != nil {
 		return err
 	}
-	offset := vl.FnodeStart + uint32(fnodeIndex)*uint32(vl.FnodeSize)
-	fnode.Serialize(r.contents[offset : offset+uint32(vl.FnodeSize)])
+	// keep only what is stored in the fnode, not the state of a lookup or read
+	saved := &FNode{Image: r, Number: fnodeIndex}
+	data := make([]byte, minFnodeSize)
+	fnode.Serialize(data)
+	err = saved.Deserialize(data)
+	if err != nil {
+		return err
+	}
+	r.fnodes[fnodeIndex] = saved
+	r.dirtyFnodes[fnodeIndex] = true
 	return nil
 }
 
+// readImage returns count bytes of the image starting at offset, as they are
+// stored, without regard to the volume or its byte order.
+func (r *RMXImage) readImage(offset int, count int) ([]byte, error) {
+	first := offset / container.BlockSize
+	skip := offset % container.BlockSize
+	blocks, err := r.container.ReadBlocks(first, (skip+count+container.BlockSize-1)/container.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return blocks[skip : skip+count], nil
+}
+
+// blocksFor returns the container blocks that hold the bytes of the volume from
+// start to end, in the byte order of the volume, together with the number of the
+// first block and the position of start within the blocks.
+func (r *RMXImage) blocksFor(start int, end int) ([]byte, int, int, error) {
+	first := (r.offset + start) / container.BlockSize
+	skip := (r.offset + start) % container.BlockSize
+	count := (skip + end - start + container.BlockSize - 1) / container.BlockSize
+	blocks, err := r.container.ReadBlocks(first, count)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if r.byteSwap {
+		// blocks start at even offsets, so the pairs line up with the volume's
+		swapBytes(blocks)
+	}
+	return blocks, first, skip, nil
+}
+
+// readRange returns a copy of the bytes of the volume from start to end, or an
+// error if any part of the range lies outside of the volume.
+func (r *RMXImage) readRange(start int, end int) ([]byte, error) {
+	if start < 0 || start > end || end > r.size {
+		return nil, fmt.Errorf("range %d-%d is outside of the image (size %d)", start, end, r.size)
+	}
+	blocks, _, skip, err := r.blocksFor(start, end)
+	if err != nil {
+		return nil, err
+	}
+	return blocks[skip : skip+end-start], nil
+}
+
+// writeRange replaces the bytes of the volume starting at start with data, or
+// returns an error if any part of the range lies outside of the volume.
+func (r *RMXImage) writeRange(start int, data []byte) error {
+	end := start + len(data)
+	if start < 0 || end > r.size {
+		return fmt.Errorf("range %d-%d is outside of the image (size %d)", start, end, r.size)
+	}
+	blocks, first, skip, err := r.blocksFor(start, end)
+	if err != nil {
+		return err
+	}
+	copy(blocks[skip:], data)
+	if r.byteSwap {
+		swapBytes(blocks)
+	}
+	return r.container.WriteBlocks(first, blocks)
+}
+
+// salvageRange returns a copy of the bytes from start to end. The portion of the
+// range that lies outside of the image is zero-filled, up to the size of the
+// image, so that a wild pointer cannot exhaust memory. The boolean result is
+// false if any zero-filling was necessary.
+func (r *RMXImage) salvageRange(start int, end int) ([]byte, bool) {
+	ok := end <= r.size
+	if !ok {
+		end = min(end, start+r.size)
+	}
+	data := make([]byte, end-start)
+	if start < r.size {
+		inside, err := r.readRange(start, min(end, r.size))
+		if err != nil {
+			return data, false
+		}
+		copy(data, inside)
+	}
+	return data, ok
+}
+
 func (r *RMXImage) ReadLongData(fnode *FNode, blockfile []byte, totalBlocks int) ([]byte, int, error) {
+	data, totalBlocks, _, err := r.readLongData(fnode, blockfile, totalBlocks, false)
+	return data, totalBlocks, err
+}
+
+func (r *RMXImage) readLongData(fnode *FNode, blockfile []byte, totalBlocks int, salvage bool) ([]byte, int, []string, error) {
 	vl, err := r.GetVolumeLabel()
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, nil, err
 	}
 	gran := int(vl.Gran)
 	data := []byte{}
-	for (len(blockfile) > 0) && (totalBlocks > 0) {
-		nblocks := blockfile[0]
-		blockPointer := uint32(blockfile[1]) + uint32(blockfile[2])<<8 + uint32(blockfile[3])<<16
-		blockfile = blockfile[4:]
-
-		if nblocks == 0 {
-			continue
+	problems := []string{}
+	for _, entry := range decodeIndirect(blockfile) {
+		if totalBlocks <= 0 {
+			break
 		}
+		nblocks := entry.NumBlocks
+		blockPointer := entry.BlockPointer
 
-		fnode.appendAllDataBlocks(int(nblocks), int(blockPointer))
+		fnode.appendAllDataBlocks(nblocks, blockPointer)
 
-		start := uint32(blockPointer) * uint32(vl.Gran)
-		end := start + uint32(nblocks)*uint32(gran)
-		//fmt.Printf("%d %d %d %d %d\n", totalBlocks, nblocks, blockPointer, start, end)
-		data = append(data, r.contents[start:end]...)
+		start := blockPointer * gran
+		end := start + nblocks*gran
+		if salvage {
+			thisData, ok := r.salvageRange(start, end)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("blocks %d-%d are out of range, zero-filled", blockPointer, blockPointer+nblocks-1))
+			}
+			data = append(data, thisData...)
+		} else {
+			if end > r.size {
+				return nil, 0, nil, r.fnodeCorrupt(fnode.Number, "blocks %d-%d lie beyond the end of the volume", blockPointer, blockPointer+nblocks-1)
+			}
+			thisData, err := r.readRange(start, end)
+			if err != nil {
+				return nil, 0, nil, err
+			}
+			data = append(data, thisData...)
+		}
 
-		totalBlocks -= int(nblocks)
+		totalBlocks -= nblocks
 	}
-	return data, totalBlocks, nil
+	return data, totalBlocks, problems, nil
 }
 
 func (r *RMXImage) ReadFile(fnode *FNode) ([]byte, error) {
+	data, _, err := r.readFile(fnode, false)
+	return data, err
+}
+
+// SalvageFile reads as much of a file as it can from a damaged image. Blocks that
+// lie outside of the image are zero-filled, indirect blocks that cannot be read
+// are skipped, and a TotalSize that is larger than the data that could be found
+// is truncated. The returned problems list everything that prevented the file
+// from being recovered completely; it is empty if the file was read cleanly.
+func (r *RMXImage) SalvageFile(fnode *FNode) ([]byte, []string, error) {
+	return r.readFile(fnode, true)
+}
+
+func (r *RMXImage) readFile(fnode *FNode, salvage bool) ([]byte, []string, error) {
 	vl, err := r.GetVolumeLabel()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	gran := int(vl.Gran) * int(fnode.Gran)
 	data := []byte{}
+	problems := []string{}
 	if fnode.IsLong() {
 		totalBlocks := int(fnode.TotalBlocks)
 		for _, pointer := range fnode.Pointers {
-			var err error
 			var thisData []byte
+			var thisProblems []string
 			if pointer.NumBlocks == 0 {
 				continue
 			}
 			fnode.appendAllIndirectBlocks(1, int(pointer.BlockPointer))
 			totalBlocks -= 1 // gotta count the indirect block too. Assuming can only name 1 indirect block.
-			start := pointer.BlockPointer * uint32(vl.Gran)
-			end := start + 1*uint32(gran)
-			thisData, totalBlocks, err = r.ReadLongData(fnode, r.contents[start:end], totalBlocks)
+			start := int(pointer.BlockPointer) * int(vl.Gran)
+			end := start + 1*gran
+			if end > r.size {
+				if !salvage {
+					return nil, nil, r.fnodeCorrupt(fnode.Number, "indirect block %d lies beyond the end of the volume", pointer.BlockPointer)
+				}
+				problems = append(problems, fmt.Sprintf("indirect block %d is out of range, its data is missing", pointer.BlockPointer))
+				continue
+			}
+			blockfile, err := r.readRange(start, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			thisData, totalBlocks, thisProblems, err = r.readLongData(fnode, blockfile, totalBlocks, salvage)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			data = append(data, thisData...)
+			problems = append(problems, thisProblems...)
 		}
 	} else {
 		for _, pointer := range fnode.Pointers {
@@ -919,31 +1473,64 @@ func (r *RMXImage) ReadFile(fnode *FNode) ([]byte, error) {
 				continue
 			}
 			fnode.appendAllDataBlocks(int(pointer.NumBlocks), int(pointer.BlockPointer))
-			//fmt.Printf("%d %d %d\n", pointer.NumBlocks, pointer.BlockPointer, len(r.contents))
-			start := uint32(pointer.BlockPointer) * uint32(vl.Gran)
-			end := start + uint32(pointer.NumBlocks)*uint32(gran)
-			data = append(data, r.contents[start:end]...)
+			start := int(pointer.BlockPointer) * int(vl.Gran)
+			end := start + int(pointer.NumBlocks)*gran
+			if salvage {
+				thisData, ok := r.salvageRange(start, end)
+				if !ok {
+					problems = append(problems, fmt.Sprintf("blocks %d-%d are out of range, zero-filled", pointer.BlockPointer, pointer.BlockPointer+uint32(pointer.NumBlocks)-1))
+				}
+				data = append(data, thisData...)
+			} else {
+				if end > r.size {
+					return nil, nil, r.fnodeCorrupt(fnode.Number, "blocks %d-%d lie beyond the end of the volume", pointer.BlockPointer, pointer.BlockPointer+uint32(pointer.NumBlocks)-1)
+				}
+				thisData, err := r.readRange(start, end)
+				if err != nil {
+					return nil, nil, err
+				}
+				data = append(data, thisData...)
+			}
 		}
 	}
-	data = data[:fnode.TotalSize]
-	return data, nil
+	if int(fnode.TotalSize) > len(data) {
+		if !salvage {
+			return nil, nil, r.fnodeCorrupt(fnode.Number, "TotalSize %d exceeds the %d bytes in its blocks", fnode.TotalSize, len(data))
+		}
+		problems = append(problems, fmt.Sprintf("TotalSize %d exceeds the %d bytes in its blocks, truncated", fnode.TotalSize, len(data)))
+	} else {
+		data = data[:fnode.TotalSize]
+	}
+	return data, problems, nil
 }
 
 func (r *RMXImage) Mknod(dirFNode *FNode, fileName string, ftype int) (*FNode, error) {
 	if !dirFNode.IsDirectory() {
-		return nil, fmt.Errorf("parent FNode is not a directory")
+		return nil, fmt.Errorf("parent FNode %d %w", dirFNode.Number, ErrNotDirectory)
+	}
+
+	dirList, err := r.GetDirectory(dirFNode)
+	if err != nil {
+		return nil, err
+	}
+	if len(fileName) > 14 {
+		fileName = fileName[:14]
+	}
+	if _, err := dirList.Find(fileName); err == nil {
+		return nil, fmt.Errorf("entry '%s' in directory: %w", fileName, ErrExists)
 	}
 
 	fnode := &FNode{
-		Name:  fileName,
-		Image: r,
-		FType: uint8(ftype),
-		Flags: Allocated | Primary,
-		Gran:  1,
-		Owner: uint16(dirFNode.Number),
+		Name:   fileName,
+		Image:  r,
+		FType:  uint8(ftype),
+		Flags:  Allocated | Primary,
+		Gran:   1,
+		Owner:  uint16(dirFNode.Number),
+		Parent: uint16(dirFNode.Number),
 	}
 
-	err := fnode.AddAccessor(AccessAll, 0) // Root
+	err = fnode.AddAccessor(AccessAll, 0) // Root
 	if err != nil {
 		return nil, err
 	}
@@ -973,15 +1560,12 @@ func (r *RMXImage) Mknod(dirFNode *FNode, fileName string, ftype int) (*FNode, e
 		return nil, err
 	}
 
-	dirList, err := r.GetDirectory(dirFNode)
-	if err != nil {
-		return nil, err
-	}
-
 	_, err = dirList.AddEntry(fnode.Number, fnode.Name)
 	if err != nil {
 		return nil, err
 	}
+	fnode.Directory = dirList
+	r.logger.Debug("created FNode", "fnode", fnode.Number, "name", fnode.Name, "type", ftype, "parent", dirFNode.Number)
 
 	err = dirList.Update()
 	if err != nil {
@@ -999,6 +1583,8 @@ func (r *RMXImage) PutFile(dirFNode *FNode, fileName string, data []byte, contig
 
 	err = r.PutData(fnode, data, contig)
 	if err != nil {
+		// don't leave an empty file behind
+		_ = r.DeleteFNode(fnode)
 		return nil, err
 	}
 
@@ -1011,21 +1597,31 @@ func (r *RMXImage) PutData(fnode *FNode, data []byte, contig bool) error {
 		return err
 	}
 
-	fnode.TotalSize = uint32(len(data))
-
-	// Note that Mknod might affect volmap, so do this after calling mknod
 	volMap, err := r.GetVolMap()
 	if err != nil {
 		return err
 	}
 
 	blockCount := (len(data) + int(vl.Gran) - 1) / int(vl.Gran)
-	fmt.Printf("Allocating %d blocks for file '%s' gran=%d\n", blockCount, fnode.Name, vl.Gran)
+	r.logger.Debug("allocating blocks", "fnode", fnode.Number, "name", fnode.Name, "blocks", blockCount, "gran", vl.Gran)
 	blockNums, err := volMap.GetFreeRange(blockCount, contig)
 	if err != nil {
 		return err
 	}
 
+	// check that the blocks can be described before writing any of them
+	extents := 0
+	for i, blkNum := range blockNums {
+		if i == 0 || blkNum != blockNums[i-1]+1 {
+			extents += 1
+		}
+	}
+	if extents > NumPointers {
+		return fmt.Errorf("file needs %d extents and long files are not supported yet: %w", extents, ErrTooManyExtents)
+	}
+
+	fnode.TotalSize = uint32(len(data))
+
 	blkList := []Pointer{}
 
 	blockIndex := 0
@@ -1033,7 +1629,6 @@ func (r *RMXImage) PutData(fnode *FNode, data []byte, contig bool) error {
 	last := -1
 	for len(data) > 0 {
 		blkNum := blockNums[blockIndex]
-		//fmt.Printf("Allocating block %d for file '%s'\n", blkNum, fileName)
 		if blkNum != last+1 {
 			if start != -1 {
 				blkList = append(blkList, Pointer{NumBlocks: uint16(last - start + 1), BlockPointer: uint32(start)})
@@ -1045,8 +1640,10 @@ func (r *RMXImage) PutData(fnode *FNode, data []byte, contig bool) error {
 		}
 		blkSize := min(len(data), int(vl.Gran))
 		startAddr := blkNum * int(vl.Gran)
-		endAddr := startAddr + blkSize
-		copy(r.contents[startAddr:endAddr], data[:blkSize])
+		err = r.writeRange(startAddr, data[:blkSize])
+		if err != nil {
+			return err
+		}
 		data = data[blkSize:]
 		volMap.SetAlloc(blkNum, true) // Mark the block as allocated
 		last = blkNum
@@ -1061,16 +1658,11 @@ func (r *RMXImage) PutData(fnode *FNode, data []byte, contig bool) error {
 		blkList = append(blkList, Pointer{NumBlocks: uint16(last - start + 1), BlockPointer: uint32(start)})
 	}
 
-	if len(blkList) > 8 {
-		return fmt.Errorf("too many blocks allocated for FNode: %d. Long files not supported yet", len(blkList))
-	}
-
 	err = volMap.Update()
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("XXX %d", fnode.TotalBlocks)
 	copy(fnode.Pointers[:], blkList)
 	err = fnode.Update()
 	if err != nil {
@@ -1094,14 +1686,17 @@ func (r *RMXImage) Mkdir(parentFNode *FNode, dirName string) (*FNode, error) {
 
 func (r *RMXImage) GetDirectory(dirFnode *FNode) (*Directory, error) {
 	if !dirFnode.IsDirectory() {
-		return nil, fmt.Errorf("FNode is not a directory")
+		return nil, fmt.Errorf("FNode %d %w", dirFnode.Number, ErrNotDirectory)
 	}
 	data, err := r.ReadFile(dirFnode)
 	if err != nil {
 		return nil, err
 	}
 	dir := &Directory{image: r, fnode: dirFnode}
-	dir.Deserialize(data, len(data))
+	err = dir.Deserialize(data, len(data))
+	if err != nil {
+		return nil, err
+	}
 	return dir, nil
 }
 
@@ -1117,12 +1712,39 @@ func (r *RMXImage) GetRootDirectory() (*FNode, error) {
 	return dirFNode, nil
 }
 
+// GetVolMap returns the map of free blocks. There is only one, shared by all
+// callers; Update marks it to be written when the image is flushed.
 func (r *RMXImage) GetVolMap() (*Bitmap, error) {
-	vl, err := r.GetVolumeLabel()
-	if err != nil {
-		return nil, err
+	if r.volMap == nil {
+		vl, err := r.GetVolumeLabel()
+		if err != nil {
+			return nil, err
+		}
+		r.volMap, err = r.readBitmap(1, int(vl.Size)/int(vl.Gran), ErrVolumeFull)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r.volMap, nil
+}
+
+// GetFNodeMap returns the map of free fnodes. Like the volume map, it is shared.
+func (r *RMXImage) GetFNodeMap() (*Bitmap, error) {
+	if r.fnodeMap == nil {
+		vl, err := r.GetVolumeLabel()
+		if err != nil {
+			return nil, err
+		}
+		r.fnodeMap, err = r.readBitmap(2, int(vl.MaxFnode), ErrNoFreeFNode)
+		if err != nil {
+			return nil, err
+		}
 	}
-	fnode, err := r.GetFNode(1)
+	return r.fnodeMap, nil
+}
+
+func (r *RMXImage) readBitmap(fnodeIndex int, numBits int, full error) (*Bitmap, error) {
+	fnode, err := r.GetFNode(fnodeIndex)
 	if err != nil {
 		return nil, err
 	}
@@ -1130,35 +1752,58 @@ func (r *RMXImage) GetVolMap() (*Bitmap, error) {
 	if err != nil {
 		return nil, err
 	}
-	b := &Bitmap{
-		data:    data,
-		fnode:   fnode,
-		numBits: int(vl.Size) / int(vl.Gran),
-	}
-
-	return b, nil
+	// a short file only holds the bits it has room for
+	numBits = min(numBits, len(data)*8)
+	return &Bitmap{data: data, fnode: fnode, numBits: numBits, full: full}, nil
 }
 
-func (r *RMXImage) GetFNodeMap() (*Bitmap, error) {
+// GrowFNodes makes room for count fnodes. The fnode file is rewritten in one
+// extent, wherever there is room for it, and the new fnodes are marked free. Like
+// other changes to the metadata, the result is written when the image is
+// flushed; the label goes first, so that the fnodes are written to their new
+// home.
+func (r *RMXImage) GrowFNodes(count int) error {
 	vl, err := r.GetVolumeLabel()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	fnode, err := r.GetFNode(2)
+	if count <= int(vl.MaxFnode) || count > math.MaxUint16 {
+		return fmt.Errorf("FNode count %d must be greater than the current %d and at most %d", count, vl.MaxFnode, math.MaxUint16)
+	}
+
+	fm, err := r.GetFNodeMap()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if (count+7)/8 > int(fm.fnode.ThisSize) {
+		return fmt.Errorf("the FNode map has no room for %d FNodes", count)
+	}
+
+	fnode, err := r.GetFNode(0)
+	if err != nil {
+		return err
 	}
 	data, err := r.ReadFile(fnode)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	b := &Bitmap{
-		data:    data,
-		fnode:   fnode,
-		numBits: int(vl.MaxFnode),
+	err = r.TruncateFNode(fnode)
+	if err != nil {
+		return err
+	}
+	data = append(data, make([]byte, count*int(vl.FnodeSize)-len(data))...)
+	err = r.PutData(fnode, data, true)
+	if err != nil {
+		return err
 	}
 
-	return b, nil
+	vl.FnodeStart = fnode.Pointers[0].BlockPointer * uint32(vl.Gran)
+	vl.MaxFnode = uint16(count)
+	err = vl.Update()
+	if err != nil {
+		return err
+	}
+	return fm.Grow(count)
 }
 
 func (r *RMXImage) Lookup(dir *FNode, name string) (*FNode, error) {
@@ -1206,13 +1851,14 @@ func (r *RMXImage) Lookup(dir *FNode, name string) (*FNode, error) {
 		return fnode, nil
 	} else {
 		if len(parts) > 1 {
-			return nil, fmt.Errorf("file %s is not a directory", parts[0])
+			return nil, fmt.Errorf("file %s %w", parts[0], ErrNotDirectory)
 		}
 		return fnode, nil
 	}
 }
 
 func (r *RMXImage) DeleteFNode(fnode *FNode) error {
+	r.logger.Debug("deleting FNode", "fnode", fnode.Number, "name", fnode.Name)
 	err := r.TruncateFNode(fnode)
 	if err != nil {
 		return err
@@ -1235,6 +1881,14 @@ func (r *RMXImage) DeleteFNode(fnode *FNode) error {
 	if err != nil {
 		return err
 	}
+	if r.scrub {
+		for i := range fnode.Directory.Entries {
+			entry := &fnode.Directory.Entries[i]
+			if entry.FNode == 0 && strings.EqualFold(entry.Name, fnode.Name) {
+				entry.Name = ""
+			}
+		}
+	}
 
 	err = fnode.Directory.Update()
 	if err != nil {
@@ -1268,6 +1922,13 @@ func (r *RMXImage) TruncateFNode(fnode *FNode) error {
 		volMap.SetAlloc(blk, false)
 	}
 
+	if r.scrub {
+		err = r.fillBlocks(append(append([]int{}, fnode.AllDataBlocks...), fnode.AllIndirectBlocks...), 0)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = volMap.Update()
 	if err != nil {
 		return err
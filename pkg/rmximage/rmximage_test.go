@@ -0,0 +1,1028 @@
+package rmximage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/sbelectronics/rmxtool/internal/testvolume"
+	"github.com/sbelectronics/rmxtool/pkg/container"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"github.com/stretchr/testify/suite"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The layout of the volume made by testvolume.Make.
+const (
+	testGran       = testvolume.Gran
+	testBlocks     = testvolume.Blocks
+	testFnodeBase  = testvolume.FNodeBase
+	testVolMap     = testvolume.VolMap
+	testFNodeMap   = testvolume.FNodeMap
+	testBadBlocks  = testvolume.BadBlocks
+	testRoot       = testvolume.Root
+	testHello      = testvolume.Hello
+	testFree       = testvolume.Free
+	testHelloFNode = testvolume.HelloFNode
+)
+
+// loadBytes returns an image of the volume in data, held in memory.
+func loadBytes(data []byte) *RMXImage {
+	c := &container.Raw{}
+	_ = c.Create(nil, len(data))
+	_ = c.WriteBlocks(0, data)
+	r := NewRMXImage()
+	r.container = c
+	r.size = len(data)
+	r.clearCache()
+	return r
+}
+
+// volumeBytes returns the volume as it is stored in the container.
+func volumeBytes(r *RMXImage) []byte {
+	data, _ := r.readImage(0, r.size)
+	return data
+}
+
+type RMXImageSuite struct {
+	suite.Suite
+}
+
+func (s *RMXImageSuite) TestReadFile() {
+	r := loadBytes(testvolume.Make())
+	fnode, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	data, err := r.ReadFile(fnode)
+	s.Require().NoError(err)
+	s.Equal("hello", string(data))
+}
+
+func (s *RMXImageSuite) TestPutFileFlush() {
+	r := loadBytes(testvolume.Make())
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	_, err = r.PutFile(root, "new.txt", []byte("new data"), false)
+	s.Require().NoError(err)
+
+	// the label, fnodes and bitmaps are not written until the image is flushed
+	s.True(bytes.Equal(testvolume.Make()[:testRoot*testGran], volumeBytes(r)[:testRoot*testGran]))
+	s.Require().NoError(r.Flush())
+
+	loaded := loadBytes(volumeBytes(r))
+	fnode, err := loaded.Lookup(nil, "new.txt")
+	s.Require().NoError(err)
+	data, err := loaded.ReadFile(fnode)
+	s.Require().NoError(err)
+	s.Equal("new data", string(data))
+
+	volMap, err := loaded.GetVolMap()
+	s.Require().NoError(err)
+	s.True(volMap.IsAlloc(fnode.AllDataBlocks[0]))
+	fnodeMap, err := loaded.GetFNodeMap()
+	s.Require().NoError(err)
+	s.True(fnodeMap.IsAlloc(fnode.Number))
+}
+
+func (s *RMXImageSuite) TestGetFNodeCopy() {
+	r := loadBytes(testvolume.Make())
+	fnode, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	_, err = r.ReadFile(fnode)
+	s.Require().NoError(err)
+	fnode.TotalSize = 99
+	fnode.Pointers[0].BlockPointer = 40
+
+	// changes to a copy are not seen until it is put back
+	again, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Equal(uint32(5), again.TotalSize)
+	s.Equal(uint32(testHello), again.Pointers[0].BlockPointer)
+	s.Empty(again.AllDataBlocks)
+
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	fnode.TotalSize = 100
+	again, err = r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Equal(uint32(99), again.TotalSize)
+	s.Empty(again.AllDataBlocks, "only what is stored in the fnode is kept")
+	s.Equal(testvolume.Make(), volumeBytes(r))
+	s.Require().NoError(r.Flush())
+	again, err = loadBytes(volumeBytes(r)).GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Equal(uint32(99), again.TotalSize)
+	s.Equal(uint32(40), again.Pointers[0].BlockPointer)
+}
+
+func (s *RMXImageSuite) TestBitmapGrow() {
+	r := loadBytes(testvolume.Make())
+	fm, err := r.GetFNodeMap()
+	s.Require().NoError(err)
+	s.Equal(10, fm.GetNumBits())
+	s.Require().NoError(fm.Grow(20))
+	s.Equal(20, fm.GetNumBits())
+	for i := 0; i < 20; i++ {
+		s.Equal(i < 8, fm.IsAlloc(i), "fnode %d", i)
+	}
+	fnode, err := r.GetFNode(2)
+	s.Require().NoError(err)
+	s.Equal(uint32(3), fnode.TotalSize)
+
+	// a bitmap never shrinks, and only grows within its file
+	s.Require().NoError(fm.Grow(12))
+	s.Equal(20, fm.GetNumBits())
+	s.ErrorContains(fm.Grow(testGran*8+1), "does not fit")
+	s.NoError(fm.Grow(testGran * 8))
+	s.Error((&Bitmap{}).Grow(8))
+}
+
+func (s *RMXImageSuite) TestGrowFNodes() {
+	r := loadBytes(testvolume.Make())
+	s.Require().NoError(r.GrowFNodes(20))
+
+	// the new fnode file is written at once, but the label, the fnodes and the
+	// bitmaps wait for the flush
+	s.Equal(testvolume.Make()[:testFnodeBase*testGran], volumeBytes(r)[:testFnodeBase*testGran])
+	s.Require().NoError(r.Flush())
+
+	// the label was written before the fnodes, so they are found at the new place
+	loaded := loadBytes(volumeBytes(r))
+	vl, err := loaded.GetVolumeLabel()
+	s.Require().NoError(err)
+	s.Equal(uint16(20), vl.MaxFnode)
+	s.Equal(uint32(testFree*testGran), vl.FnodeStart)
+	fnode, err := loaded.GetFNode(0)
+	s.Require().NoError(err)
+	s.Equal(uint32(testFree), fnode.Pointers[0].BlockPointer)
+	s.Equal(uint32(20*minFnodeSize), fnode.TotalSize)
+	fm, err := loaded.GetFNodeMap()
+	s.Require().NoError(err)
+	s.Equal(20, fm.GetNumBits())
+	s.False(fm.IsAlloc(19))
+	volMap, err := loaded.GetVolMap()
+	s.Require().NoError(err)
+	s.False(volMap.IsAlloc(testFnodeBase), "the old fnode file is free")
+	s.True(volMap.IsAlloc(testFree + 13))
+
+	hello, err := loaded.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	data, err := loaded.ReadFile(hello)
+	s.Require().NoError(err)
+	s.Equal("hello", string(data))
+	s.Empty(loaded.Check())
+
+	// the new fnodes can be used
+	for i := 0; i < 12; i++ {
+		root, err := loaded.GetRootDirectory()
+		s.Require().NoError(err)
+		_, err = loaded.PutFile(root, fmt.Sprintf("f%d", i), []byte("x"), false)
+		s.Require().NoError(err)
+	}
+	s.Require().NoError(loaded.Flush())
+	s.Empty(loaded.Check())
+
+	s.ErrorContains(loaded.GrowFNodes(20), "must be greater than the current 20")
+	s.ErrorContains(loaded.GrowFNodes(testGran*8+1), "no room")
+}
+
+func (s *RMXImageSuite) TestCorruptPointer() {
+	data := testvolume.Make()
+	// point hello.txt far beyond the end of the volume
+	data[testFnodeBase*testGran+testHelloFNode*minFnodeSize+28] = 0xFF
+	r := loadBytes(data)
+
+	fnode, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	_, err = r.ReadFile(fnode)
+	var corruptErr *CorruptError
+	s.Require().True(errors.As(err, &corruptErr), "%v", err)
+	s.Equal("FNode 7", corruptErr.What)
+	s.Equal(testFnodeBase*testGran+testHelloFNode*minFnodeSize, corruptErr.Offset)
+
+	salvaged, problems, err := r.SalvageFile(fnode)
+	s.Require().NoError(err)
+	s.Len(salvaged, 5)
+	s.NotEmpty(problems)
+}
+
+func (s *RMXImageSuite) TestCorruptLabel() {
+	data := testvolume.Make()
+	data[rmxLabelOffset+24] = 10 // fnode size
+	r := loadBytes(data)
+
+	_, err := r.GetRootDirectory()
+	var corruptErr *CorruptError
+	s.Require().True(errors.As(err, &corruptErr), "%v", err)
+	s.Equal("volume label", corruptErr.What)
+}
+
+func (s *RMXImageSuite) TestTruncatedVolume() {
+	r := loadBytes(testvolume.Make()[:testFnodeBase*testGran+3*minFnodeSize])
+
+	_, err := r.GetFNode(6)
+	var corruptErr *CorruptError
+	s.True(errors.As(err, &corruptErr), "%v", err)
+	_, err = r.GetFNode(8)
+	s.Error(err)
+}
+
+func (s *RMXImageSuite) TestErrors() {
+	r := loadBytes(testvolume.Make())
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+
+	_, err = r.Lookup(nil, "missing.txt")
+	s.ErrorIs(err, ErrNotFound)
+	_, err = r.Lookup(nil, "hello.txt/x")
+	s.ErrorIs(err, ErrNotDirectory)
+	_, err = r.Mkdir(root, "HELLO.TXT")
+	s.ErrorIs(err, ErrExists)
+	_, err = r.PutFile(root, "big.txt", make([]byte, testBlocks*testGran), false)
+	s.ErrorIs(err, ErrVolumeFull)
+
+	// leave only every other block free
+	volMap, err := r.GetVolMap()
+	s.Require().NoError(err)
+	for i := testFree; i < testBlocks; i += 2 {
+		volMap.SetAlloc(i, true)
+	}
+	_, err = r.PutFile(root, "scattered.txt", make([]byte, 9*testGran), false)
+	s.ErrorIs(err, ErrTooManyExtents)
+
+	// the failed puts did not keep their FNodes, so two are free
+	for _, name := range []string{"a", "b"} {
+		_, err = r.Mkdir(root, name)
+		s.Require().NoError(err)
+	}
+	_, err = r.Mkdir(root, "c")
+	s.ErrorIs(err, ErrNoFreeFNode)
+}
+
+func (s *RMXImageSuite) TestCheck() {
+	r := loadBytes(testvolume.Make())
+	s.Empty(r.Check())
+
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	_, err = r.PutFile(root, "new.txt", []byte("new data"), false)
+	s.Require().NoError(err)
+	s.Empty(r.Check())
+}
+
+func (s *RMXImageSuite) TestCheckFindings() {
+	data := testvolume.Make()
+	// mark block 19, used by hello.txt, free and block 20 allocated
+	data[testVolMap*testGran+2] = 0xF8
+	data[testVolMap*testGran+2] &^= 0x10
+	r := loadBytes(data)
+
+	findings := r.Check()
+	s.Require().Len(findings, 2)
+	s.Equal(Finding{Severity: SeverityError, Kind: KindFreeBlock, FNode: -1, Block: testHello,
+		Message: "block is marked free in the VolMap but is used by FNode 7"}, findings[0])
+	s.Equal(KindLostBlock, findings[1].Kind)
+	s.Equal(SeverityWarning, findings[1].Severity)
+	s.Equal(testFree, findings[1].Block)
+	s.True(HasErrors(findings))
+	s.False(HasErrors(findings[1:]))
+}
+
+func (s *RMXImageSuite) TestCheckUnreadableFile() {
+	// a TotalSize beyond the blocks of the file
+	data := testvolume.Make()
+	data[testFnodeBase*testGran+testHelloFNode*minFnodeSize+19] = 0xFF
+	r := loadBytes(data)
+
+	findings := r.Check()
+	s.Require().NotEmpty(findings)
+	s.Equal(KindFile, findings[0].Kind)
+	s.Equal(testHelloFNode, findings[0].FNode)
+	s.Equal("/hello.txt", findings[0].Path)
+}
+
+func (s *RMXImageSuite) TestCheckBadPointer() {
+	data := testvolume.Make()
+	data[testFnodeBase*testGran+testHelloFNode*minFnodeSize+28] = 0xFF
+	r := loadBytes(data)
+
+	findings := r.Check()
+	s.Require().NotEmpty(findings)
+	s.Equal(KindPointer, findings[0].Kind)
+	s.Equal(testHelloFNode, findings[0].FNode)
+	s.Equal("/hello.txt", findings[0].Path)
+}
+
+// kinds returns the kinds of findings.
+func kinds(findings []Finding) []string {
+	k := []string{}
+	for _, f := range findings {
+		k = append(k, f.Kind)
+	}
+	return k
+}
+
+func (s *RMXImageSuite) TestCheckDirectories() {
+	r := loadBytes(testvolume.Make())
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	sub, err := r.Mkdir(root, "sub")
+	s.Require().NoError(err)
+
+	rootList, err := r.GetDirectory(root)
+	s.Require().NoError(err)
+	_, err = rootList.AddEntry(testHelloFNode, "HELLO.TXT")
+	s.Require().NoError(err)
+	s.Require().NoError(rootList.Update())
+	subList, err := r.GetDirectory(sub)
+	s.Require().NoError(err)
+	_, err = subList.AddEntry(6, "loop")
+	s.Require().NoError(err)
+	s.Require().NoError(subList.Update())
+
+	findings := r.Check()
+	s.ElementsMatch([]string{KindCycle, KindDuplicate, KindMultiLink}, kinds(findings), "%v", findings)
+}
+
+func (s *RMXImageSuite) TestCheckFNodeFields() {
+	r := loadBytes(testvolume.Make())
+	fnode, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	fnode.Parent = 3
+	fnode.FType = 77
+	fnode.ThisSize = 2 * testGran
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	fnode, err = r.GetFNode(1)
+	s.Require().NoError(err)
+	fnode.FType = TypeData
+	s.Require().NoError(r.PutFNode(1, fnode))
+
+	findings := r.Check()
+	s.ElementsMatch([]string{KindType, KindParent, KindSize, KindSystem}, kinds(findings), "%v", findings)
+}
+
+func (s *RMXImageSuite) TestCheckIsoLabel() {
+	data := testvolume.Make()
+	data[isoLabelOffset+76] = 'x'
+	findings := loadBytes(data).Check()
+	s.Equal([]string{KindIsoLabel}, kinds(findings), "%v", findings)
+}
+
+func (s *RMXImageSuite) TestCheckLongFile() {
+	// make hello.txt a long file, with its one block listed in indirect block 20
+	data := testvolume.Make()
+	data[testVolMap*testGran+2] &^= 0x10
+	copy(data[testFree*testGran:], []byte{1, testHello, 0, 0})
+	r := loadBytes(data)
+	fnode, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	fnode.Flags |= LongFile
+	fnode.Pointers[0] = Pointer{NumBlocks: 1, BlockPointer: testFree}
+	fnode.TotalBlocks = 2
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	s.Empty(r.Check())
+
+	fnode.TotalBlocks = 5
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	findings := r.Check()
+	s.Require().NotEmpty(findings)
+	s.Equal(KindIndirect, findings[0].Kind)
+
+	fnode.TotalBlocks = 2
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	s.Require().NoError(r.writeRange(testFree*testGran, []byte{1, 0, 4, 0}))
+	findings = r.Check()
+	s.Require().NotEmpty(findings)
+	s.Equal(KindPointer, findings[0].Kind)
+	s.Equal("blocks 1024-1024, listed in indirect block 20, lie beyond the end of the volume (64 blocks)", findings[0].Message)
+
+	// with a file granularity of 2 the indirect block runs on into block 21
+	fnode.Gran = 2
+	s.Require().NoError(r.PutFNode(testHelloFNode, fnode))
+	s.Require().NoError(r.writeRange(testFree*testGran, make([]byte, 4)))
+	s.Require().NoError(r.writeRange((testFree+1)*testGran, []byte{1, 0, 4, 0}))
+	findings = r.Check()
+	s.Require().NotEmpty(findings)
+	s.Equal("blocks 1024-1024, listed in indirect block 20, lie beyond the end of the volume (64 blocks)", findings[0].Message)
+}
+
+func (s *RMXImageSuite) TestOrphans() {
+	r := loadBytes(testvolume.Make())
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	sub, err := r.Mkdir(root, "sub")
+	s.Require().NoError(err)
+
+	// lose the entries of sub, which knows its parent, and of hello.txt, which
+	// does not
+	rootList, err := r.GetDirectory(root)
+	s.Require().NoError(err)
+	s.Require().NoError(rootList.Unlink("sub"))
+	s.Require().NoError(rootList.Unlink("hello.txt"))
+	s.Require().NoError(rootList.Update())
+	hello, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	hello.Parent = 3
+	s.Require().NoError(hello.Update())
+
+	orphans, err := r.Orphans()
+	s.Require().NoError(err)
+	s.Require().Len(orphans, 2)
+	s.Equal(testHelloFNode, orphans[0].Number)
+	s.Equal(sub.Number, orphans[1].Number)
+
+	reattached, err := r.ReattachOrphans()
+	s.Require().NoError(err)
+	s.Require().Len(reattached, 2)
+	s.Equal("/LOST+FOUND/FNODE7", reattached[0].Path)
+	s.Equal(fmt.Sprintf("/FNODE%d", sub.Number), reattached[1].Path)
+
+	fnode, err := r.Lookup(nil, "LOST+FOUND/FNODE7")
+	s.Require().NoError(err)
+	data, err := r.ReadFile(fnode)
+	s.Require().NoError(err)
+	s.Equal("hello", string(data))
+	orphans, err = r.Orphans()
+	s.Require().NoError(err)
+	s.Empty(orphans)
+	s.Empty(r.Check())
+}
+
+func (s *RMXImageSuite) TestRebuildDirectory() {
+	data := testvolume.Make()
+	// overwrite the entries of R?SPACEMAP and R?FNODEMAP, and leave the rest
+	for i := testRoot * testGran; i < testRoot*testGran+32; i++ {
+		data[i] = 0xFF
+	}
+	r := loadBytes(data)
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	sub, err := r.Mkdir(root, "sub")
+	s.Require().NoError(err)
+	_, err = r.PutFile(sub, "a.txt", []byte("a"), false)
+	s.Require().NoError(err)
+
+	entries, err := r.RebuildDirectory(root)
+	s.Require().NoError(err)
+	s.Equal([]RebuiltEntry{
+		{DirEntry{1, "R?SPACEMAP"}, false},
+		{DirEntry{2, "R?FNODEMAP"}, false},
+		{DirEntry{4, "R?BADBLOCKMAP"}, true},
+		{DirEntry{5, "R?VOLUMELABEL"}, true},
+		{DirEntry{testHelloFNode, "hello.txt"}, true},
+		{DirEntry{uint16(sub.Number), "sub"}, true},
+	}, entries)
+
+	// lose everything in sub
+	sub, err = r.Lookup(nil, "sub")
+	s.Require().NoError(err)
+	_, err = r.ReadFile(sub)
+	s.Require().NoError(err)
+	s.Require().NoError(sub.UpdateDataInPlace(make([]byte, 16)))
+	_, err = r.Lookup(nil, "sub/a.txt")
+	s.ErrorIs(err, ErrNotFound)
+
+	entries, err = r.RebuildDirectory(sub)
+	s.Require().NoError(err)
+	s.Require().Len(entries, 1)
+	s.False(entries[0].Recovered)
+	fnode, err := r.Lookup(nil, fmt.Sprintf("sub/FNODE%d", entries[0].FNode))
+	s.Require().NoError(err)
+	content, err := r.ReadFile(fnode)
+	s.Require().NoError(err)
+	s.Equal("a", string(content))
+	s.Empty(r.Check())
+}
+
+func (s *RMXImageSuite) TestDataBlocks() {
+	r := loadBytes(testvolume.Make())
+	hello, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Equal([]int{testHello}, r.dataBlocks(hello, testGran))
+	s.Nil(hello.AllDataBlocks, "the data is not read")
+
+	// a long file, with one indirect block past the end of the volume and the
+	// entries after TotalBlocks ignored
+	s.Require().NoError(r.writeRange(testFree*testGran, []byte{2, testHello, 0, 0, 1, 40, 0, 0}))
+	hello.Flags |= LongFile
+	hello.Pointers[0] = Pointer{NumBlocks: 1, BlockPointer: 1000}
+	hello.Pointers[1] = Pointer{NumBlocks: 1, BlockPointer: testFree}
+	hello.TotalBlocks = 4
+	s.Equal([]int{testHello, testHello + 1}, r.dataBlocks(hello, testGran))
+}
+
+func (s *RMXImageSuite) TestDecodeIndirect() {
+	s.Equal([]IndirectEntry{
+		{Offset: 0, NumBlocks: 2, BlockPointer: 0x030201, Raw: []byte{2, 1, 2, 3}},
+		{Offset: 8, NumBlocks: 1, BlockPointer: testHello, Raw: []byte{1, testHello, 0, 0}},
+	}, decodeIndirect([]byte{2, 1, 2, 3, 0, 9, 9, 9, 1, testHello, 0, 0, 7, 1}))
+	s.Empty(decodeIndirect(make([]byte, 3)))
+}
+
+func (s *RMXImageSuite) TestStats() {
+	r := loadBytes(testvolume.Make())
+	stats, err := r.Stats()
+	s.Require().NoError(err)
+	s.Equal(testBlocks, stats.Blocks)
+	s.Equal(testBlocks-testFree, stats.FreeBlocks)
+	s.Equal([]int{testBlocks - testFree}, stats.FreeExtents)
+	s.Equal(testBlocks-testFree, stats.LargestFree())
+	s.Equal(2, stats.FreeFNodes)
+
+	s.Require().Len(stats.Files, 8)
+	s.Empty(stats.Skipped)
+	s.Equal(0, stats.Files[0].FNode)
+	s.Equal("", stats.Files[0].Dir)
+	s.Equal(7, stats.Files[0].Blocks)
+	s.Equal(1, stats.Files[0].Extents)
+	hello := stats.Files[len(stats.Files)-1]
+	s.Equal("/hello.txt", hello.Path)
+	s.Equal("/", hello.Dir)
+	s.Equal(1, hello.Extents)
+	s.Equal(testGran-5, hello.Slack)
+	s.False(hello.Long)
+
+	s.Equal(2, countExtents([]int{3, 4, 5, 9}))
+	s.Equal(0, countExtents(nil))
+}
+
+func (s *RMXImageSuite) TestReadableFNodes() {
+	// hello.txt points beyond the end of the volume
+	r := loadBytes(testvolume.Make())
+	hello, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	hello.Pointers[0].BlockPointer = 1000
+	s.Require().NoError(r.PutFNode(testHelloFNode, hello))
+
+	fnodes, paths, skipped, err := r.readableFNodes()
+	s.Require().NoError(err)
+	s.Len(fnodes, 7)
+	s.Equal("/hello.txt", paths[testHelloFNode])
+	s.Require().Len(skipped, 1)
+	s.Equal(testHelloFNode, skipped[0].FNode)
+	s.Equal("/hello.txt", skipped[0].Path)
+	s.Contains(skipped[0].Reason, "beyond the end of the volume")
+
+	// every report leaves it out
+	stats, err := r.Stats()
+	s.Require().NoError(err)
+	s.Len(stats.Files, 7)
+	s.Equal(skipped, stats.Skipped)
+	blocks, err := r.BlockMap()
+	s.Require().NoError(err)
+	s.Equal(BlockUse{OwnerLost, -1}, blocks[testHello])
+	index, err := r.BlockIndex()
+	s.Require().NoError(err)
+	s.NotContains(index, testHello)
+}
+
+func (s *RMXImageSuite) TestBlockMap() {
+	data := testvolume.Make()
+	data[testBadBlocks*testGran+30/8] &^= 1 << (30 % 8)
+	r := loadBytes(data)
+
+	// cross-link hello.txt with the root directory
+	hello, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	hello.Pointers[0].BlockPointer = testRoot
+	s.Require().NoError(hello.Update())
+
+	blocks, err := r.BlockMap()
+	s.Require().NoError(err)
+	s.Require().Len(blocks, testBlocks)
+	s.Equal(BlockUse{OwnerSystem, 5}, blocks[0])
+	s.Equal(BlockUse{OwnerSystem, 0}, blocks[testFnodeBase])
+	s.Equal(BlockUse{OwnerSystem, 1}, blocks[testVolMap])
+	s.Equal(BlockUse{OwnerShared, 6}, blocks[testRoot])
+	s.Equal(BlockUse{OwnerLost, -1}, blocks[testHello])
+	s.Equal(BlockUse{OwnerFree, -1}, blocks[testFree])
+	s.Equal(OwnerBad, blocks[30].Owner)
+	s.Equal("Cross-linked", OwnerShared.String())
+}
+
+func (s *RMXImageSuite) TestBlockIndex() {
+	r := loadBytes(testvolume.Make())
+	hello, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	hello.Pointers[1] = Pointer{NumBlocks: 1, BlockPointer: testRoot}
+	hello.TotalBlocks, hello.ThisSize = 2, 2*testGran
+	s.Require().NoError(hello.Update())
+
+	index, err := r.BlockIndex()
+	s.Require().NoError(err)
+	s.Equal([]Ownership{{FNode: 5, Path: "/R?VOLUMELABEL", Offset: 3 * testGran}}, index[3])
+	s.Equal([]Ownership{{FNode: 0, Path: "", Offset: 0}}, index[testFnodeBase])
+	s.Equal([]Ownership{
+		{FNode: 6, Path: "/", Offset: 0},
+		{FNode: testHelloFNode, Path: "/hello.txt", Offset: testGran},
+	}, index[testRoot])
+	s.NotContains(index, testFree)
+
+	s.Equal("RMX volume label", LabelAt(rmxLabelOffset))
+	s.Equal("ISO volume label", LabelAt(labelsEnd-1))
+	s.Equal("", LabelAt(0))
+}
+
+func (s *RMXImageSuite) TestBlocks() {
+	r := loadBytes(testvolume.Make())
+	hello, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	s.Require().NoError(r.WriteBlocks(testHello, []byte("HELLO")))
+	data, err := r.ReadBlocks(testHello, 1)
+	s.Require().NoError(err)
+	s.Len(data, testGran)
+	s.Equal("HELLO", string(data[:5]))
+	data, err = r.ReadFile(hello)
+	s.Require().NoError(err)
+	s.Equal("HELLO", string(data))
+
+	_, err = r.ReadBlocks(testBlocks-1, 2)
+	s.Error(err)
+	s.Error(r.WriteBlocks(testBlocks, []byte{0}))
+
+	notes, err := r.Annotate(testRoot, 1)
+	s.Require().NoError(err)
+	s.Require().Len(notes, 5)
+	s.Equal(Annotation{64, 16, `directory entry of FNode 6: FNode 7, "hello.txt"`}, notes[4])
+
+	notes, err = r.Annotate(testFnodeBase, 2)
+	s.Require().NoError(err)
+	s.Require().Len(notes, 2)
+	s.Equal("FNode 0: FNode, 870 bytes in 7 blocks, parent 6", notes[0].Text)
+	s.Equal(minFnodeSize, notes[1].Offset)
+
+	notes, err = r.Annotate(3, 5)
+	s.Require().NoError(err)
+	s.Require().Len(notes, 2)
+	s.Equal(0, notes[0].Offset)
+	s.Contains(notes[0].Text, "RMX volume label")
+	s.Equal(isoLabelOffset-3*testGran, notes[1].Offset)
+}
+
+func (s *RMXImageSuite) TestLayout() {
+	data := testvolume.Make()
+	copy(data[testFree*testGran:], []byte{1, testHello, 0, 0, 0, 0, 0, 0, 2, 0x10, 0x01, 0})
+	r := loadBytes(data)
+	fnode, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+	_, err = r.IndirectEntries(fnode)
+	s.Error(err)
+
+	fnode.Flags |= LongFile
+	fnode.Pointers[0] = Pointer{NumBlocks: 1, BlockPointer: testFree}
+	entries, err := r.IndirectEntries(fnode)
+	s.Require().NoError(err)
+	s.Equal([]IndirectEntry{
+		{Block: testFree, Offset: 0, NumBlocks: 1, BlockPointer: testHello, Raw: []byte{1, testHello, 0, 0}},
+		{Block: testFree, Offset: 8, NumBlocks: 2, BlockPointer: 0x110, Raw: []byte{2, 0x10, 0x01, 0}},
+	}, entries)
+
+	raw, err := r.RawFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Len(raw, minFnodeSize)
+	values := map[string]string{}
+	for _, field := range FNodeFields {
+		values[field.Name] = field.Value(raw)
+	}
+	s.Equal("5", values["TotalSize"])
+	s.Equal("19", values["Pointer[0].BlockPointer"])
+	s.Equal("6", values["Parent"])
+
+	raw, err = r.RawRmxLabel()
+	s.Require().NoError(err)
+	s.Equal(`"TEST"`, RmxLabelFields[0].Value(raw))
+	raw, err = r.RawIsoLabel()
+	s.Require().NoError(err)
+	s.Equal(`"VOL"`, IsoLabelFields[0].Value(raw))
+	s.Equal("(missing)", IsoLabelFields[0].Value(raw[:2]))
+}
+
+func (s *RMXImageSuite) TestSetField() {
+	r := loadBytes(testvolume.Make())
+	fnode, err := r.GetFNode(testHelloFNode)
+	s.Require().NoError(err)
+
+	s.Require().NoError(fnode.SetField("flags", "+long"))
+	s.Equal(uint16(Allocated|Primary|LongFile), fnode.Flags)
+	s.Require().NoError(fnode.SetField("Flags", "-LONG,-primary"))
+	s.Equal(uint16(Allocated), fnode.Flags)
+	s.Require().NoError(fnode.SetField("Flags", "alloc|nodelete"))
+	s.Equal(uint16(Allocated|NoDelete), fnode.Flags)
+	s.Require().NoError(fnode.SetField("Flags", "0x5"))
+	s.Equal(uint16(5), fnode.Flags)
+
+	s.Require().NoError(fnode.SetField("FType", "Directory"))
+	s.Equal(uint8(TypeDirectory), fnode.FType)
+	s.Require().NoError(fnode.SetField("Pointer[2].BlockPointer", "0x123456"))
+	s.Equal(Pointer{BlockPointer: 0x123456}, fnode.Pointers[2])
+	s.Require().NoError(fnode.SetField("Accessor[1].Id", "65535"))
+	s.Equal(uint16(65535), fnode.Accessor[1].Id)
+	s.Require().NoError(fnode.SetField("TotalSize", "100"))
+	s.Equal(uint32(100), fnode.TotalSize)
+	s.Equal(testHelloFNode, fnode.Number)
+
+	s.Error(fnode.SetField("Gran", "256"))
+	s.Error(fnode.SetField("Flags", "+bogus"))
+	s.Error(fnode.SetField("Flags", "alloc|+long"))
+	s.Error(fnode.SetField("Name", "x"))
+}
+
+func (s *RMXImageSuite) TestSetLabelField() {
+	r := loadBytes(testvolume.Make())
+	s.Require().NoError(r.SetLabelField("Name", "SCRATCHVOL", false))
+	s.ErrorContains(r.SetLabelField("interleave", "12", false), "holds files laid out with interleave 1")
+	s.Require().NoError(r.SetLabelField("interleave", "1", false))
+	s.Require().NoError(r.SetLabelField("interleave", "12", true))
+	s.Require().NoError(r.SetLabelField("fill", "229", false))
+	s.Require().NoError(r.Flush())
+
+	r = loadBytes(volumeBytes(r))
+	vl, err := r.GetVolumeLabel()
+	s.Require().NoError(err)
+	s.Equal("SCRATCHVOL", vl.Name)
+	s.Equal(uint8(229), vl.Fill)
+	ivl, err := r.GetIsoVolumeLabel()
+	s.Require().NoError(err)
+	s.Equal("SCRATC", ivl.Name)
+	s.Equal(12, ivl.Interleave)
+
+	s.Require().NoError(r.SetLabelField("isoname", "AB", false))
+	ivl, err = r.GetIsoVolumeLabel()
+	s.Require().NoError(err)
+	s.Equal("AB", ivl.Name)
+	s.Empty(r.Check())
+
+	s.ErrorContains(r.SetLabelField("Gran", "512", false), "cannot be changed")
+	s.Error(r.SetLabelField("name", "ELEVENCHARS", false))
+	s.Error(r.SetLabelField("isoname", "SEVENCH", false))
+	s.Error(r.SetLabelField("side", "3", false))
+	s.Error(r.SetLabelField("colour", "red", false))
+
+	data := volumeBytes(r)
+	copy(data[isoLabelOffset:], "XXX")
+	r = loadBytes(data)
+	s.ErrorContains(r.SetLabelField("side", "1", false), "there is none")
+	s.NoError(r.SetLabelField("name", "PLAIN", false))
+
+	// an empty volume can be laid out afresh
+	r = loadBytes(testvolume.Make())
+	hello, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	s.Require().NoError(r.DeleteFNode(hello))
+	s.NoError(r.SetLabelField("interleave", "5", false))
+}
+
+func (s *RMXImageSuite) TestScrub() {
+	data := testvolume.Make()
+	copy(data[30*testGran:], "secret")
+	r := loadBytes(data)
+	s.Require().NoError(r.SetLabelField("fill", "229", false))
+
+	r.SetScrub(true)
+	hello, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	s.Require().NoError(r.DeleteFNode(hello))
+	s.Require().NoError(r.Flush())
+	data = volumeBytes(r)
+	s.Equal(make([]byte, testGran), data[testHello*testGran:testFree*testGran])
+	s.NotContains(string(data), "hello")
+	s.Contains(string(data), "secret")
+
+	// an entry unlinked without scrubbing keeps its name
+	r.SetScrub(false)
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	sub, err := r.Mkdir(root, "sub")
+	s.Require().NoError(err)
+	s.Require().NoError(r.DeleteFNode(sub))
+	s.Require().NoError(r.Flush())
+	s.Contains(string(volumeBytes(r)), "sub")
+
+	result, err := r.Scrub()
+	s.Require().NoError(err)
+	s.Require().NoError(r.Flush())
+	s.Equal(&ScrubResult{Blocks: testBlocks - testFree + 1, Slots: 1, FNodes: 1}, result)
+	data = volumeBytes(r)
+	s.NotContains(string(data), "secret")
+	s.NotContains(string(data), "sub")
+	s.Equal(bytes.Repeat([]byte{229}, testGran), data[30*testGran:31*testGran])
+	raw, err := r.RawFNode(testHelloFNode)
+	s.Require().NoError(err)
+	s.Equal(make([]byte, minFnodeSize), raw)
+	s.Empty(r.Check())
+}
+
+func (s *RMXImageSuite) TestConvert() {
+	dir := s.T().TempDir()
+	volume := testvolume.Make()
+	ivl := &IsoVolumeLabel{}
+	s.Require().NoError(ivl.Deserialize(volume[isoLabelOffset:]))
+	ivl.Interleave = 3
+	ivl.Serialize(volume[isoLabelOffset:])
+
+	// an interleaved, skewed, head-major dump whose interleave is in the label
+	from, err := geometry.Parse("cyls=4,heads=2,secsize=128,sectors=8,interleave=iso,t0interleave=1,skew=1,headmajor=1")
+	s.Require().NoError(err)
+	to, err := geometry.Parse("cyls=4,heads=2,secsize=256,sectors=4")
+	s.Require().NoError(err)
+	resolved := from.WithISOInterleave(3)
+	raw := make([]byte, resolved.RawSize())
+	s.Require().NoError(resolved.Write(volume, resolved.RawReader(raw), resolved.RawWriter(raw)))
+	s.NotEqual(volume, raw)
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "a.img"), raw, 0644))
+
+	r := NewRMXImage()
+	r.SetGeometry(from)
+	s.Require().NoError(r.Load(filepath.Join(dir, "a.img"), false))
+	s.Equal(3, r.GetGeometry().Track.Interleave)
+	s.Equal(volume, volumeBytes(r))
+	s.Require().NoError(r.SaveAs(filepath.Join(dir, "b.img"), "raw", to))
+	plain, err := os.ReadFile(filepath.Join(dir, "b.img"))
+	s.Require().NoError(err)
+	s.Equal(volume, plain)
+
+	// and back again
+	r = NewRMXImage()
+	r.SetGeometry(to)
+	s.Require().NoError(r.Load(filepath.Join(dir, "b.img"), false))
+	s.Equal(volume, volumeBytes(r))
+	s.Require().NoError(r.SaveAs(filepath.Join(dir, "c.img"), "raw", resolved))
+	again, err := os.ReadFile(filepath.Join(dir, "c.img"))
+	s.Require().NoError(err)
+	s.Equal(raw, again)
+
+	// a new image needs an explicit interleave
+	s.Error(r.SaveAs(filepath.Join(dir, "d.img"), "raw", from))
+}
+
+func (s *RMXImageSuite) TestISOInterleave() {
+	dir := s.T().TempDir()
+	g, err := geometry.Parse("cyls=4,heads=2,secsize=128,sectors=8,interleave=iso,t0interleave=1")
+	s.Require().NoError(err)
+	volume := testvolume.Make()
+	ivl := &IsoVolumeLabel{}
+	s.Require().NoError(ivl.Deserialize(volume[isoLabelOffset:]))
+	ivl.Interleave = 5
+	ivl.Serialize(volume[isoLabelOffset:])
+
+	// the label is found in either byte order
+	for _, swap := range []bool{false, true} {
+		data := append([]byte{}, volume...)
+		if swap {
+			swapBytes(data)
+		}
+		resolved := g.WithISOInterleave(5)
+		raw := make([]byte, resolved.RawSize())
+		s.Require().NoError(resolved.Write(data, resolved.RawReader(raw), resolved.RawWriter(raw)))
+		fileName := filepath.Join(dir, "disk.img")
+		s.Require().NoError(os.WriteFile(fileName, raw, 0644))
+
+		r := NewRMXImage()
+		r.SetGeometry(g)
+		s.Require().NoError(r.Load(fileName, false))
+		s.Equal(5, r.GetGeometry().Track.Interleave)
+		s.Equal(1, r.GetGeometry().Format(0, 0).Interleave)
+		s.Equal(data, volumeBytes(r))
+	}
+
+	s.Require().NoError(os.WriteFile(filepath.Join(dir, "blank.img"), make([]byte, g.RawSize()), 0644))
+	r := NewRMXImage()
+	r.SetGeometry(g)
+	s.ErrorContains(r.Load(filepath.Join(dir, "blank.img"), false), "no usable interleave")
+}
+
+func (s *RMXImageSuite) TestDetectByteSwap() {
+	volume := testvolume.Make()
+	swapped := append([]byte{}, volume...)
+	swapBytes(swapped)
+	s.Equal(3, labelScore(volume))
+	s.Equal(0, labelScore(swapped))
+	s.False(detectByteSwap(volume))
+	s.True(detectByteSwap(swapped))
+
+	// the iRMX label counts for more than the ISO label
+	noIso := append([]byte{}, volume...)
+	copy(noIso[isoLabelOffset:], "XXX")
+	s.Equal(2, labelScore(noIso))
+	s.False(detectByteSwap(noIso))
+	noRmx := append([]byte{}, volume...)
+	copy(noRmx[rmxLabelOffset+12:], []byte{0, 0}) // granularity
+	s.Equal(1, labelScore(noRmx))
+	copy(noRmx[isoLabelOffset:], "XXX")
+	s.False(detectByteSwap(noRmx))
+	s.False(detectByteSwap(swapped[:labelsEnd-1]))
+
+	fileName := filepath.Join(s.T().TempDir(), "swapped.img")
+	s.Require().NoError(os.WriteFile(fileName, swapped, 0644))
+	r := NewRMXImage()
+	s.Require().NoError(r.Load(fileName, false))
+	s.True(r.IsByteSwapped())
+	s.True(r.IsByteSwapDetected())
+	s.NoError(r.CheckVolumeLabel())
+	fnode, err := r.Lookup(nil, "hello.txt")
+	s.Require().NoError(err)
+	data, err := r.ReadFile(fnode)
+	s.Require().NoError(err)
+	s.Equal("hello", string(data))
+
+	// an explicit byte order is used as given
+	r = NewRMXImage()
+	s.Require().NoError(r.Load(fileName, true))
+	s.True(r.IsByteSwapped())
+	s.False(r.IsByteSwapDetected())
+	r = NewRMXImage()
+	r.SetDetectByteOrder(false)
+	s.Require().NoError(r.Load(fileName, false))
+	s.False(r.IsByteSwapped())
+	s.Error(r.CheckVolumeLabel())
+}
+
+// makeDisk returns a disk image holding two copies of the test volume, the second
+// one named SECOND and byte swapped, surrounded by other data, together with
+// the offsets of the volumes.
+func makeDisk() ([]byte, int, int) {
+	first := 1024
+	second := first + testBlocks*testGran + 640
+	disk := bytes.Repeat([]byte{0x11}, second+testBlocks*testGran+256)
+	copy(disk[first:], testvolume.Make())
+
+	volume := testvolume.Make()
+	vl := &RmxVolumeLabel{}
+	_ = vl.Deserialize(volume[rmxLabelOffset:])
+	vl.Name = "SECOND"
+	vl.Serialize(volume[rmxLabelOffset:])
+	swapBytes(volume)
+	copy(disk[second:], volume)
+	return disk, first, second
+}
+
+func (s *RMXImageSuite) TestScanVolumes() {
+	disk, first, second := makeDisk()
+	s.Equal([]Volume{
+		{Offset: first, Size: testBlocks * testGran, Name: "TEST"},
+		{Offset: second, Size: testBlocks * testGran, Name: "SECOND", Swapped: true},
+	}, ScanVolumes(disk))
+	s.Empty(ScanVolumes(disk[:first+labelsEnd-1]))
+
+	r := NewRMXImage()
+	r.container = loadBytes(disk).container
+	s.Equal(ScanVolumes(disk), r.ScanVolumes())
+}
+
+func (s *RMXImageSuite) TestPartition() {
+	disk, first, second := makeDisk()
+	fileName := filepath.Join(s.T().TempDir(), "disk.img")
+	s.Require().NoError(os.WriteFile(fileName, disk, 0644))
+
+	r := NewRMXImage()
+	r.SetPartition(1)
+	s.Require().NoError(r.Load(fileName, false))
+	s.Equal(first, r.GetOffset())
+	s.Equal(testBlocks*testGran, r.Size())
+	root, err := r.GetRootDirectory()
+	s.Require().NoError(err)
+	_, err = r.PutFile(root, "new.txt", []byte("new data"), false)
+	s.Require().NoError(err)
+	s.Require().NoError(r.Save())
+	s.Empty(r.Check())
+
+	// only the volume changed
+	saved, err := os.ReadFile(fileName)
+	s.Require().NoError(err)
+	s.Equal(len(disk), len(saved))
+	s.Equal(disk[:first], saved[:first])
+	s.NotEqual(disk[first:first+testBlocks*testGran], saved[first:first+testBlocks*testGran])
+	s.Equal(disk[first+testBlocks*testGran:], saved[first+testBlocks*testGran:])
+
+	// the second volume, by partition and by offset
+	for _, byOffset := range []bool{false, true} {
+		r = NewRMXImage()
+		if byOffset {
+			r.SetOffset(second)
+		} else {
+			r.SetPartition(2)
+		}
+		s.Require().NoError(r.Load(fileName, false))
+		s.Equal(second, r.GetOffset())
+		s.True(r.IsByteSwapDetected())
+		vl, err := r.GetVolumeLabel()
+		s.Require().NoError(err)
+		s.Equal("SECOND", vl.Name)
+		_, err = r.Lookup(nil, "new.txt")
+		s.ErrorIs(err, ErrNotFound)
+	}
+
+	r = NewRMXImage()
+	r.SetPartition(3)
+	s.ErrorContains(r.Load(fileName, false), "partition 3 not found, the image holds 2 volumes")
+	r = NewRMXImage()
+	r.SetOffset(len(disk))
+	s.ErrorContains(r.Load(fileName, false), "outside of the image")
+	r = NewRMXImage()
+	r.SetOffset(second + 1)
+	r.SetDetectByteOrder(false)
+	s.ErrorContains(r.Load(fileName, true), "odd offset")
+}
+
+func TestRMXImageSuite(t *testing.T) {
+	suite.Run(t, new(RMXImageSuite))
+}
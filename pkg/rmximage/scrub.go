@@ -0,0 +1,137 @@
+package rmximage
+
+import "bytes"
+
+// ScrubResult counts what Scrub overwrote.
+type ScrubResult struct {
+	Blocks int // free blocks
+	Slots  int // unused directory entries that still held a name
+	FNodes int // free fnodes that were not already zero
+}
+
+// fillBlocks overwrites blocks with fill.
+func (r *RMXImage) fillBlocks(blocks []int, fill byte) error {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return err
+	}
+	gran := int(vl.Gran)
+	data := bytes.Repeat([]byte{fill}, gran)
+	for _, b := range blocks {
+		err = r.writeRange(b*gran, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scrub overwrites what is left of deleted files: every free block with the
+// Fill byte of the volume label, and the names in unused directory entries, the
+// space past the end of each directory and every free fnode with zeros. Only
+// blocks and fnodes that are free in the maps and used by nothing that can be
+// reached are touched, so a damaged volume loses nothing chkdsk could recover.
+// Bad blocks are left alone.
+func (r *RMXImage) Scrub() (*ScrubResult, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := r.BlockMap()
+	if err != nil {
+		return nil, err
+	}
+	fnodes, paths, _, err := r.readableFNodes()
+	if err != nil {
+		return nil, err
+	}
+	result := &ScrubResult{}
+
+	// the VolMap may count blocks past the end of a short image
+	free := []int{}
+	for i, use := range blocks {
+		if use.Owner == OwnerFree && (i+1)*int(vl.Gran) <= r.size {
+			free = append(free, i)
+		}
+	}
+	err = r.fillBlocks(free, vl.Fill)
+	if err != nil {
+		return nil, err
+	}
+	result.Blocks = len(free)
+
+	gran := int(vl.Gran)
+	for _, fnode := range fnodes {
+		if !fnode.IsDirectory() {
+			continue
+		}
+		n := fnode.Number
+		dir, err := r.GetFNode(n)
+		if err != nil {
+			return nil, err
+		}
+		dirList, err := r.GetDirectory(dir)
+		if err != nil {
+			continue
+		}
+		slots := 0
+		for i := range dirList.Entries {
+			if dirList.Entries[i].FNode == 0 && dirList.Entries[i].Name != "" {
+				dirList.Entries[i].Name = ""
+				slots++
+			}
+		}
+		if slots > 0 {
+			err = dirList.Update()
+			if err != nil {
+				return nil, err
+			}
+			result.Slots += slots
+		}
+
+		// the space in the last blocks past the end of the directory
+		dir, err = r.GetFNode(n)
+		if err != nil {
+			return nil, err
+		}
+		_, err = r.ReadFile(dir)
+		if err != nil {
+			return nil, err
+		}
+		for offset := int(dir.TotalSize); offset < len(dir.AllDataBlocks)*gran; offset = (offset/gran + 1) * gran {
+			start := dir.AllDataBlocks[offset/gran]*gran + offset%gran
+			err = r.writeRange(start, make([]byte, gran-offset%gran))
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	fnodeMap, err := r.GetFNodeMap()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < int(vl.MaxFnode); i++ {
+		if _, used := paths[i]; used || fnodeMap.IsAlloc(i) {
+			continue
+		}
+		raw, err := r.RawFNode(i)
+		if err != nil {
+			return nil, err
+		}
+		fnode, err := r.GetFNode(i)
+		if err != nil {
+			return nil, err
+		}
+		if fnode.IsAllocated() || bytes.Equal(raw, make([]byte, len(raw))) {
+			continue
+		}
+		err = r.PutFNode(i, &FNode{})
+		if err != nil {
+			return nil, err
+		}
+		result.FNodes++
+	}
+	r.logger.Debug("scrubbed volume", "blocks", result.Blocks, "slots", result.Slots, "fnodes", result.FNodes)
+	return result, nil
+}
@@ -0,0 +1,128 @@
+package rmximage
+
+import (
+	"fmt"
+	"path"
+	"sort"
+)
+
+// FileStats describes how the blocks of one fnode are laid out.
+type FileStats struct {
+	FNode   int
+	Path    string // empty for the system fnodes that are not in a directory
+	Dir     string // the directory that holds the file, empty if it is in none
+	Type    int
+	Size    int // TotalSize, in bytes
+	Blocks  int // data blocks
+	Extents int // runs of contiguous data blocks
+	Long    bool
+	Slack   int // bytes allocated to the file beyond its size
+}
+
+// VolumeStats describes how the space of a volume is used.
+type VolumeStats struct {
+	Gran        int
+	Blocks      int
+	FreeBlocks  int
+	FNodes      int
+	FreeFNodes  int
+	FreeExtents []int // the length in blocks of every run of free blocks, in volume order
+	Files       []FileStats
+	Skipped     []SkippedFNode // reachable fnodes left out of Files
+}
+
+// LargestFree returns the length in blocks of the longest run of free blocks,
+// which is the largest file that can be stored contiguously.
+func (v *VolumeStats) LargestFree() int {
+	largest := 0
+	for _, n := range v.FreeExtents {
+		largest = max(largest, n)
+	}
+	return largest
+}
+
+// countExtents returns the number of runs of contiguous blocks in blocks.
+func countExtents(blocks []int) int {
+	extents := 0
+	for i, b := range blocks {
+		if i == 0 || b != blocks[i-1]+1 {
+			extents++
+		}
+	}
+	return extents
+}
+
+// Stats reports the free space of the volume and the layout of every fnode
+// that can be reached from the root directory. Fnodes that cannot be read are
+// left out; chkdsk reports them.
+func (r *RMXImage) Stats() (*VolumeStats, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	volMap, err := r.GetVolMap()
+	if err != nil {
+		return nil, err
+	}
+	fnodeMap, err := r.GetFNodeMap()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &VolumeStats{Gran: int(vl.Gran), Blocks: volMap.GetNumBits(), FNodes: fnodeMap.GetNumBits()}
+	run := 0
+	for i := 0; i < volMap.GetNumBits(); i++ {
+		if volMap.IsAlloc(i) {
+			if run > 0 {
+				stats.FreeExtents = append(stats.FreeExtents, run)
+			}
+			run = 0
+			continue
+		}
+		stats.FreeBlocks++
+		run++
+	}
+	if run > 0 {
+		stats.FreeExtents = append(stats.FreeExtents, run)
+	}
+	for i := 0; i < fnodeMap.GetNumBits(); i++ {
+		if !fnodeMap.IsAlloc(i) {
+			stats.FreeFNodes++
+		}
+	}
+
+	fnodes, paths, skipped, err := r.readableFNodes()
+	if err != nil {
+		return nil, err
+	}
+	stats.Skipped = skipped
+	for _, fnode := range fnodes {
+		fs := FileStats{
+			FNode:   fnode.Number,
+			Path:    paths[fnode.Number],
+			Type:    int(fnode.FType),
+			Size:    int(fnode.TotalSize),
+			Blocks:  len(fnode.AllDataBlocks),
+			Extents: countExtents(fnode.AllDataBlocks),
+			Long:    fnode.IsLong(),
+			Slack:   max(len(fnode.AllDataBlocks)*int(vl.Gran)-int(fnode.TotalSize), 0),
+		}
+		if fs.Path != "" && fs.Path != "/" {
+			fs.Dir = path.Dir(fs.Path)
+		}
+		stats.Files = append(stats.Files, fs)
+	}
+	sort.SliceStable(stats.Files, func(i, j int) bool {
+		return fileSortKey(stats.Files[i]) < fileSortKey(stats.Files[j])
+	})
+	return stats, nil
+}
+
+// fileSortKey puts the system fnodes that are not in a directory first, and
+// the rest in path order.
+func fileSortKey(fs FileStats) string {
+	if fs.Path == "" {
+		return fmt.Sprintf("\x00%5d", fs.FNode)
+	}
+	return fs.Path
+}
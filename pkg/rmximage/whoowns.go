@@ -0,0 +1,56 @@
+package rmximage
+
+import "sort"
+
+// Ownership records that a block belongs to an fnode.
+type Ownership struct {
+	FNode    int
+	Path     string // empty for the system fnodes that are not in a directory
+	Indirect bool   // the block is an indirect block of the fnode, not part of its data
+	Offset   int    // the byte offset of the block within the data of the fnode, or -1 if Indirect
+}
+
+// BlockIndex returns the fnodes that use each block, for every fnode that can
+// be reached from the root directory and the system fnodes. The labels are in
+// the data of the VolLabel fnode, and the fnodes in that of fnode 0. A block
+// used by more than one fnode has more than one Ownership; a block used by none
+// is absent. Fnodes whose pointers cannot be followed are left out.
+func (r *RMXImage) BlockIndex() (map[int][]Ownership, error) {
+	vl, err := r.GetVolumeLabel()
+	if err != nil {
+		return nil, err
+	}
+	fnodes, paths, _, err := r.readableFNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	index := map[int][]Ownership{}
+	for _, fnode := range fnodes {
+		n, pathName := fnode.Number, paths[fnode.Number]
+		for _, b := range fnode.AllIndirectBlocks {
+			index[b] = append(index[b], Ownership{FNode: n, Path: pathName, Indirect: true, Offset: -1})
+		}
+		for i, b := range fnode.AllDataBlocks {
+			index[b] = append(index[b], Ownership{FNode: n, Path: pathName, Offset: i * int(vl.Gran)})
+		}
+	}
+	for _, owners := range index {
+		sort.Slice(owners, func(i, j int) bool {
+			return owners[i].FNode < owners[j].FNode
+		})
+	}
+	return index, nil
+}
+
+// LabelAt returns the name of the volume label that holds the byte at offset in
+// the volume, or an empty string if it is in neither label.
+func LabelAt(offset int) string {
+	switch {
+	case offset >= rmxLabelOffset && offset < rmxLabelOffset+128:
+		return "RMX volume label"
+	case offset >= isoLabelOffset && offset < labelsEnd:
+		return "ISO volume label"
+	}
+	return ""
+}
@@ -0,0 +1,337 @@
+package td0
+
+/* LZHUF compression, as used by TeleDisk "advanced compression"
+ *
+ * This is the LZSS plus adaptive Huffman scheme from Haruyasu Yoshizaki's
+ * lzhuf.c (based on Haruhiko Okumura's LZARI), which TeleDisk 2.x uses for
+ * everything in the image after the 12-byte header. Unlike lzhuf.c, TeleDisk
+ * does not store the uncompressed length, so decompression simply runs until the
+ * input is exhausted.
+ *
+ * The decoder follows lzhuf.c closely, since it has to agree bit for bit with the
+ * model TeleDisk used. The encoder produces a compatible stream, but finds its
+ * matches with hash chains rather than lzhuf.c's binary trees, so its output is
+ * not byte-identical to TeleDisk's.
+ */
+
+const (
+	lzN         = 4096 // size of the ring buffer
+	lzF         = 60   // upper limit for match length
+	lzThreshold = 2    // matches must be longer than this to be encoded
+	nChar       = 256 - lzThreshold + lzF
+	tableSize   = nChar*2 - 1
+	rootNode    = tableSize - 1
+	maxFreq     = 0x8000
+	maxChain    = 256 // number of candidates the encoder examines per position
+)
+
+// upper 6 bits of a position: number of bits in the code, and the code itself
+var pLen = [64]uint8{
+	0x03, 0x04, 0x04, 0x04, 0x05, 0x05, 0x05, 0x05,
+	0x05, 0x05, 0x05, 0x05, 0x06, 0x06, 0x06, 0x06,
+	0x06, 0x06, 0x06, 0x06, 0x06, 0x06, 0x06, 0x06,
+	0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07,
+	0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07,
+	0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07, 0x07,
+	0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08,
+	0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08, 0x08,
+}
+
+var pCode = [64]uint8{
+	0x00, 0x20, 0x30, 0x40, 0x50, 0x58, 0x60, 0x68,
+	0x70, 0x78, 0x80, 0x88, 0x90, 0x94, 0x98, 0x9C,
+	0xA0, 0xA4, 0xA8, 0xAC, 0xB0, 0xB4, 0xB8, 0xBC,
+	0xC0, 0xC2, 0xC4, 0xC6, 0xC8, 0xCA, 0xCC, 0xCE,
+	0xD0, 0xD2, 0xD4, 0xD6, 0xD8, 0xDA, 0xDC, 0xDE,
+	0xE0, 0xE2, 0xE4, 0xE6, 0xE8, 0xEA, 0xEC, 0xEE,
+	0xF0, 0xF1, 0xF2, 0xF3, 0xF4, 0xF5, 0xF6, 0xF7,
+	0xF8, 0xF9, 0xFA, 0xFB, 0xFC, 0xFD, 0xFE, 0xFF,
+}
+
+// dCode and dLen are the decoding tables for pCode and pLen, indexed by the
+// first 8 bits of a position code.
+var dCode, dLen [256]uint8
+
+func init() {
+	for i := 0; i < 64; i++ {
+		shift := 8 - pLen[i]
+		for b := 0; b < 256; b++ {
+			if uint8(b)>>shift == pCode[i]>>shift {
+				dCode[b] = uint8(i)
+				dLen[b] = pLen[i]
+			}
+		}
+	}
+}
+
+// huffman is the adaptive Huffman tree shared by the encoder and decoder.
+type huffman struct {
+	freq [tableSize + 1]int
+	prnt [tableSize + nChar]int
+	son  [tableSize]int
+}
+
+func newHuffman() *huffman {
+	h := &huffman{}
+	for i := 0; i < nChar; i++ {
+		h.freq[i] = 1
+		h.son[i] = i + tableSize
+		h.prnt[i+tableSize] = i
+	}
+	i := 0
+	for j := nChar; j <= rootNode; j++ {
+		h.freq[j] = h.freq[i] + h.freq[i+1]
+		h.son[j] = i
+		h.prnt[i] = j
+		h.prnt[i+1] = j
+		i += 2
+	}
+	h.freq[tableSize] = 0xffff
+	h.prnt[rootNode] = 0
+	return h
+}
+
+// reconst rebuilds the tree, halving every frequency.
+func (h *huffman) reconst() {
+	j := 0
+	for i := 0; i < tableSize; i++ {
+		if h.son[i] >= tableSize {
+			h.freq[j] = (h.freq[i] + 1) / 2
+			h.son[j] = h.son[i]
+			j++
+		}
+	}
+	for i, j := 0, nChar; j < tableSize; i, j = i+2, j+1 {
+		f := h.freq[i] + h.freq[i+1]
+		h.freq[j] = f
+		k := j - 1
+		for f < h.freq[k] {
+			k--
+		}
+		k++
+		copy(h.freq[k+1:j+1], h.freq[k:j])
+		h.freq[k] = f
+		copy(h.son[k+1:j+1], h.son[k:j])
+		h.son[k] = i
+	}
+	for i := 0; i < tableSize; i++ {
+		k := h.son[i]
+		h.prnt[k] = i
+		if k < tableSize {
+			h.prnt[k+1] = i
+		}
+	}
+}
+
+// update increments the frequency of character c and keeps the tree ordered.
+func (h *huffman) update(c int) {
+	if h.freq[rootNode] == maxFreq {
+		h.reconst()
+	}
+	c = h.prnt[c+tableSize]
+	for {
+		h.freq[c]++
+		k := h.freq[c]
+		l := c + 1
+		if k > h.freq[l] {
+			for k > h.freq[l+1] {
+				l++
+			}
+			h.freq[c] = h.freq[l]
+			h.freq[l] = k
+
+			i := h.son[c]
+			h.prnt[i] = l
+			if i < tableSize {
+				h.prnt[i+1] = l
+			}
+
+			j := h.son[l]
+			h.son[l] = i
+			h.prnt[j] = c
+			if j < tableSize {
+				h.prnt[j+1] = c
+			}
+			h.son[c] = j
+
+			c = l
+		}
+		c = h.prnt[c]
+		if c == 0 {
+			break
+		}
+	}
+}
+
+type bitReader struct {
+	data []byte
+	pos  int // in bits
+}
+
+func (b *bitReader) done() bool {
+	return b.pos >= len(b.data)*8
+}
+
+// bit returns the next bit, or 0 once the input is exhausted.
+func (b *bitReader) bit() int {
+	v := 0
+	if b.pos/8 < len(b.data) {
+		v = int(b.data[b.pos/8]>>(7-b.pos%8)) & 1
+	}
+	b.pos++
+	return v
+}
+
+func (b *bitReader) byte() int {
+	v := 0
+	for i := 0; i < 8; i++ {
+		v = (v << 1) | b.bit()
+	}
+	return v
+}
+
+type bitWriter struct {
+	data []byte
+	n    int // bits used in the last byte
+}
+
+// put writes the low count bits of v, most significant first.
+func (b *bitWriter) put(v uint, count int) {
+	for i := count - 1; i >= 0; i-- {
+		if b.n == 0 {
+			b.data = append(b.data, 0)
+		}
+		if v&(1<<i) != 0 {
+			b.data[len(b.data)-1] |= 0x80 >> b.n
+		}
+		b.n = (b.n + 1) % 8
+	}
+}
+
+func lzhufDecompress(data []byte) []byte {
+	h := newHuffman()
+	br := &bitReader{data: data}
+	out := []byte{}
+
+	var text [lzN]byte
+	for i := 0; i < lzN-lzF; i++ {
+		text[i] = ' '
+	}
+	r := lzN - lzF
+
+	for !br.done() {
+		// decode a character
+		c := h.son[rootNode]
+		for c < tableSize {
+			c = h.son[c+br.bit()]
+		}
+		c -= tableSize
+		h.update(c)
+
+		if c < 256 {
+			out = append(out, byte(c))
+			text[r] = byte(c)
+			r = (r + 1) & (lzN - 1)
+			continue
+		}
+
+		// decode the position of a match
+		i := br.byte()
+		pos := int(dCode[i]) << 6
+		for j := int(dLen[i]) - 2; j > 0; j-- {
+			i = (i << 1) + br.bit()
+		}
+		pos |= i & 0x3f
+
+		start := (r - pos - 1) & (lzN - 1)
+		length := c - 255 + lzThreshold
+		for k := 0; k < length; k++ {
+			b := text[(start+k)&(lzN-1)]
+			out = append(out, b)
+			text[r] = b
+			r = (r + 1) & (lzN - 1)
+		}
+	}
+	return out
+}
+
+func lzhufCompress(data []byte) []byte {
+	h := newHuffman()
+	bw := &bitWriter{}
+
+	encodeChar := func(c int) {
+		// walk from the leaf to the root, then emit the bits root first
+		bits := []uint{}
+		for k := h.prnt[c+tableSize]; k != rootNode; k = h.prnt[k] {
+			bits = append(bits, uint(k&1))
+		}
+		for i := len(bits) - 1; i >= 0; i-- {
+			bw.put(bits[i], 1)
+		}
+		h.update(c)
+	}
+
+	// the text is preceded by the spaces the ring buffer starts out with
+	buf := make([]byte, lzN-lzF, lzN-lzF+len(data))
+	for i := range buf {
+		buf[i] = ' '
+	}
+	buf = append(buf, data...)
+
+	hash := func(i int) int {
+		return (int(buf[i])<<8 ^ int(buf[i+1])<<4 ^ int(buf[i+2])) & 0xffff
+	}
+	head := make([]int, 0x10000)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int, len(buf))
+	insert := func(i int) {
+		if i+2 < len(buf) {
+			hv := hash(i)
+			prev[i] = head[hv]
+			head[hv] = i
+		}
+	}
+	for i := 0; i < lzN-lzF; i++ {
+		insert(i)
+	}
+
+	for a := lzN - lzF; a < len(buf); {
+		bestLen, bestDist := 0, 0
+		maxLen := min(lzF, len(buf)-a)
+		if maxLen > lzThreshold {
+			chain := 0
+			for q := head[hash(a)]; q >= 0 && a-q <= lzN-lzF && chain < maxChain; q = prev[q] {
+				chain++
+				n := 0
+				for n < maxLen && buf[q+n] == buf[a+n] {
+					n++
+				}
+				if n > bestLen {
+					bestLen, bestDist = n, a-q
+					if n == maxLen {
+						break
+					}
+				}
+			}
+		}
+
+		if bestLen > lzThreshold {
+			encodeChar(255 - lzThreshold + bestLen)
+			pos := bestDist - 1
+			bw.put(uint(pCode[pos>>6]>>(8-pLen[pos>>6])), int(pLen[pos>>6]))
+			bw.put(uint(pos&0x3f), 6)
+			for i := 0; i < bestLen; i++ {
+				insert(a + i)
+			}
+			a += bestLen
+		} else {
+			encodeChar(int(buf[a]))
+			insert(a)
+			a++
+		}
+	}
+
+	return bw.data
+}
@@ -0,0 +1,577 @@
+package td0
+
+/* Td0: TeleDisk reader/writer
+ *
+ * TeleDisk images start with a 12-byte header, optionally followed by a comment
+ * block, and then by each track in turn: a track header, and for each sector a
+ * sector header and usually a data block. The list of tracks ends with a track
+ * header whose sector count is 0xFF.
+ *
+ * Images with the signature "td" rather than "TD" use "advanced compression",
+ * where everything after the header is compressed with LZHUF (see lzhuf.c).
+ * Independently of that, each data block is encoded in one of three ways: stored
+ * as is, as a repeated two byte pattern, or as a run-length encoded sequence.
+ *
+ * The format was never published. This follows Dave Dunfield's notes on it, and
+ * the TeleDisk readers in MAME and libdsk. Images from TeleDisk 1.x, which used a
+ * different compression scheme, are not supported.
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	FlagDuplicate = 0x01 // sector appeared more than once on the track
+	FlagCRCError  = 0x02 // sector was read with a CRC error
+	FlagDeleted   = 0x04 // sector has a deleted data address mark
+	FlagSkipped   = 0x10 // sector was skipped as unallocated by DOS, no data block
+	FlagNoData    = 0x20 // sector ID was found but there was no data, no data block
+	FlagNoID      = 0x40 // data was found without a sector ID
+
+	headFM    = 0x80 // in the head byte of a track header, the track is FM
+	rateFM    = 0x80 // in the data rate of the header, the disk is FM
+	stepNotes = 0x80 // in the stepping byte of the header, a comment block follows
+	endOfDisk = 0xFF // sector count of the track header that ends the image
+
+	headerSize        = 12
+	commentHeaderSize = 10
+)
+
+type Sector struct {
+	Cylinder uint8 // as recorded in the sector ID
+	Head     uint8 // as recorded in the sector ID
+	Number   uint8
+	SizeCode uint8
+	Flags    uint8
+	Data     []byte // nil if the sector has no data block
+}
+
+type Track struct {
+	Cylinder      uint8
+	Head          uint8
+	FM            bool
+	SectorNumbers []uint8 // in the order they were recorded
+	Sectors       map[int]Sector
+}
+
+type TeleDisk struct {
+	FileName    string
+	Advanced    bool // "advanced compression", everything after the header is LZHUF compressed
+	Sequence    uint8
+	CheckSig    uint8
+	Version     uint8
+	DataRate    uint8
+	DriveType   uint8
+	Stepping    uint8
+	DOSAlloc    uint8
+	Sides       uint8
+	Comment     []byte // nil if there is no comment block
+	CommentTime time.Time
+	Tracks      map[int]map[int]*Track
+	CylCount    int
+	HeadCount   int
+}
+
+func NewTeleDisk() *TeleDisk {
+	td := &TeleDisk{}
+	return td
+}
+
+// crc is the CRC used throughout TeleDisk images: polynomial 0xA097, initial
+// value 0.
+func crc(data []byte) uint16 {
+	value := uint16(0)
+	for _, b := range data {
+		value ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if value&0x8000 != 0 {
+				value = (value << 1) ^ 0xA097
+			} else {
+				value <<= 1
+			}
+		}
+	}
+	return value
+}
+
+// IsTeleDisk returns true if data starts with a TeleDisk header. The header CRC
+// is checked as well as the signature, since two bytes alone are easily matched
+// by accident.
+func IsTeleDisk(data []byte) bool {
+	if len(data) < headerSize {
+		return false
+	}
+	signature := string(data[:2])
+	return (signature == "TD" || signature == "td") && binary.LittleEndian.Uint16(data[10:12]) == crc(data[:10])
+}
+
+func (td *TeleDisk) SetTrack(track *Track) {
+	if td.Tracks == nil {
+		td.Tracks = make(map[int]map[int]*Track)
+	}
+	cTrack, okay := td.Tracks[int(track.Cylinder)]
+	if !okay {
+		cTrack = make(map[int]*Track)
+		td.Tracks[int(track.Cylinder)] = cTrack
+	}
+	cTrack[int(track.Head)] = track
+
+	td.CylCount = max(td.CylCount, int(track.Cylinder)+1)
+	td.HeadCount = max(td.HeadCount, int(track.Head)+1)
+}
+
+func (td *TeleDisk) Load(fileName string) error {
+	td.FileName = fileName
+	data, err := os.ReadFile(td.FileName)
+	if err != nil {
+		return fmt.Errorf("failed to read file: %w", err)
+	}
+	return td.Parse(data)
+}
+
+// Parse decodes a TeleDisk image held in memory.
+func (td *TeleDisk) Parse(data []byte) error {
+	if len(data) < headerSize {
+		return fmt.Errorf("file too short: expected at least %d bytes, got %d", headerSize, len(data))
+	}
+	signature := string(data[:2])
+	if signature != "TD" && signature != "td" {
+		return fmt.Errorf("invalid file format: expected 'TD' or 'td', got '%s'", data[:2])
+	}
+	if binary.LittleEndian.Uint16(data[10:12]) != crc(data[:10]) {
+		return fmt.Errorf("header CRC mismatch")
+	}
+
+	td.Advanced = signature == "td"
+	td.Sequence = data[2]
+	td.CheckSig = data[3]
+	td.Version = data[4]
+	td.DataRate = data[5]
+	td.DriveType = data[6]
+	td.Stepping = data[7]
+	td.DOSAlloc = data[8]
+	td.Sides = data[9]
+	td.Tracks = nil
+	td.CylCount = 0
+	td.HeadCount = 0
+	td.Comment = nil
+
+	data = data[headerSize:]
+	if td.Advanced {
+		if td.Version < 20 {
+			return fmt.Errorf("advanced compression from TeleDisk version %d.%d is not supported", td.Version/10, td.Version%10)
+		}
+		data = lzhufDecompress(data)
+	}
+
+	if td.Stepping&stepNotes != 0 {
+		if len(data) < commentHeaderSize {
+			return fmt.Errorf("comment block is truncated")
+		}
+		length := int(binary.LittleEndian.Uint16(data[2:4]))
+		if len(data) < commentHeaderSize+length {
+			return fmt.Errorf("comment block is truncated")
+		}
+		if binary.LittleEndian.Uint16(data[0:2]) != crc(data[2:commentHeaderSize+length]) {
+			return fmt.Errorf("comment block CRC mismatch")
+		}
+		td.CommentTime = time.Date(1900+int(data[4]), time.Month(data[5]+1), int(data[6]),
+			int(data[7]), int(data[8]), int(data[9]), 0, time.Local)
+		td.Comment = append([]byte{}, data[commentHeaderSize:commentHeaderSize+length]...)
+		data = data[commentHeaderSize+length:]
+	}
+
+	for {
+		if len(data) < 1 {
+			return fmt.Errorf("image ends without an end of disk marker")
+		}
+		if data[0] == endOfDisk {
+			break
+		}
+		if len(data) < 4 {
+			return fmt.Errorf("track header is truncated")
+		}
+		if uint8(crc(data[:3])) != data[3] {
+			return fmt.Errorf("track header CRC mismatch on track %d/%d", data[1], data[2]&^headFM)
+		}
+		track := &Track{
+			Cylinder: data[1],
+			Head:     data[2] &^ headFM,
+			FM:       data[2]&headFM != 0 || td.DataRate&rateFM != 0,
+			Sectors:  make(map[int]Sector),
+		}
+		count := int(data[0])
+		data = data[4:]
+
+		for i := 0; i < count; i++ {
+			if len(data) < 6 {
+				return fmt.Errorf("sector header is truncated on track %d/%d", track.Cylinder, track.Head)
+			}
+			sector := Sector{
+				Cylinder: data[0],
+				Head:     data[1],
+				Number:   data[2],
+				SizeCode: data[3],
+				Flags:    data[4],
+			}
+			data = data[6:]
+
+			if sector.Flags&(FlagSkipped|FlagNoData) == 0 {
+				if sector.SizeCode > 6 {
+					return fmt.Errorf("invalid size code %d for sector %d on track %d/%d", sector.SizeCode, sector.Number, track.Cylinder, track.Head)
+				}
+				var err error
+				var n int
+				sector.Data, n, err = decodeBlock(data, 128<<sector.SizeCode)
+				if err != nil {
+					return fmt.Errorf("sector %d on track %d/%d: %w", sector.Number, track.Cylinder, track.Head, err)
+				}
+				data = data[n:]
+			}
+
+			if _, exists := track.Sectors[int(sector.Number)]; exists {
+				// keep the first copy of a duplicated sector
+				continue
+			}
+			track.SectorNumbers = append(track.SectorNumbers, sector.Number)
+			track.Sectors[int(sector.Number)] = sector
+		}
+
+		td.SetTrack(track)
+	}
+
+	return nil
+}
+
+// decodeBlock decodes the data block at the start of data into a sector of the
+// given size, and returns the number of bytes the block occupied.
+func decodeBlock(data []byte, size int) ([]byte, int, error) {
+	if len(data) < 3 {
+		return nil, 0, fmt.Errorf("data block is truncated")
+	}
+	length := int(binary.LittleEndian.Uint16(data[0:2]))
+	if length < 1 || len(data) < 2+length {
+		return nil, 0, fmt.Errorf("data block is truncated")
+	}
+	method := data[2]
+	block := data[3 : 2+length]
+
+	sector := []byte{}
+	switch method {
+	case 0: // stored
+		sector = append(sector, block...)
+	case 1: // repeated two byte pattern
+		for len(block) >= 4 && len(sector) < size {
+			count := int(binary.LittleEndian.Uint16(block[0:2]))
+			for j := 0; j < count && len(sector) < size; j++ {
+				sector = append(sector, block[2], block[3])
+			}
+			block = block[4:]
+		}
+	case 2: // run-length encoded
+		for len(block) >= 2 && len(sector) < size {
+			if block[0] == 0 {
+				// literal run
+				count := int(block[1])
+				if len(block) < 2+count {
+					return nil, 0, fmt.Errorf("literal run is truncated")
+				}
+				sector = append(sector, block[2:2+count]...)
+				block = block[2+count:]
+			} else {
+				// a pattern of 2^n bytes, repeated
+				patternLen := 1 << block[0]
+				count := int(block[1])
+				if len(block) < 2+patternLen {
+					return nil, 0, fmt.Errorf("repeated run is truncated")
+				}
+				for j := 0; j < count && len(sector) < size; j++ {
+					sector = append(sector, block[2:2+patternLen]...)
+				}
+				block = block[2+patternLen:]
+			}
+		}
+	default:
+		return nil, 0, fmt.Errorf("unknown data block encoding %d", method)
+	}
+
+	if len(sector) != size {
+		return nil, 0, fmt.Errorf("data block holds %d bytes, expected %d", len(sector), size)
+	}
+	return sector, 2 + length, nil
+}
+
+// encodeBlock encodes a sector as a data block. Sectors that consist of a single
+// repeated two byte pattern, as freshly formatted sectors do, are stored as that
+// pattern, and other sectors are stored as is.
+func encodeBlock(sector []byte) []byte {
+	repeated := len(sector) >= 2 && len(sector)%2 == 0
+	for i := 2; repeated && i < len(sector); i++ {
+		if sector[i] != sector[i%2] {
+			repeated = false
+		}
+	}
+
+	var block []byte
+	if repeated {
+		block = []byte{1}
+		block = binary.LittleEndian.AppendUint16(block, uint16(len(sector)/2))
+		block = append(block, sector[0], sector[1])
+	} else {
+		block = append([]byte{0}, sector...)
+	}
+	return append(binary.LittleEndian.AppendUint16(nil, uint16(len(block))), block...)
+}
+
+func (td *TeleDisk) GetTD0() ([]byte, error) {
+	body := []byte{}
+
+	stepping := td.Stepping &^ stepNotes
+	if td.Comment != nil {
+		stepping |= stepNotes
+		t := td.CommentTime
+		if t.IsZero() {
+			t = time.Now()
+		}
+		comment := binary.LittleEndian.AppendUint16(nil, uint16(len(td.Comment)))
+		comment = append(comment, uint8(t.Year()-1900), uint8(t.Month()-1), uint8(t.Day()),
+			uint8(t.Hour()), uint8(t.Minute()), uint8(t.Second()))
+		comment = append(comment, td.Comment...)
+		body = binary.LittleEndian.AppendUint16(body, crc(comment))
+		body = append(body, comment...)
+	}
+
+	for i := 0; i < td.CylCount; i++ {
+		for j := 0; j < td.HeadCount; j++ {
+			track, ok := td.Tracks[i][j]
+			if !ok {
+				continue
+			}
+			head := track.Head
+			if track.FM {
+				head |= headFM
+			}
+			header := []byte{uint8(len(track.SectorNumbers)), track.Cylinder, head}
+			body = append(body, header...)
+			body = append(body, uint8(crc(header)))
+
+			for _, number := range track.SectorNumbers {
+				sector := track.Sectors[int(number)]
+				flags := sector.Flags &^ FlagDuplicate
+				if sector.Data == nil {
+					flags |= FlagNoData
+				} else {
+					flags &^= FlagSkipped | FlagNoData
+				}
+				body = append(body, sector.Cylinder, sector.Head, sector.Number, sector.SizeCode, flags)
+				if sector.Data == nil {
+					body = append(body, 0)
+				} else {
+					body = append(body, uint8(crc(sector.Data)))
+					body = append(body, encodeBlock(sector.Data)...)
+				}
+			}
+		}
+	}
+	body = append(body, endOfDisk, 0, 0, 0)
+
+	signature := "TD"
+	if td.Advanced {
+		signature = "td"
+		body = lzhufCompress(body)
+	}
+
+	data := []byte(signature)
+	data = append(data, td.Sequence, td.CheckSig, td.Version, td.DataRate, td.DriveType, stepping, td.DOSAlloc, td.Sides)
+	data = binary.LittleEndian.AppendUint16(data, crc(data))
+	data = append(data, body...)
+
+	return data, nil
+}
+
+// sortedNumbers returns the sector numbers of a track in ascending order.
+func (track *Track) sortedNumbers() []int {
+	numbers := []int{}
+	for _, n := range track.SectorNumbers {
+		numbers = append(numbers, int(n))
+	}
+	sort.Ints(numbers)
+	return numbers
+}
+
+func (td *TeleDisk) GetData() []byte {
+	data := []byte{}
+	for i := 0; i < td.CylCount; i++ {
+		for j := 0; j < td.HeadCount; j++ {
+			track, ok := td.Tracks[i][j]
+			if !ok {
+				continue
+			}
+			for _, n := range track.sortedNumbers() {
+				sector := track.Sectors[n]
+				if sector.Data == nil {
+					data = append(data, make([]byte, 128<<sector.SizeCode)...)
+				} else {
+					data = append(data, sector.Data...)
+				}
+			}
+		}
+	}
+	return data
+}
+
+func (td *TeleDisk) SetData(data []byte) {
+	for i := 0; i < td.CylCount; i++ {
+		for j := 0; j < td.HeadCount; j++ {
+			track, ok := td.Tracks[i][j]
+			if !ok {
+				continue
+			}
+			for _, n := range track.sortedNumbers() {
+				sector := track.Sectors[n]
+				secLen := min(128<<sector.SizeCode, len(data))
+				if sector.Data == nil {
+					sector.Data = make([]byte, 128<<sector.SizeCode)
+					track.Sectors[n] = sector
+				}
+				copy(sector.Data, data[:secLen])
+				data = data[secLen:]
+			}
+		}
+	}
+}
+
+// ReadSector returns the contents of a sector, or nil if the sector is not
+// present in the image or has no data.
+func (td *TeleDisk) ReadSector(cylinder int, head int, sector int) ([]byte, error) {
+	track, ok := td.Tracks[cylinder][head]
+	if !ok {
+		return nil, nil
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return nil, nil
+	}
+	return sec.Data, nil
+}
+
+// WriteSector replaces the contents of a sector that is present in the image. A
+// sector that was recorded without data gains a data block.
+func (td *TeleDisk) WriteSector(cylinder int, head int, sector int, data []byte) error {
+	track, ok := td.Tracks[cylinder][head]
+	if !ok {
+		return fmt.Errorf("track %d/%d is not present in the image", cylinder, head)
+	}
+	sec, ok := track.Sectors[sector]
+	if !ok {
+		return fmt.Errorf("sector %d of track %d/%d is not present in the image", sector, cylinder, head)
+	}
+	if sec.Data == nil {
+		sec.Data = make([]byte, 128<<sec.SizeCode)
+		track.Sectors[sector] = sec
+	}
+	copy(sec.Data, data)
+	return nil
+}
+
+// Geometry describes the tracks in the image. The format of cylinder 1 is taken
+// to be the normal format, and every track that differs from it is recorded as
+// an exception.
+func (td *TeleDisk) Geometry() *geometry.Geometry {
+	g := &geometry.Geometry{
+		Name:       "td0",
+		Cylinders:  td.CylCount,
+		Heads:      td.HeadCount,
+		Exceptions: map[geometry.Location]geometry.TrackFormat{},
+	}
+	normal := min(1, td.CylCount-1)
+	g.Track = td.trackFormat(td.Tracks[normal][0])
+	for c := 0; c < td.CylCount; c++ {
+		for h := 0; h < td.HeadCount; h++ {
+			tf := td.trackFormat(td.Tracks[c][h])
+			if tf != g.Track {
+				g.Exceptions[geometry.Location{Cylinder: c, Head: h}] = tf
+			}
+		}
+	}
+	return g
+}
+
+func (td *TeleDisk) trackFormat(track *Track) geometry.TrackFormat {
+	if track == nil || len(track.SectorNumbers) == 0 {
+		return geometry.TrackFormat{}
+	}
+	numbers := track.sortedNumbers()
+	return geometry.TrackFormat{
+		SectorSize:  128 << track.Sectors[numbers[0]].SizeCode,
+		SectorCount: len(numbers),
+		FirstSector: numbers[0],
+		FM:          track.FM,
+	}
+}
+
+// Save writes the image to the named file.
+func (td *TeleDisk) Save(fileName string) error {
+	data, err := td.GetTD0()
+	if err != nil {
+		return fmt.Errorf("failed to get TD0 data: %w", err)
+	}
+	td.FileName = fileName
+	return os.WriteFile(fileName, data, 0644)
+}
+
+// Format replaces the contents of the image with empty tracks laid out according
+// to the geometry. The header describes an 8" drive at 500 kbps, and the image is
+// written with advanced compression.
+func (td *TeleDisk) Format(g *geometry.Geometry) error {
+	td.Tracks = nil
+	td.CylCount = 0
+	td.HeadCount = 0
+	td.Advanced = true
+	td.Sequence = 0
+	td.CheckSig = 0
+	td.Version = 21
+	td.DataRate = 2  // 500 kbps
+	td.DriveType = 5 // 8"
+	td.Stepping = 0
+	td.DOSAlloc = 0
+	td.Sides = uint8(g.Heads)
+	td.Comment = []byte("Created by rmxtool")
+	td.CommentTime = time.Now()
+
+	for _, loc := range g.Tracks() {
+		tf := g.Format(loc.Cylinder, loc.Head)
+		sizeCode := 0
+		for 128<<sizeCode < tf.SectorSize {
+			sizeCode++
+		}
+		if 128<<sizeCode != tf.SectorSize || sizeCode > 6 {
+			return fmt.Errorf("sector size %d cannot be stored in a TD0 image", tf.SectorSize)
+		}
+		track := &Track{
+			Cylinder: uint8(loc.Cylinder),
+			Head:     uint8(loc.Head),
+			FM:       tf.FM,
+			Sectors:  make(map[int]Sector),
+		}
+		for i := 0; i < tf.SectorCount; i++ {
+			number := uint8(tf.FirstSector + i)
+			track.SectorNumbers = append(track.SectorNumbers, number)
+			track.Sectors[int(number)] = Sector{
+				Cylinder: uint8(loc.Cylinder),
+				Head:     uint8(loc.Head),
+				Number:   number,
+				SizeCode: uint8(sizeCode),
+				Data:     make([]byte, tf.SectorSize),
+			}
+		}
+		td.SetTrack(track)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package td0
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/sbelectronics/rmxtool/pkg/geometry"
+	"github.com/stretchr/testify/suite"
+	"math/rand"
+	"testing"
+)
+
+type TD0Suite struct {
+	suite.Suite
+}
+
+func (s *TD0Suite) TestLZHUFRoundTrip() {
+	rng := rand.New(rand.NewSource(1))
+
+	random := make([]byte, 20000)
+	rng.Read(random)
+
+	text := []byte{}
+	words := []string{"sing ", "to me ", "of the man, ", "Muse, ", "the man of twists and turns\r\n"}
+	for len(text) < 100000 {
+		text = append(text, words[rng.Intn(len(words))]...)
+	}
+
+	for name, data := range map[string][]byte{
+		"empty":  {},
+		"short":  []byte("ab"),
+		"spaces": bytes.Repeat([]byte(" "), 5000),
+		"zeros":  make([]byte, 70000),
+		"random": random,
+		"text":   text,
+	} {
+		compressed := lzhufCompress(data)
+		decompressed := lzhufDecompress(compressed)
+		// the decoder may produce trailing garbage from the padding bits
+		s.Require().GreaterOrEqual(len(decompressed), len(data), name)
+		s.Equal(data, decompressed[:len(data)], name)
+	}
+}
+
+func (s *TD0Suite) TestImageRoundTrip() {
+	g, err := geometry.Parse("intel-dsdd")
+	s.Require().NoError(err)
+
+	for _, advanced := range []bool{false, true} {
+		td := NewTeleDisk()
+		s.Require().NoError(td.Format(g))
+		td.Advanced = advanced
+
+		data := td.GetData()
+		s.Equal(g.Size(), len(data))
+		for i := range data {
+			data[i] = byte(i * 7 / 3)
+		}
+		td.SetData(data)
+
+		image, err := td.GetTD0()
+		s.Require().NoError(err)
+		s.True(IsTeleDisk(image))
+
+		loaded := NewTeleDisk()
+		s.Require().NoError(loaded.Parse(image))
+		s.Equal(advanced, loaded.Advanced)
+		s.Equal(td.Comment, loaded.Comment)
+		s.Equal(data, loaded.GetData())
+		s.Equal(g.Format(0, 0), loaded.Geometry().Format(0, 0))
+		s.Equal(g.Format(40, 1), loaded.Geometry().Format(40, 1))
+	}
+}
+
+func (s *TD0Suite) TestRLEBlock() {
+	// a literal run of 2 bytes, then the 2 byte pattern "xy" 63 times
+	block := []byte{2, 0, 2, 'a', 'b', 1, 63, 'x', 'y'}
+	block = append(binary.LittleEndian.AppendUint16(nil, uint16(len(block))), block...)
+
+	sector, n, err := decodeBlock(block, 128)
+	s.Require().NoError(err)
+	s.Equal(len(block), n)
+	s.Equal(append([]byte("ab"), bytes.Repeat([]byte("xy"), 63)...), sector)
+}
+
+func TestTD0Suite(t *testing.T) {
+	suite.Run(t, new(TD0Suite))
+}
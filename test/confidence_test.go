@@ -17,6 +17,7 @@ const (
 	TESTIMAGE     = "../test.work"
 	SRCIMAGE_IMD  = "../imdtest.save"
 	TESTIMAGE_IMD = "../imdtest-work.imd"
+	TESTIMAGE_SWP = "../test-swapped.work"
 )
 
 var (
@@ -394,6 +395,27 @@ func (s *ConfidenceSuite) TestWipeAndFillIMD() {
 	s.CheckDisk()
 }
 
+func (s *ConfidenceSuite) TestByteSwapDetect() {
+	input, err := os.ReadFile(SRCIMAGE)
+	s.Require().NoError(err)
+	for i := 0; i+1 < len(input); i += 2 {
+		input[i], input[i+1] = input[i+1], input[i]
+	}
+	err = os.WriteFile(TESTIMAGE_SWP, input, 0644)
+	s.Require().NoError(err)
+	defer func() {
+		_ = os.Remove(TESTIMAGE_SWP)
+	}()
+
+	out, errOut, err := s.run("info", "-f", TESTIMAGE_SWP)
+	s.NoError(err)
+	s.ShowIfError(err, out, errOut)
+	s.Contains(out, "swapped (detected)")
+	s.Contains(out, "Volume label: valid")
+
+	s.VerifyFiles(TESTIMAGE_SWP, SRCIMAGE_FILES)
+}
+
 func TestConfidenceSuite(t *testing.T) {
 	suite.Run(t, new(ConfidenceSuite))
 }